@@ -0,0 +1,222 @@
+package dhcp6c
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// Advertisement is an Advertise message received in answer to a Solicit.
+type Advertisement struct {
+	Message *dhcpv6.Message
+	// Peer is the address the Advertise came from.
+	Peer *net.UDPAddr
+	// Received is when the Advertise was received and RTT the time since
+	// the first Solicit was sent.
+	Received time.Time
+	RTT      time.Duration
+	// Preference is the value of the Preference option, 0 if absent.
+	Preference uint8
+	// Transmissions is the number of Solicit sent when it was received.
+	Transmissions int
+}
+
+func newAdvertisement(r *response, start time.Time, transmissions int) *Advertisement {
+	a := &Advertisement{
+		Message:       r.msg,
+		Received:      time.Now(),
+		Transmissions: transmissions,
+	}
+	a.Peer, _ = r.peer.(*net.UDPAddr)
+	a.RTT = a.Received.Sub(start)
+	if opt := r.msg.GetOneOption(dhcpv6.OptionPreference); opt != nil {
+		if b := opt.ToBytes(); len(b) == 1 {
+			a.Preference = b[0]
+		}
+	}
+	return a
+}
+
+// Prefixes returns the prefixes offered by the Advertise.
+func (a *Advertisement) Prefixes() []*dhcpv6.OptIAPrefix {
+	var prefixes []*dhcpv6.OptIAPrefix
+	for _, iapd := range a.Message.Options.IAPD() {
+		if status := iapd.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			continue
+		}
+		prefixes = append(prefixes, iapd.Options.Prefixes()...)
+	}
+	return prefixes
+}
+
+// Status returns the top level Status Code of the Advertise, nil if absent.
+func (a *Advertisement) Status() *dhcpv6.OptStatusCode {
+	return a.Message.Options.Status()
+}
+
+// valid tells if the Advertise offers something: RFC 8415 section 18.2.9,
+// the client must ignore Advertise without prefixes or addresses.
+func (a *Advertisement) valid() bool {
+	if status := a.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		return false
+	}
+	if len(a.Prefixes()) > 0 {
+		return true
+	}
+	for _, ia := range a.Message.Options.IANA() {
+		if len(ia.Options.Addresses()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// offered returns the number of IA_PD with prefixes and the shortest offered
+// prefix length (the biggest delegation).
+func (a *Advertisement) offered() (iapds int, length int) {
+	length = 129
+	for _, iapd := range a.Message.Options.IAPD() {
+		if status := iapd.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			continue
+		}
+		prefixes := iapd.Options.Prefixes()
+		if len(prefixes) > 0 {
+			iapds++
+		}
+		for _, p := range prefixes {
+			if l, _ := p.Prefix.Mask.Size(); l < length {
+				length = l
+			}
+		}
+	}
+	return iapds, length
+}
+
+// SelectionPolicy picks the Advertise to request among the collected ones,
+// nil if none is acceptable.
+type SelectionPolicy func(ads []*Advertisement) *Advertisement
+
+// ComparePreference orders Advertise messages from the best to the worst:
+// valid ones first, then by Preference, then by number of IA_PD served, then
+// by delegated prefix size and finally by arrival time.
+func ComparePreference(a, b *Advertisement) int {
+	if av, bv := a.valid(), b.valid(); av != bv {
+		if av {
+			return -1
+		}
+		return 1
+	}
+	if c := cmp.Compare(b.Preference, a.Preference); c != 0 {
+		return c
+	}
+	aIAPDs, aLength := a.offered()
+	bIAPDs, bLength := b.offered()
+	if c := cmp.Compare(bIAPDs, aIAPDs); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(aLength, bLength); c != 0 {
+		return c
+	}
+	return a.Received.Compare(b.Received)
+}
+
+// SelectByPreference is the RFC 8415 section 18.2.9 selection policy: the
+// valid Advertise with the highest preference, and the one offering the most
+// among equal preferences.
+func SelectByPreference(ads []*Advertisement) *Advertisement {
+	if len(ads) == 0 {
+		return nil
+	}
+	best := slices.MinFunc(ads, ComparePreference)
+	if !best.valid() {
+		return nil
+	}
+	return best
+}
+
+// SortAdvertisements sorts ads from the best to the worst according to
+// ComparePreference.
+func SortAdvertisements(ads []*Advertisement) {
+	slices.SortStableFunc(ads, ComparePreference)
+}
+
+// CollectAdvertises sends solicit and returns all the Advertise messages
+// received, in arrival order.
+//
+// As described in RFC 8415 section 18.2.1, the Advertise messages are
+// collected during the first retransmission timeout, unless one has a
+// preference of 255. If none was received, the first one received during the
+// following retransmissions is returned. The Advertise messages without
+// prefixes or addresses don't end the exchange: they are returned only once
+// the retransmissions give up.
+func (c *Client) CollectAdvertises(ctx context.Context, solicit *dhcpv6.Message) ([]*Advertisement, error) {
+	var ads []*Advertisement
+	if err := c.initialDelay(ctx, solicit.MessageType); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	first := true
+	transmissions := 0
+	err := c.retryFn(solicit.MessageType, func(timeout time.Duration) error {
+		if solicit.GetOneOption(dhcpv6.OptionElapsedTime) != nil {
+			solicit.UpdateOption(dhcpv6.OptElapsedTime(elapsedSince(start)))
+		}
+		ch, rem, err := c.send(c.serverAddr, solicit)
+		if err != nil {
+			return err
+		}
+		transmissions++
+		c.logger.PrintMessage("sent message", solicit)
+		defer rem()
+		collecting := first
+		first = false
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-c.done:
+				return ErrNoResponse
+
+			case <-timer.C:
+				// the Advertise without prefixes don't end the exchange
+				if slices.ContainsFunc(ads, (*Advertisement).valid) {
+					return nil
+				}
+				return errDeadlineExceeded
+
+			case <-ctx.Done():
+				if len(ads) > 0 {
+					return nil
+				}
+				return ctx.Err()
+
+			case resp := <-ch:
+				if resp.msg.MessageType != dhcpv6.MessageTypeAdvertise {
+					continue
+				}
+				c.logger.PrintMessage("received message", resp.msg)
+				ad := newAdvertisement(resp, start, transmissions)
+				ads = append(ads, ad)
+				if ad.valid() && (ad.Preference == 255 || !collecting) {
+					return nil
+				}
+			}
+		}
+	})
+	if err == errDeadlineExceeded {
+		if len(ads) > 0 {
+			return ads, nil
+		}
+		return nil, ErrNoResponse
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ads, nil
+}
@@ -0,0 +1,65 @@
+package dhcp6c_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/fakeserver"
+)
+
+// collect solicits a /56 from srv and returns the Advertise messages.
+func collect(t *testing.T, srv *fakeserver.Server) ([]*dhcp6c.Advertisement, error) {
+	t.Helper()
+	client, err := dhcp6c.NewWithConn(srv.Pipe(), testMAC, dhcp6c.WithTimeout(50*time.Millisecond), dhcp6c.WithRetry(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	solicit, err := dhcp6c.NewSolicit(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC}, dhcp6c.WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{
+		Prefix: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(56, 128)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.CollectAdvertises(context.Background(), solicit)
+}
+
+func TestCollectAdvertisesNoPrefixAvail(t *testing.T) {
+	// the Advertise without prefix doesn't end the exchange, the Solicit is
+	// retransmitted until one offers a prefix
+	srv := fakeserver.New(fakeserver.Scenario{
+		Faults: []fakeserver.Fault{{Type: dhcpv6.MessageTypeSolicit, Count: 1, IAPDStatus: iana.StatusNoPrefixAvail}},
+		Logf:   t.Logf,
+	})
+	ads, err := collect(t, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads) != 2 || len(ads[0].Prefixes()) != 0 || len(ads[1].Prefixes()) != 1 {
+		t.Fatalf("got %d advertises, want the NoPrefixAvail one then one with a prefix", len(ads))
+	}
+	if ads[1].Transmissions != 2 {
+		t.Errorf("prefix advertised after %d Solicit, want 2", ads[1].Transmissions)
+	}
+}
+
+func TestCollectAdvertisesNoPrefixAvailOnly(t *testing.T) {
+	// the Advertise without prefix are returned once the retransmissions
+	// give up, for the caller to report the status
+	srv := fakeserver.New(fakeserver.Scenario{
+		Faults: []fakeserver.Fault{{Type: dhcpv6.MessageTypeSolicit, IAPDStatus: iana.StatusNoPrefixAvail}},
+		Logf:   t.Logf,
+	})
+	ads, err := collect(t, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countMessages(srv, dhcpv6.MessageTypeSolicit); n != 3 || len(ads) != 3 {
+		t.Errorf("got %d advertises to %d Solicit, want 3 of each", len(ads), n)
+	}
+}
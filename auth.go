@@ -0,0 +1,167 @@
+package dhcp6c
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Authentication protocols, RFC 8415 section 20 and RFC 3118.
+const (
+	AuthProtocolConfigurationToken uint8 = 0
+	// AuthProtocolDelayedV4 is the RFC 3118 (DHCPv4) delayed authentication
+	AuthProtocolDelayedV4      uint8 = 1
+	AuthProtocolDelayed        uint8 = 2
+	AuthProtocolReconfigureKey uint8 = 3
+)
+
+// Authentication algorithms.
+const (
+	AuthAlgorithmHMACMD5 uint8 = 1
+)
+
+// Replay detection methods.
+const (
+	RDMMonotonicCounter uint8 = 0
+)
+
+// Reconfigure Key authentication information types, RFC 8415 section 20.4.1.
+const (
+	reconfigureKeyValue  uint8 = 1
+	reconfigureKeyDigest uint8 = 2
+)
+
+// authHeaderLen is the size of the authentication option before the
+// authentication information.
+const authHeaderLen = 11
+
+// OptAuth is the Authentication option, RFC 8415 section 21.11.
+type OptAuth struct {
+	Protocol        uint8
+	Algorithm       uint8
+	RDM             uint8
+	ReplayDetection uint64
+	AuthInfo        []byte
+}
+
+// Code returns the option code.
+func (op *OptAuth) Code() dhcpv6.OptionCode {
+	return dhcpv6.OptionAuth
+}
+
+// ToBytes serializes the option.
+func (op *OptAuth) ToBytes() []byte {
+	b := make([]byte, authHeaderLen, authHeaderLen+len(op.AuthInfo))
+	b[0] = op.Protocol
+	b[1] = op.Algorithm
+	b[2] = op.RDM
+	binary.BigEndian.PutUint64(b[3:], op.ReplayDetection)
+	return append(b, op.AuthInfo...)
+}
+
+// FromBytes parses the option data (without code and length).
+func (op *OptAuth) FromBytes(data []byte) error {
+	if len(data) < authHeaderLen {
+		return fmt.Errorf("authentication option too short: %d bytes", len(data))
+	}
+	op.Protocol = data[0]
+	op.Algorithm = data[1]
+	op.RDM = data[2]
+	op.ReplayDetection = binary.BigEndian.Uint64(data[3:])
+	op.AuthInfo = append([]byte(nil), data[authHeaderLen:]...)
+	return nil
+}
+
+func (op *OptAuth) String() string {
+	return fmt.Sprintf("%s: {Protocol=%d Algorithm=%d RDM=%d ReplayDetection=%d AuthInfo=%#x}",
+		op.Code(), op.Protocol, op.Algorithm, op.RDM, op.ReplayDetection, op.AuthInfo)
+}
+
+// GetAuth returns the first Authentication option of msg, nil if there's none
+// or it can't be parsed.
+func GetAuth(msg *dhcpv6.Message) *OptAuth {
+	opt := msg.GetOneOption(dhcpv6.OptionAuth)
+	if opt == nil {
+		return nil
+	}
+	return parseAuth(opt)
+}
+
+// authOptions returns all the Authentication options of msg in order, nil
+// for the ones that can't be parsed: the index of an option is the one
+// authInfoBounds expects.
+func authOptions(msg *dhcpv6.Message) []*OptAuth {
+	var auths []*OptAuth
+	for _, opt := range msg.Options.Get(dhcpv6.OptionAuth) {
+		auths = append(auths, parseAuth(opt))
+	}
+	return auths
+}
+
+func parseAuth(opt dhcpv6.Option) *OptAuth {
+	if auth, ok := opt.(*OptAuth); ok {
+		return auth
+	}
+	auth := &OptAuth{}
+	if err := auth.FromBytes(opt.ToBytes()); err != nil {
+		return nil
+	}
+	return auth
+}
+
+// authInfoBounds returns the bounds of the authentication information of the
+// n-th Authentication option (from 0) in the raw message b, -1 if there is no
+// such option.
+func authInfoBounds(b []byte, n int) (int, int) {
+	// message type and transaction ID
+	off := 4
+	for off+4 <= len(b) {
+		code := dhcpv6.OptionCode(binary.BigEndian.Uint16(b[off:]))
+		length := int(binary.BigEndian.Uint16(b[off+2:]))
+		if off+4+length > len(b) {
+			return -1, -1
+		}
+		if code == dhcpv6.OptionAuth {
+			if n == 0 {
+				if length < authHeaderLen {
+					return -1, -1
+				}
+				return off + 4 + authHeaderLen, off + 4 + length
+			}
+			n--
+		}
+		off += 4 + length
+	}
+	return -1, -1
+}
+
+// hmacMD5 returns the HMAC-MD5 digest of raw computed with the digest (the
+// last 16 bytes of the authentication information of the n-th Authentication
+// option) set to zero.
+func hmacMD5(raw []byte, n int, key []byte) ([]byte, error) {
+	start, end := authInfoBounds(raw, n)
+	if start < 0 || end-start < md5.Size {
+		return nil, errors.New("no HMAC-MD5 digest in authentication option")
+	}
+	b := bytes.Clone(raw)
+	clear(b[end-md5.Size : end])
+	mac := hmac.New(md5.New, key)
+	mac.Write(b)
+	return mac.Sum(nil), nil
+}
+
+// validHMACMD5 checks the HMAC-MD5 digest of the n-th Authentication option
+// in raw.
+func validHMACMD5(raw []byte, n int, key []byte) bool {
+	digest, err := hmacMD5(raw, n, key)
+	if err != nil {
+		return false
+	}
+	_, end := authInfoBounds(raw, n)
+	return hmac.Equal(digest, raw[end-md5.Size:end])
+}
@@ -0,0 +1,275 @@
+package dhcp6c
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/nspeed-app/testdhcpv6pd/internal/atomicfile"
+)
+
+// ReplayCounter provides the replay detection values of the Authentication
+// options sent. They must increase monotonically.
+type ReplayCounter interface {
+	Next() (uint64, error)
+}
+
+// NTPCounter is a ReplayCounter using the current time as a 64 bits NTP
+// timestamp, as suggested by RFC 3118: it keeps increasing across restarts as
+// long as the clock doesn't go back.
+type NTPCounter struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+// ntpEpoch is the NTP era 0 origin.
+var ntpEpoch = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Next returns the current NTP timestamp, or the previous value plus one if
+// the clock went back.
+func (n *NTPCounter) Next() (uint64, error) {
+	d := time.Since(ntpEpoch)
+	sec := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	ts := sec<<32 | frac
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ts <= n.last {
+		ts = n.last + 1
+	}
+	n.last = ts
+	return ts, nil
+}
+
+// FileCounter is a ReplayCounter persisted in a file (as a decimal number),
+// so it keeps increasing across restarts.
+type FileCounter struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Next reads the last value from the file, increments it and stores it back.
+// A missing file starts the counter at 1.
+func (f *FileCounter) Next() (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var v uint64
+	b, err := os.ReadFile(f.Path)
+	switch {
+	case err == nil:
+		v, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad replay counter in %s: %v", f.Path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return 0, err
+	}
+	v++
+
+	// a crash can't lose the counter
+	if err := atomicfile.WriteFile(f.Path, []byte(strconv.FormatUint(v, 10)+"\n")); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// Authenticator builds the Authentication option of the messages sent and
+// validates the one of the Advertise and Reply messages received.
+//
+// Protocol 0 (configuration token) sends Info as is, so does any other
+// protocol but the delayed authentication protocols (1 from RFC 3118 and 2
+// from RFC 3315): they compute the HMAC-MD5 digest with Key, which is then
+// required.
+type Authenticator struct {
+	Protocol  uint8
+	Algorithm uint8
+	RDM       uint8
+
+	// Info is the authentication information of the protocols other than
+	// the delayed ones (the token of protocol 0).
+	Info []byte
+
+	// Realm (protocol 2 only) and KeyID identify the Key of the delayed
+	// authentication protocols.
+	Realm []byte
+	KeyID uint32
+	Key   []byte
+
+	// Counter provides the replay detection values, a NTPCounter if nil.
+	Counter ReplayCounter
+
+	// Required drops the received messages without an Authentication
+	// option.
+	Required bool
+
+	mu         sync.Mutex
+	ntpCounter NTPCounter
+	// replays holds the last replay detection value received per Server ID.
+	replays map[string]uint64
+}
+
+// delayed tells if a HMAC-MD5 digest is computed.
+func (a *Authenticator) delayed() bool {
+	return a.Protocol == AuthProtocolDelayedV4 || a.Protocol == AuthProtocolDelayed
+}
+
+// errNoKey is returned when a delayed authentication protocol has no Key.
+var errNoKey = errors.New("no key for the delayed authentication protocol")
+
+// authInfo returns the authentication information to send, without the
+// digest for the delayed protocols.
+func (a *Authenticator) authInfo() []byte {
+	if !a.delayed() {
+		return a.Info
+	}
+	var b []byte
+	if a.Protocol == AuthProtocolDelayed {
+		b = append(b, a.Realm...)
+	}
+	return binary.BigEndian.AppendUint32(b, a.KeyID)
+}
+
+// Sign adds (or updates) the Authentication option of msg, with a new replay
+// detection value and, for the delayed protocols, the HMAC-MD5 digest of msg.
+//
+// It must be called once msg is complete.
+func (a *Authenticator) Sign(msg *dhcpv6.Message) error {
+	if a.delayed() && a.Key == nil {
+		return errNoKey
+	}
+	counter := a.Counter
+	if counter == nil {
+		counter = &a.ntpCounter
+	}
+	replay, err := counter.Next()
+	if err != nil {
+		return err
+	}
+	auth := &OptAuth{
+		Protocol:        a.Protocol,
+		Algorithm:       a.Algorithm,
+		RDM:             a.RDM,
+		ReplayDetection: replay,
+		AuthInfo:        bytes.Clone(a.authInfo()),
+	}
+	if a.delayed() {
+		auth.AuthInfo = append(auth.AuthInfo, make([]byte, md5.Size)...)
+	}
+	msg.UpdateOption(auth)
+	if a.delayed() {
+		// UpdateOption replaced the first Authentication option
+		digest, err := hmacMD5(msg.ToBytes(), 0, a.Key)
+		if err != nil {
+			return err
+		}
+		copy(auth.AuthInfo[len(auth.AuthInfo)-md5.Size:], digest)
+	}
+	return nil
+}
+
+// Validate checks the Authentication options of a received message, raw are
+// the bytes received: one of them must use the protocol of a and validate. The
+// Reconfigure Key option of a Reply is only accepted in addition to it.
+func (a *Authenticator) Validate(msg *dhcpv6.Message, raw []byte) error {
+	if a.delayed() && a.Key == nil {
+		return errNoKey
+	}
+	auths := authOptions(msg)
+	if len(auths) == 0 {
+		if a.Required {
+			return errors.New("no authentication option")
+		}
+		return nil
+	}
+	var err error
+	for n, auth := range auths {
+		if auth == nil || auth.Protocol != a.Protocol {
+			continue
+		}
+		if err = a.check(auth, raw, n); err == nil {
+			return a.checkReplay(msg, auth)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("no authentication option of protocol %d", a.Protocol)
+}
+
+// check validates auth, the n-th Authentication option of the raw message.
+func (a *Authenticator) check(auth *OptAuth, raw []byte, n int) error {
+	if auth.Algorithm != a.Algorithm || auth.RDM != a.RDM {
+		return fmt.Errorf("unexpected authentication algorithm %d or RDM %d", auth.Algorithm, auth.RDM)
+	}
+	switch {
+	case a.Protocol == AuthProtocolConfigurationToken:
+		if !hmac.Equal(auth.AuthInfo, a.Info) {
+			return errors.New("invalid configuration token")
+		}
+	case a.delayed():
+		id := a.authInfo()
+		if len(auth.AuthInfo) != len(id)+md5.Size || !bytes.Equal(auth.AuthInfo[:len(id)], id) {
+			return errors.New("unknown authentication key")
+		}
+		if !validHMACMD5(raw, n, a.Key) {
+			return errors.New("invalid HMAC-MD5 digest")
+		}
+	}
+	return nil
+}
+
+// checkReplay checks that the replay detection value of auth increased since
+// the last message of the server.
+func (a *Authenticator) checkReplay(msg *dhcpv6.Message, auth *OptAuth) error {
+	if a.RDM != RDMMonotonicCounter {
+		return nil
+	}
+	var server string
+	if sid := msg.Options.ServerID(); sid != nil {
+		server = string(sid.ToBytes())
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if last, ok := a.replays[server]; ok && auth.ReplayDetection <= last {
+		return fmt.Errorf("replayed message (%d <= %d)", auth.ReplayDetection, last)
+	}
+	if a.replays == nil {
+		a.replays = make(map[string]uint64)
+	}
+	a.replays[server] = auth.ReplayDetection
+	return nil
+}
+
+// WithAuth returns a modifier adding the Authentication option built by a.
+// It must be the last modifier applied. Replay counter errors are ignored (no
+// option is added), use Sign to get them.
+//
+// The Client retransmissions change the Elapsed Time option, use
+// WithAuthenticator to sign each message sent instead.
+func WithAuth(a *Authenticator) dhcpv6.Modifier {
+	return func(d dhcpv6.DHCPv6) {
+		if msg, ok := d.(*dhcpv6.Message); ok {
+			_ = a.Sign(msg)
+		}
+	}
+}
+
+// WithAuthenticator signs every message sent with a and drops the Advertise
+// and Reply messages that a doesn't validate.
+func WithAuthenticator(a *Authenticator) ClientOpt {
+	return func(c *Client) {
+		c.auth = a
+	}
+}
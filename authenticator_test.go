@@ -0,0 +1,188 @@
+package dhcp6c
+
+import (
+	"crypto/md5"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+var testAuthKey = []byte("0123456789abcdef")
+
+// newAuthReply returns a Reply from the server with the link-layer address
+// ending with n.
+func newAuthReply(t *testing.T, n byte) *dhcpv6.Message {
+	t.Helper()
+	msg, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.MessageType = dhcpv6.MessageTypeReply
+	msg.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC}))
+	msg.AddOption(dhcpv6.OptServerID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, n}}))
+	return msg
+}
+
+func delayedAuthenticator(key []byte) *Authenticator {
+	return &Authenticator{
+		Protocol:  AuthProtocolDelayed,
+		Algorithm: AuthAlgorithmHMACMD5,
+		RDM:       RDMMonotonicCounter,
+		Realm:     []byte("example.net"),
+		KeyID:     7,
+		Key:       key,
+	}
+}
+
+// reconfigureKeyOption returns the Reconfigure Key option a server sends in a
+// Reply.
+func reconfigureKeyOption(replay uint64) *OptAuth {
+	return &OptAuth{
+		Protocol:        AuthProtocolReconfigureKey,
+		Algorithm:       AuthAlgorithmHMACMD5,
+		RDM:             RDMMonotonicCounter,
+		ReplayDetection: replay,
+		AuthInfo:        append([]byte{reconfigureKeyValue}, testReconfigureKey...),
+	}
+}
+
+func TestAuthenticatorSignValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		auth func() *Authenticator
+	}{
+		{"token", func() *Authenticator {
+			return &Authenticator{Protocol: AuthProtocolConfigurationToken, Info: []byte("fti/xxxxxxx")}
+		}},
+		{"delayed", func() *Authenticator { return delayedAuthenticator(testAuthKey) }},
+	} {
+		msg := newAuthReply(t, 1)
+		if err := tt.auth().Sign(msg); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := tt.auth().Validate(msg, msg.ToBytes()); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestAuthenticatorWrongKey(t *testing.T) {
+	msg := newAuthReply(t, 1)
+	if err := delayedAuthenticator([]byte("fedcba9876543210")).Sign(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := delayedAuthenticator(testAuthKey).Validate(msg, msg.ToBytes()); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("got error %v, want an invalid digest", err)
+	}
+
+	token := &Authenticator{Protocol: AuthProtocolConfigurationToken, Info: []byte("fti/yyyyyyy")}
+	if err := token.Sign(msg); err != nil {
+		t.Fatal(err)
+	}
+	token.Info = []byte("fti/xxxxxxx")
+	if err := token.Validate(msg, msg.ToBytes()); err == nil {
+		t.Error("validated another token")
+	}
+}
+
+func TestAuthenticatorReplay(t *testing.T) {
+	server := delayedAuthenticator(testAuthKey)
+	server.Counter = &FileCounter{Path: filepath.Join(t.TempDir(), "counter")}
+	client := delayedAuthenticator(testAuthKey)
+	first, second := newAuthReply(t, 1), newAuthReply(t, 1)
+	for _, msg := range []*dhcpv6.Message{first, second} {
+		if err := server.Sign(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Validate(first, first.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Validate(first, first.ToBytes()); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("got error %v for the replayed message", err)
+	}
+	if err := client.Validate(second, second.ToBytes()); err != nil {
+		t.Errorf("next message: %v", err)
+	}
+
+	// the counter is per server
+	other := newAuthReply(t, 2)
+	server.Counter = &FileCounter{Path: filepath.Join(t.TempDir(), "counter")}
+	if err := server.Sign(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Validate(other, other.ToBytes()); err != nil {
+		t.Errorf("first message of another server: %v", err)
+	}
+}
+
+func TestAuthenticatorReconfigureKey(t *testing.T) {
+	// a spoofed Reply with only a Reconfigure Key option is rejected
+	spoofed := newAuthReply(t, 1)
+	spoofed.AddOption(reconfigureKeyOption(1))
+	client := delayedAuthenticator(testAuthKey)
+	if err := client.Validate(spoofed, spoofed.ToBytes()); err == nil {
+		t.Error("validated a Reply with a Reconfigure Key option only")
+	}
+	client.Required = true
+	if err := client.Validate(spoofed, spoofed.ToBytes()); err == nil {
+		t.Error("validated a Reply with a Reconfigure Key option only, with Required")
+	}
+
+	// it's accepted besides a valid option of the protocol, in any order
+	msg := newAuthReply(t, 1)
+	msg.AddOption(reconfigureKeyOption(1))
+	server := delayedAuthenticator(testAuthKey)
+	auth := &OptAuth{
+		Protocol:        server.Protocol,
+		Algorithm:       server.Algorithm,
+		RDM:             server.RDM,
+		ReplayDetection: 1,
+		AuthInfo:        append(server.authInfo(), make([]byte, md5.Size)...),
+	}
+	msg.AddOption(auth)
+	digest, err := hmacMD5(msg.ToBytes(), 1, testAuthKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(auth.AuthInfo[len(auth.AuthInfo)-md5.Size:], digest)
+	if err := client.Validate(msg, msg.ToBytes()); err != nil {
+		t.Errorf("Reconfigure Key before the delayed authentication: %v", err)
+	}
+	if key, replay := reconfigureKey(msg); string(key) != string(testReconfigureKey) || replay != 1 {
+		t.Errorf("got Reconfigure Key %x (%d)", key, replay)
+	}
+
+	// a bad digest isn't saved by the Reconfigure Key option
+	raw := msg.ToBytes()
+	raw[len(raw)-1] ^= 1
+	if err := delayedAuthenticator(testAuthKey).Validate(msg, raw); err == nil {
+		t.Error("validated a tampered Reply")
+	}
+}
+
+func TestFileCounter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+	var last uint64
+	for i := range 3 {
+		// a new instance, like a new run
+		c := &FileCounter{Path: path}
+		for range 2 {
+			v, err := c.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v <= last {
+				t.Errorf("run %d: got %d after %d", i, v, last)
+			}
+			last = v
+		}
+	}
+	if last != 6 {
+		t.Errorf("got %d after 6 values, want 6", last)
+	}
+}
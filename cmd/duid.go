@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/google/uuid"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/nspeed-app/testdhcpv6pd/duid"
+)
+
+var (
+	optDUID2    = flag.String("den", "", "specify type 2 DUID-EN with an enterprise number and an identifier in hex digits (format: number:identifier)")
+	optDUIDMID  = flag.String("dmid", "", "derive the DUID from /etc/machine-id like systemd-networkd: vendor (DUID-EN, its default) or uuid (DUID-UUID)")
+	optDUIDFile = flag.String("dfile", "", "use the DUID saved by another client in this file (dhcpcd duid, dhclient leases, wide-dhcpv6 dhcp6c_duid or hex digits)")
+)
+
+// buildDUID returns the DUID of the DUID options, by default a DUID-LLT of
+// mac (the interface address) at the current time or -dlltt. explicit tells
+// if it was given on the command line.
+func buildDUID(mac net.HardwareAddr) (d dhcpv6.DUID, explicit bool, err error) {
+	t := dhcpv6.GetTime()
+	if *optDUID1T != 0 {
+		t = uint32(*optDUID1T)
+	}
+	var ds []dhcpv6.DUID
+	// type 1
+	if *optDUID1 != "" {
+		m, err := net.ParseMAC(*optDUID1)
+		if err != nil {
+			return nil, false, err
+		}
+		ds = append(ds, duid.LLT(m, t))
+	}
+	// type 2
+	if *optDUID2 != "" {
+		d, err := duid.ParseEN(*optDUID2)
+		if err != nil {
+			return nil, false, err
+		}
+		ds = append(ds, d)
+	}
+	// type 3
+	if *optDUID3 != "" {
+		m, err := net.ParseMAC(*optDUID3)
+		if err != nil {
+			return nil, false, err
+		}
+		ds = append(ds, duid.LL(m))
+	}
+	// type 4
+	if *optDUID4 != "" {
+		u, err := uuid.Parse(*optDUID4)
+		if err != nil {
+			return nil, false, err
+		}
+		ds = append(ds, duid.UUID(u))
+	}
+	if *optDUIDMID != "" {
+		id, err := duid.MachineID("")
+		if err != nil {
+			return nil, false, err
+		}
+		switch *optDUIDMID {
+		case "vendor":
+			ds = append(ds, duid.SystemdEN(id))
+		case "uuid":
+			ds = append(ds, duid.SystemdUUID(id))
+		default:
+			return nil, false, fmt.Errorf("bad -dmid value %q, expecting vendor or uuid", *optDUIDMID)
+		}
+	}
+	if *optDUIDFile != "" {
+		d, err := duid.ReadFile(*optDUIDFile)
+		if err != nil {
+			return nil, false, err
+		}
+		ds = append(ds, d)
+	}
+
+	switch len(ds) {
+	case 0:
+		return duid.LLT(mac, t), *optDUID1T != 0, nil
+	case 1:
+		return ds[0], true, nil
+	}
+	return nil, false, errors.New("DUID already specified")
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+
+	"nspeed.app/nspeed/utils"
+)
+
+// report is the document written to stdout with -json, nil otherwise.
+var report *jsonReport
+
+type jsonReport struct {
+	Interface string `json:"interface"`
+	DUID      string `json:"duid"`
+	// Advertises are all the Advertise received, best one first.
+	Advertises  []*jsonMessage   `json:"advertises,omitempty"`
+	Reply       *jsonMessage     `json:"reply,omitempty"`
+	Released    bool             `json:"released,omitempty"`
+	Information *jsonInformation `json:"information,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	// Extended is RENEW or REBIND when the lease saved by the previous run
+	// was extended instead of soliciting a new one, Reply then describes it.
+	Extended string `json:"extended,omitempty"`
+}
+
+type jsonStatus struct {
+	Code    uint16 `json:"code"`
+	Name    string `json:"name"`
+	Message string `json:"message,omitempty"`
+}
+
+type jsonPrefix struct {
+	Prefix string `json:"prefix"`
+	// lifetimes in seconds
+	Preferred uint32 `json:"preferred_lifetime"`
+	Valid     uint32 `json:"valid_lifetime"`
+}
+
+type jsonIAPD struct {
+	IAID     uint32       `json:"iaid"`
+	Hint     string       `json:"hint,omitempty"`
+	T1       uint32       `json:"t1"`
+	T2       uint32       `json:"t2"`
+	Status   *jsonStatus  `json:"status,omitempty"`
+	Prefixes []jsonPrefix `json:"prefixes"`
+}
+
+type jsonMessage struct {
+	Type            string      `json:"type"`
+	Selected        bool        `json:"selected,omitempty"`
+	ServerDUID      string      `json:"server_duid,omitempty"`
+	ServerAddress   string      `json:"server_address,omitempty"`
+	Preference      uint8       `json:"preference"`
+	Status          *jsonStatus `json:"status,omitempty"`
+	RTT             float64     `json:"rtt_ms"`
+	Retransmissions int         `json:"retransmissions"`
+	IAPDs           []*jsonIAPD `json:"iapds"`
+}
+
+type jsonInformation struct {
+	DNS          []string      `json:"dns,omitempty"`
+	DomainSearch []string      `json:"domain_search,omitempty"`
+	SNTP         []string      `json:"sntp,omitempty"`
+	NTP          []string      `json:"ntp,omitempty"`
+	AFTR         string        `json:"aftr,omitempty"`
+	S46          []*jsonS46    `json:"s46,omitempty"`
+	Other        []*jsonOption `json:"other_options,omitempty"`
+	// RefreshTime in seconds, Information-Request only
+	RefreshTime uint32 `json:"refresh_time,omitempty"`
+}
+
+type jsonPortParams struct {
+	Offset  uint8  `json:"offset"`
+	PSIDLen uint8  `json:"psid_len"`
+	PSID    uint16 `json:"psid"`
+}
+
+type jsonS46Rule struct {
+	FMR        bool            `json:"fmr,omitempty"`
+	EALen      uint8           `json:"ea_len"`
+	IPv4Prefix string          `json:"ipv4_prefix"`
+	IPv6Prefix string          `json:"ipv6_prefix"`
+	PortParams *jsonPortParams `json:"port_params,omitempty"`
+}
+
+type jsonS46Binding struct {
+	IPv4Address string          `json:"ipv4_address"`
+	IPv6Prefix  string          `json:"ipv6_prefix"`
+	PortParams  *jsonPortParams `json:"port_params,omitempty"`
+}
+
+// jsonS46 is a softwire container, in order of preference.
+type jsonS46 struct {
+	Mechanism string            `json:"mechanism"`
+	Rules     []*jsonS46Rule    `json:"rules,omitempty"`
+	BRs       []string          `json:"brs,omitempty"`
+	DMR       string            `json:"dmr,omitempty"`
+	Bindings  []*jsonS46Binding `json:"bindings,omitempty"`
+}
+
+// jsonOption is an option not decoded, its data in hex digits.
+type jsonOption struct {
+	Code uint16 `json:"code"`
+	Name string `json:"name,omitempty"`
+	Data string `json:"data"`
+}
+
+// print writes the report to stdout.
+func (r *jsonReport) print() {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fail reports err and exits, in the JSON document with -json.
+func fail(err error) {
+	if report != nil {
+		report.Error = err.Error()
+		report.print()
+		os.Exit(1)
+	}
+	log.Fatal(err)
+}
+
+func seconds(d time.Duration) uint32 {
+	return uint32(d / time.Second)
+}
+
+func anonymizeNet(n *net.IPNet) string {
+	return utils.AnonymizeIPNet(n, utils.FormatV4First, *optAnonymize)
+}
+
+// anonymizeAddr anonymizes a server address, link-local ones are displayed
+// as is.
+func anonymizeAddr(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	if addr.IP.IsLinkLocalUnicast() {
+		return addr.IP.String()
+	}
+	return strings.TrimSuffix(anonymizeNet(&net.IPNet{IP: addr.IP, Mask: net.CIDRMask(128, 128)}), "/128")
+}
+
+// anonymizeIP anonymizes an IPv4 or IPv6 address.
+func anonymizeIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.TrimSuffix(anonymizeNet(&net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}), "/32")
+	}
+	return strings.TrimSuffix(anonymizeNet(&net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}), "/128")
+}
+
+func newJSONStatus(s *dhcpv6.OptStatusCode) *jsonStatus {
+	if s == nil {
+		return nil
+	}
+	return &jsonStatus{Code: uint16(s.StatusCode), Name: s.StatusCode.String(), Message: s.StatusMessage}
+}
+
+// newJSONMessage describes the IA_PDs of msg, hints are the requested
+// prefixes indexed by IAID - 1.
+func newJSONMessage(msg *dhcpv6.Message, peer *net.UDPAddr, rtt time.Duration, transmissions int, hints []*net.IPNet) *jsonMessage {
+	m := &jsonMessage{
+		Type:            msg.MessageType.String(),
+		ServerAddress:   anonymizeAddr(peer),
+		Status:          newJSONStatus(msg.Options.Status()),
+		RTT:             float64(rtt) / float64(time.Millisecond),
+		Retransmissions: max(transmissions-1, 0),
+	}
+	if sid := msg.Options.ServerID(); sid != nil {
+		m.ServerDUID = hex.EncodeToString(sid.ToBytes())
+	}
+	m.IAPDs = newJSONIAPDs(msg.Options.IAPD(), hints)
+	return m
+}
+
+// newJSONLease describes the IA_PDs of an extended lease, hints are the
+// requested prefixes indexed by IAID - 1.
+func newJSONLease(lease *dhcp6c.Lease, hints []*net.IPNet) *jsonMessage {
+	return &jsonMessage{
+		Type:          dhcpv6.MessageTypeReply.String(),
+		ServerDUID:    hex.EncodeToString(lease.ServerID.ToBytes()),
+		ServerAddress: anonymizeAddr(lease.ServerAddr),
+		IAPDs:         newJSONIAPDs(lease.IAPDs, hints),
+	}
+}
+
+func newJSONIAPDs(iapds []*dhcpv6.OptIAPD, hints []*net.IPNet) []*jsonIAPD {
+	js := []*jsonIAPD{}
+	for _, iapd := range iapds {
+		j := &jsonIAPD{
+			IAID:     binary.BigEndian.Uint32(iapd.IaId[:]),
+			T1:       seconds(iapd.T1),
+			T2:       seconds(iapd.T2),
+			Status:   newJSONStatus(iapd.Options.Status()),
+			Prefixes: []jsonPrefix{},
+		}
+		if i := int(j.IAID) - 1; i >= 0 && i < len(hints) {
+			j.Hint = anonymizeNet(hints[i])
+		}
+		for _, p := range iapd.Options.Prefixes() {
+			j.Prefixes = append(j.Prefixes, jsonPrefix{
+				Prefix:    anonymizeNet(p.Prefix),
+				Preferred: seconds(p.PreferredLifetime),
+				Valid:     seconds(p.ValidLifetime),
+			})
+		}
+		js = append(js, j)
+	}
+	return js
+}
+
+// reportAdvertisements adds all the Advertise received to the report, best
+// one first.
+func reportAdvertisements(ads []*dhcp6c.Advertisement, selected *dhcp6c.Advertisement, hints []*net.IPNet) {
+	sorted := slices.Clone(ads)
+	dhcp6c.SortAdvertisements(sorted)
+	for _, a := range sorted {
+		m := newJSONMessage(a.Message, a.Peer, a.RTT, a.Transmissions, hints)
+		m.Preference = a.Preference
+		m.Selected = a == selected
+		report.Advertises = append(report.Advertises, m)
+	}
+}
+
+func newJSONPortParams(p *dhcp6c.S46PortParams) *jsonPortParams {
+	if p == nil {
+		return nil
+	}
+	return &jsonPortParams{Offset: p.Offset, PSIDLen: p.PSIDLen, PSID: p.PSID}
+}
+
+func newJSONS46(c *dhcp6c.OptS46Container) *jsonS46 {
+	j := &jsonS46{Mechanism: dhcp6c.S46Mechanism(c.Container)}
+	for _, r := range c.Rules {
+		j.Rules = append(j.Rules, &jsonS46Rule{
+			FMR:        r.FMR,
+			EALen:      r.EALen,
+			IPv4Prefix: anonymizeNet(r.IPv4Prefix),
+			IPv6Prefix: anonymizeNet(r.IPv6Prefix),
+			PortParams: newJSONPortParams(r.PortParams),
+		})
+	}
+	for _, br := range c.BRs {
+		j.BRs = append(j.BRs, anonymizeIP(br))
+	}
+	if c.DMR != nil {
+		j.DMR = anonymizeNet(c.DMR)
+	}
+	for _, b := range c.Bindings {
+		j.Bindings = append(j.Bindings, &jsonS46Binding{
+			IPv4Address: anonymizeIP(b.IPv4),
+			IPv6Prefix:  anonymizeNet(b.IPv6Prefix),
+			PortParams:  newJSONPortParams(b.PortParams),
+		})
+	}
+	return j
+}
+
+// reportInformation adds the configuration options to the report, with the
+// refresh time for a stateless one.
+func reportInformation(info *dhcp6c.Information, stateless bool) {
+	j := &jsonInformation{
+		DomainSearch: info.DomainSearch,
+		NTP:          info.NTPFQDN,
+		AFTR:         info.AFTR,
+	}
+	if stateless {
+		j.RefreshTime = seconds(info.RefreshTime)
+	}
+	for _, c := range info.S46 {
+		j.S46 = append(j.S46, newJSONS46(c))
+	}
+	for _, opt := range info.Other {
+		j.Other = append(j.Other, &jsonOption{
+			Code: uint16(opt.Code()),
+			Name: optionName(opt.Code()),
+			Data: hex.EncodeToString(opt.ToBytes()),
+		})
+	}
+	for _, ip := range info.DNS {
+		j.DNS = append(j.DNS, anonymizeIP(ip))
+	}
+	for _, ip := range info.SNTP {
+		j.SNTP = append(j.SNTP, anonymizeIP(ip))
+	}
+	for _, ip := range info.NTP {
+		j.NTP = append(j.NTP, anonymizeIP(ip))
+	}
+	report.Information = j
+}
+
+// checkIAPDs returns the error printIAPDs exits with.
+func checkIAPDs(msg *dhcpv6.Message) error {
+	iapds := msg.Options.IAPD()
+	if iapds == nil {
+		return errors.New("no IAPD found")
+	}
+	for _, iapd := range iapds {
+		if status := iapd.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			continue
+		}
+		if iapd.Options.Prefixes() == nil {
+			return errors.New("no prefix found")
+		}
+	}
+	return nil
+}
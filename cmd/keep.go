@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/downstream"
+	"github.com/nspeed-app/testdhcpv6pd/hooks"
+	"github.com/nspeed-app/testdhcpv6pd/store"
+
+	"nspeed.app/nspeed/utils"
+)
+
+// pathsFlag implement flag.Value interface
+type pathsFlag []string
+
+// String() for flag.Value interface
+func (p *pathsFlag) String() string {
+	return fmt.Sprintf("%v", *p)
+}
+
+// Set() for flag.Value interface
+func (p *pathsFlag) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+var optHooks pathsFlag
+
+// hookRunner runs the -hook executables, nil without -hook.
+var hookRunner *hooks.Runner
+
+// applier configures the -downstream interfaces, nil without -downstream.
+var applier *downstream.Applier
+
+// clientState keeps the identity and the lease across runs, nil with
+// -no-state and -test.
+var clientState *store.Store
+
+// onLease saves the lease, applies it to the downstream interfaces (or
+// removes what was applied if new is nil) and runs the hooks for reason,
+// failures are only logged.
+func onLease(reason hooks.Reason, old, new *dhcp6c.Lease) {
+	if clientState != nil {
+		if err := clientState.SetLease(new); err != nil {
+			log.Print(err)
+		}
+	}
+	if applier != nil {
+		var err error
+		if new != nil {
+			err = applier.Apply(new)
+		} else {
+			err = applier.Remove()
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	if hookRunner == nil {
+		return
+	}
+	if err := hookRunner.Run(context.Background(), reason, old, new); err != nil {
+		log.Print(err)
+	}
+}
+
+// newApplier returns the applier of the -downstream interfaces, logging the
+// changes instead of applying them with -downstream-dry-run.
+func newApplier(logger *myLogger) (*downstream.Applier, error) {
+	var ifaces []string
+	for _, name := range strings.Split(*optDownstream, ",") {
+		iface, err := parseInterface(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("downstream interface %s: %v", name, err)
+		}
+		ifaces = append(ifaces, iface.Name)
+	}
+	if *optDownstreamDryRun {
+		fake := downstream.NewFake()
+		fake.Logf = logger.Logger.Printf
+		return downstream.New(fake, ifaces...), nil
+	}
+	backend, err := downstream.NewNetlink()
+	if err != nil {
+		return nil, err
+	}
+	return downstream.New(backend, ifaces...), nil
+}
+
+// keepLease holds a lease with the lease manager until ctx is done, running
+// the hooks on each change, and releases it at the end with -release. A
+// restored lease (nil if none) is refreshed first.
+func keepLease(ctx context.Context, client *dhcp6c.Client, duid dhcpv6.DUID, restored *dhcp6c.Lease, modifiers ...dhcpv6.Modifier) error {
+	if restored != nil {
+		printLease(log.Default(), "restored", restored)
+	}
+	m := dhcp6c.NewLeaseManager(client, duid, modifiers...)
+	m.RequestedOptions = requestedOptions
+	m.AcceptReconfigure = *optReconf
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.Run(ctx, restored)
+	}()
+
+	var current *dhcp6c.Lease
+	for e := range m.Events() {
+		switch e.Type {
+		case dhcp6c.LeaseBound, dhcp6c.LeaseRenewed, dhcp6c.LeaseRebound:
+			reason := hooks.Bound
+			switch {
+			case current == nil && e.Type != dhcp6c.LeaseBound:
+				// the restored lease, hooked by the previous run
+				reason = hooks.Reboot
+			case current != nil && hooks.PrefixesChanged(current, e.Lease):
+				reason = hooks.Changed
+			case e.Type == dhcp6c.LeaseRenewed:
+				reason = hooks.Renew
+			case e.Type == dhcp6c.LeaseRebound:
+				reason = hooks.Rebind
+			}
+			printLease(log.Default(), e.Type.String(), e.Lease)
+			onLease(reason, current, e.Lease)
+			current = e.Lease
+		case dhcp6c.LeaseExpired:
+			log.Printf("lease expired: %s", e.Err)
+			onLease(hooks.Expire, e.Lease, nil)
+			current = nil
+		case dhcp6c.LeaseFailed:
+			log.Printf("lease: %s", e.Err)
+		case dhcp6c.LeaseReconfigured:
+			// saved so the Reconfigure can't be replayed after a restart
+			log.Printf("Reconfigure accepted")
+			if clientState != nil {
+				if err := clientState.SetLease(e.Lease); err != nil {
+					log.Print(err)
+				}
+			}
+			current = e.Lease
+		case dhcp6c.LeaseInformation:
+			printInformation(log.Default(), e.Information)
+		}
+	}
+	err := <-errc
+	if current != nil && *optRelease {
+		release(log.Default(), client, current)
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// printLease logs the prefixes of lease with the renewal time to l.
+func printLease(l *log.Logger, what string, lease *dhcp6c.Lease) {
+	for _, p := range lease.Prefixes() {
+		l.Printf("%s prefix = %s (pttl=%s,vttl=%s)\n", what, utils.AnonymizeIPNet(p.Prefix, utils.FormatV4First, *optAnonymize), p.PreferredLifetime, p.ValidLifetime)
+	}
+	l.Printf("next renew at %s", lease.RenewAt().Format("15:04:05"))
+}
@@ -3,20 +3,27 @@ package main
 import (
 	"context"
 	"encoding/binary"
-	"errors"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net"
 	"net/netip"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/iana"
 	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/hooks"
+	"github.com/nspeed-app/testdhcpv6pd/metrics"
+	"github.com/nspeed-app/testdhcpv6pd/monitor"
 
 	"nspeed.app/nspeed/utils"
 )
@@ -103,11 +110,60 @@ var (
 	optDUID3     = flag.String("dll", "", "specify type 3 DUID-LL using the provided mac address ( : or - separated digits)")
 	optDUID4     = flag.String("duu", "", "specify type 4 DUID-UUID (format: xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx)")
 	optDryRun    = flag.Bool("test", false, "dry-run only,  print the solicit paquet, nothing is send on the network")
+	optRequest   = flag.Bool("r", false, "do the full Solicit/Advertise/Request/Reply exchange and display the committed prefixes")
+	optRelease   = flag.Bool("release", false, "release the committed prefixes at the end or on interrupt (implies -r)")
+	optInfo      = flag.Bool("i", false, "send a stateless Information-Request (DNS, NTP, ...) instead of a Solicit")
+	optJSON      = flag.Bool("json", false, "write the results as a JSON document to stdout")
+	optKeep      = flag.Bool("keep", false, "keep the lease (Renew, Rebind, Solicit again on expiry) until interrupted, then release it with -release")
+	optReconf    = flag.Bool("reconfigure", false, "with -keep, accept the Reconfigure messages (authenticated with the Reconfigure Key of the server) asking to renew, rebind or refresh the information")
+	optRaw       = flag.Bool("raw", false, "use a raw socket (Linux only) instead of binding UDP port 546, to run alongside the DHCPv6 client of the system")
+	optMonitor   = flag.Duration("monitor", 0, "probe every interval (randomized, backing off on failures, 1m minimum) until interrupted and report the prefix changes")
+	optMetrics   = flag.String("metrics", "", "serve Prometheus metrics of -monitor on this address, e.g. :9547 (http://addr/metrics)")
+	optState     = flag.String("state", "", "file keeping the DUID, IAIDs, lease and replay counter (default is one per interface in the user cache directory), -monitor keeps its last probe next to it in monitor-<name>")
+	optNoState   = flag.Bool("no-state", false, "don't read nor write the state: a new DUID-LLT each run unless a DUID option is given")
+
+	optAuth        = flag.String("auth", "", "add an Authentication option (11) with the given protocol/algorithm/RDM, e.g. 0/0/0")
+	optAuthInfo    = flag.String("auth-info", "", "authentication information (the token of protocol 0): a string or 0x prefixed hex digits")
+	optAuthKey     = flag.String("auth-key", "", "HMAC-MD5 key of the delayed authentication protocols 1 and 2: a string or 0x prefixed hex digits")
+	optAuthRealm   = flag.String("auth-realm", "", "DHCP realm of the delayed authentication protocol 2")
+	optAuthKeyID   = flag.Uint("auth-keyid", 0, "key ID of the delayed authentication protocols 1 and 2")
+	optAuthCounter = flag.String("auth-counter", "", "file keeping the replay detection counter (default is the NTP time)")
 )
 
+var (
+	optDownstream       = flag.String("downstream", "", "comma separated interfaces each getting a /64 of the delegated prefixes and its ::1 address, with an unreachable route for the prefixes (Linux only, with -r or -keep)")
+	optDownstreamDryRun = flag.Bool("downstream-dry-run", false, "log the -downstream changes instead of applying them")
+	optPcap             = flag.String("pcap", "", "record the packets sent and received (dropped ones included) to this pcapng file")
+	optReplay           = flag.String("replay", "", "answer with the Advertise and Reply messages of this pcap/pcapng capture or hex file instead of the network (the interface needs not exist)")
+	optReplayDelays     = flag.Bool("replay-delays", false, "with -replay, answer after the recorded delays")
+	optTimeout          = flag.Duration("timeout", 10*time.Second, "give up a Solicit, Renew, Rebind or Information-Request unanswered for this long, retransmitted as per RFC 8415 until then (0 or -keep: until interrupted)")
+	optORO              = flag.String("oro", "", "comma separated option codes to request besides DNS and the domain search list, numbers or names: "+strings.Join(slices.Sorted(maps.Keys(optionNames)), ", "))
+)
+
+// optionNames are the names of the option codes accepted by -oro.
+var optionNames = map[string]dhcpv6.OptionCode{
+	"dns":     dhcpv6.OptionDNSRecursiveNameServer,
+	"domain":  dhcpv6.OptionDomainSearchList,
+	"sntp":    dhcpv6.OptionSNTPServerList,
+	"ntp":     dhcpv6.OptionNTPServer,
+	"aftr":    dhcpv6.OptionAFTRName,
+	"mape":    dhcpv6.OptionS46ContMapE,
+	"mapt":    dhcpv6.OptionS46ContMapT,
+	"lw4o6":   dhcpv6.OptionS46ContLW,
+	"s46prio": dhcpv6.OptionS46Priority,
+}
+
+// requestedOptions are the option codes of -oro.
+var requestedOptions []dhcpv6.OptionCode
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
 
 	flag.Var(&optPrefixes, "p", "ask for a specific prefix and/or length (repeatable, default is one prefix of ::/64)")
+	flag.Var(&optHooks, "hook", "run this executable, or the executables of this directory, when the prefixes are bound, renewed, changed, expired or released (repeatable)")
 	flag.Parse()
 
 	if *optVersion {
@@ -116,12 +172,29 @@ func main() {
 	}
 	if len(flag.Args()) != 1 {
 		fmt.Printf("Usage: %s [options] [interface name] or [interface index]\n", os.Args[0])
+		fmt.Printf("       %s serve [options] [interface name] or [interface index]\n", os.Args[0])
 		displayInterfaces()
 		fmt.Println("\nAvailable options:")
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
 
+	if *optMetrics != "" && *optMonitor == 0 {
+		log.Fatal("-metrics needs -monitor")
+	}
+	if *optDownstream != "" && !(*optRequest || *optRelease || *optKeep) {
+		log.Fatal("-downstream needs -r, -release or -keep")
+	}
+	if *optReconf && !*optKeep {
+		log.Fatal("-reconfigure needs -keep")
+	}
+	if *optKeep && (*optDryRun || *optInfo || *optMonitor > 0 || *optJSON) {
+		log.Fatal("-keep can't be used with -test, -i, -monitor or -json")
+	}
+	if *optMonitor > 0 && (*optDryRun || *optRequest || *optRelease || *optInfo) {
+		log.Fatal("-monitor can't be used with -test, -r, -release or -i")
+	}
+
 	// parse prefix(es)
 	if optPrefixes == nil {
 		optPrefixes = append(optPrefixes, "::/64")
@@ -138,22 +211,106 @@ func main() {
 
 	// parse interface
 	iface, err := parseInterface(flag.Args()[0])
+	if err != nil && *optReplay != "" {
+		// nothing is sent, a made up interface will do
+		iface, err = &net.Interface{Name: flag.Args()[0], HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}}, nil
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	if !*optNoDebug {
-		log.Printf("Sending a DHCPv6-PD Solicit on interface %s", iface.Name)
+		if *optInfo {
+			log.Printf("Sending a DHCPv6 Information-Request on interface %s", iface.Name)
+		} else if *optKeep {
+			log.Printf("Keeping a DHCPv6-PD lease on interface %s", iface.Name)
+		} else if *optMonitor > 0 {
+			log.Printf("Monitoring DHCPv6-PD on interface %s every %s", iface.Name, *optMonitor)
+		} else {
+			log.Printf("Sending a DHCPv6-PD Solicit on interface %s", iface.Name)
+		}
+	}
+
+	auth, err := parseAuth()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if requestedOptions, err = parseORO(*optORO); err != nil {
+		log.Fatal(err)
+	}
+	// a replay must not disturb the lease
+	if !*optNoState && !*optDryRun && *optReplay == "" {
+		if clientState, err = openClientState(iface.Name); err != nil {
+			log.Fatal(err)
+		}
+		if auth != nil && auth.Counter == nil {
+			auth.Counter = clientState
+		}
 	}
 
 	logger := NewMyLogger()
 	logger.Debug = !*optNoDebug
 	logger.Anonymize = *optAnonymize
+	if len(optHooks) > 0 {
+		hookRunner = hooks.NewRunner(iface.Name, optHooks...)
+		hookRunner.Logger = &logger
+	}
+	if *optDownstream != "" && !*optDryRun {
+		if applier, err = newApplier(&logger); err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts := []dhcp6c.ClientOpt{
+		dhcp6c.WithRetransmissions(),
+		dhcp6c.WithLogger(&logger),
+	}
+	if *optTimeout > 0 && !*optKeep {
+		for _, mt := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeInformationRequest} {
+			r := dhcp6c.DefaultRetransmissions[mt]
+			r.MRD = *optTimeout
+			opts = append(opts, dhcp6c.WithRetransmission(mt, r))
+		}
+	}
+	// the client signs each message it sends, but nothing is sent in dry-run
+	var authModifiers []dhcpv6.Modifier
+	if auth != nil {
+		opts = append(opts, dhcp6c.WithAuthenticator(auth))
+		if *optDryRun {
+			authModifiers = append(authModifiers, dhcp6c.WithAuth(auth))
+		}
+	}
+	if *optPcap != "" {
+		f, err := os.Create(*optPcap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		pcap, err := dhcp6c.NewPcapWriter(f, iface.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, dhcp6c.WithPcap(pcap))
+	}
 	var client *dhcp6c.Client
-	client, err = dhcp6c.New(iface.Name,
-		dhcp6c.WithTimeout(2*time.Second),
-		dhcp6c.WithRetry(1),
-		dhcp6c.WithLogger(&logger))
+	if *optReplay != "" {
+		var packets []*dhcp6c.ReplayPacket
+		packets, err = dhcp6c.ReadReplayFile(*optReplay)
+		if err != nil && len(packets) > 0 {
+			log.Printf("warning: %v, replaying the %d messages read", err, len(packets))
+			err = nil
+		}
+		if err == nil {
+			client, err = dhcp6c.NewWithConn(dhcp6c.NewReplayConn(packets, *optReplayDelays), iface.HardwareAddr, opts...)
+		}
+	} else if *optRaw {
+		var conn net.PacketConn
+		conn, err = dhcp6c.NewRawConn(iface.Name, dhcpv6.DefaultClientPort)
+		if err == nil {
+			client, err = dhcp6c.NewWithConn(conn, iface.HardwareAddr, opts...)
+		}
+	} else {
+		client, err = dhcp6c.New(iface.Name, opts...)
+	}
 
 	if err != nil {
 		log.Fatal(err)
@@ -166,175 +323,353 @@ func main() {
 		baddr.Zone = iface.Name
 		dhcp6c.WithBroadcastAddr(baddr)(client)
 	}
+	// default duid is type 1
+	duid, explicit, err := buildDUID(client.InterfaceAddr())
+	if err != nil {
+		log.Fatal(err)
+	}
+	// disabled for now, as it's not conform to the rfc
+	// if *optCID != "" {
+	// 	mac, err := net.ParseMAC(*optCID)
+	// 	if err != nil {
+	// 		log.Fatal(err)
+	// 	}
+	// 	modifiers = append(modifiers, dhcpv6.WithClientID(&dhcpv6.DUIDLLT{
+	// 		HWType:        iana.HWTypeEthernet,
+	// 		Time:          dhcpv6.GetTime(),
+	// 		LinkLayerAddr: mac,
+	// 	}))
+	// }
+
+	// the saved identity, a new one is saved
+	duid, iaids, err := clientIdentity(clientState, duid, explicit, len(prefixes))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// build solicit options
 	var modifiers []dhcpv6.Modifier
+	if requestedOptions != nil {
+		modifiers = append(modifiers, dhcp6c.WithRequestedOptions(requestedOptions...))
+	}
+	var hints []*net.IPNet
 	for i, prefix := range prefixes {
 		iaid := [4]byte{}
-		binary.BigEndian.PutUint32(iaid[:], uint32(i+1))
+		binary.BigEndian.PutUint32(iaid[:], iaids[i])
+		hint := &net.IPNet{
+			Mask: net.CIDRMask(prefix.Bits(), 128),
+			IP:   prefix.Addr().AsSlice(),
+		}
+		hints = append(hints, hint)
 		modifiers = append(modifiers, dhcp6c.WithIAPD(
 			iaid,
 			&dhcpv6.OptIAPrefix{
 				PreferredLifetime: 0,
 				ValidLifetime:     0,
-				Prefix: &net.IPNet{
-					Mask: net.CIDRMask(prefix.Bits(), 128),
-					IP:   prefix.Addr().AsSlice(),
-				},
-				Options: dhcpv6.PrefixOptions{Options: dhcpv6.Options{}},
+				Prefix:            hint,
+				Options:           dhcpv6.PrefixOptions{Options: dhcpv6.Options{}},
 			}))
 	}
 
-	/* https://datatracker.ietf.org/doc/html/rfc8415#section-11
+	// the lease of the previous run, if still valid
+	var restored *dhcp6c.Lease
+	if clientState != nil {
+		if restored, err = clientState.Lease(); err != nil {
+			log.Fatal(err)
+		}
+		if restored != nil && restored.ServerAddr != nil && restored.ServerAddr.IP.IsLinkLocalUnicast() {
+			restored.ServerAddr.Zone = iface.Name
+		}
+	}
 
-	   A DUID consists of a 2-octet type code represented in network byte
-	   order, followed by a variable number of octets that make up the
-	   actual identifier.  The length of the DUID (not including the type
-	   code) is at least 1 octet and at most 128 octets.  The following
-	   types are currently defined:
+	if *optKeep {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := keepLease(ctx, client, duid, restored, modifiers...); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	      +------+------------------------------------------------------+
-	      | Type | Description                                          |
-	      +------+------------------------------------------------------+
-	      | 1    | Link-layer address plus time                         |
-	      | 2    | Vendor-assigned unique ID based on Enterprise Number |
-	      | 3    | Link-layer address                                   |
-	      | 4    | Universally Unique Identifier (UUID) [RFC6355]       |
-	      +------+------------------------------------------------------+
+	if *optMonitor > 0 {
+		// the probes use the DUID and IAIDs of the client state, the
+		// last probe is kept next to it
+		var file string
+		state := &monitor.State{}
+		if clientState != nil {
+			if file, err = monitorStateFile(iface.Name); err != nil {
+				log.Fatal(err)
+			}
+			if state, err = monitor.LoadState(file); err != nil {
+				log.Fatal(err)
+			}
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		m := monitor.New(monitor.SolicitProbe(client, duid, modifiers...), *optMonitor, state)
+		m.StateFile = file
+		var exporter *metrics.Exporter
+		if *optMetrics != "" {
+			exporter = metrics.New()
+			exporter.AddClient(iface.Name, client)
+			if err := serveMetrics(*optMetrics, exporter); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := runMonitor(ctx, m, iface.Name, exporter); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	                            Table 2: DUID Types
+	if *optJSON {
+		report = &jsonReport{Interface: iface.Name, DUID: hex.EncodeToString(duid.ToBytes())}
+		defer report.print()
+	}
 
-	   Formats for the variable field of the DUID for the first three of the
-	   above types are shown below.  The fourth type, DUID-UUID [RFC6355],
-	   can be used in situations where there is a UUID stored in a device's
-	   firmware settings.
-	*/
+	// SIGINT cancels the exchange (and with -release, gives back what was obtained)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	// default duid is type 1
-	hmac := client.InterfaceAddr()
-	t := dhcpv6.GetTime()
-	DUIDset := false
-	if *optDUID1 != "" {
-		DUIDset = true
-		hmac, err = net.ParseMAC(*optDUID1)
-		if err != nil {
-			log.Fatal(err)
+	if *optInfo {
+		if err := information(ctx, *optDryRun, duid, client, authModifiers...); err != nil {
+			fail(err)
 		}
+		return
 	}
 
-	if *optDUID1T != 0 {
-		t = uint32(*optDUID1T)
+	if *optDryRun {
+		if _, err := Solicit(ctx, true, duid, client, append(modifiers, authModifiers...)...); err != nil {
+			fail(err)
+		}
+		return
+	}
+	o := &oneShot{
+		client:   client,
+		duid:     duid,
+		hints:    hints,
+		restored: restored,
+		timeout:  *optTimeout,
+		request:  *optRequest || *optRelease,
+		release:  *optRelease,
+		stop:     stop,
+		log:      log.Default(),
 	}
-	var duid dhcpv6.DUID = &dhcpv6.DUIDLLT{
-		HWType:        iana.HWTypeEthernet,
-		Time:          t,
-		LinkLayerAddr: hmac,
+	if err := o.run(ctx, modifiers...); err != nil {
+		fail(err)
 	}
+}
 
-	// type 2 ? (todo?)
+// release gives back the prefixes of lease, using its own timeout as the
+// main context may be already cancelled.
+func release(l *log.Logger, client *dhcp6c.Client, lease *dhcp6c.Lease) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Release(ctx, lease); err != nil {
+		if report != nil {
+			report.Error = fmt.Sprintf("release failed: %s", err)
+			return
+		}
+		l.Printf("release failed: %s", err)
+		return
+	}
+	onLease(hooks.Release, lease, nil)
+	if report != nil {
+		report.Released = true
+		return
+	}
+	for _, p := range lease.Prefixes() {
+		l.Printf("released prefix = %s\n", utils.AnonymizeIPNet(p.Prefix, utils.FormatV4First, *optAnonymize))
+	}
+}
 
-	// type 3
-	if *optDUID3 != "" {
-		if DUIDset {
-			log.Fatal("DUID already specified")
+// printIAPDs logs the prefixes of all the IA_PD options of msg, see
+// checkIAPDs for the missing ones. If timers is set, T1/T2 of each IA_PD are
+// also displayed.
+func printIAPDs(l *log.Logger, msg *dhcpv6.Message, what string, timers bool) {
+	for _, iapd := range msg.Options.IAPD() {
+		if timers {
+			l.Printf("IA_PD iaid=%#x (t1=%s,t2=%s)\n", iapd.IaId, iapd.T1, iapd.T2)
 		}
-		DUIDset = true
-		mac, err := net.ParseMAC(*optDUID3)
-		if err != nil {
-			log.Fatal(err)
+		if status := iapd.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			l.Printf("IA_PD iaid=%#x: %s\n", iapd.IaId, status)
+			continue
 		}
-		duid = &dhcpv6.DUIDLL{
-			HWType:        iana.HWTypeEthernet,
-			LinkLayerAddr: mac,
+		for _, p := range iapd.Options.Prefixes() {
+			l.Printf("%s = %s (pttl=%s,vttl=%s)\n", what, utils.AnonymizeIPNet(p.Prefix, utils.FormatV4First, *optAnonymize), p.PreferredLifetime, p.ValidLifetime)
 		}
+	}
+}
 
+// parseBytes parses a flag value given as a string or as 0x prefixed hex
+// digits (: separators allowed).
+func parseBytes(s string) ([]byte, error) {
+	if h, ok := strings.CutPrefix(s, "0x"); ok {
+		return hex.DecodeString(strings.ReplaceAll(h, ":", ""))
 	}
-	// type 4
-	if *optDUID4 != "" {
-		if DUIDset {
-			log.Fatal("DUID already specified")
-		}
-		DUIDset = true
-		uuid, err := uuid.Parse(*optDUID4)
+	return []byte(s), nil
+}
+
+// parseAuth builds the authenticator from the -auth* flags, nil if -auth is
+// not used.
+func parseAuth() (*dhcp6c.Authenticator, error) {
+	if *optAuth == "" {
+		return nil, nil
+	}
+	fields := strings.Split(*optAuth, "/")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("bad -auth value %q, expecting protocol/algorithm/RDM", *optAuth)
+	}
+	var values [3]uint8
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 8)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("bad -auth value %q: %v", *optAuth, err)
 		}
-		duid = &dhcpv6.DUIDUUID{
-			UUID: uuid,
+		values[i] = uint8(v)
+	}
+	auth := &dhcp6c.Authenticator{
+		Protocol:  values[0],
+		Algorithm: values[1],
+		RDM:       values[2],
+		Realm:     []byte(*optAuthRealm),
+		KeyID:     uint32(*optAuthKeyID),
+	}
+	var err error
+	if auth.Info, err = parseBytes(*optAuthInfo); err != nil {
+		return nil, fmt.Errorf("bad -auth-info value: %v", err)
+	}
+	if *optAuthKey != "" {
+		if auth.Key, err = parseBytes(*optAuthKey); err != nil {
+			return nil, fmt.Errorf("bad -auth-key value: %v", err)
 		}
 	}
-	// disabled for now, as it's not conform to the rfc
-	// if *optCID != "" {
-	// 	mac, err := net.ParseMAC(*optCID)
-	// 	if err != nil {
-	// 		log.Fatal(err)
-	// 	}
-	// 	modifiers = append(modifiers, dhcpv6.WithClientID(&dhcpv6.DUIDLLT{
-	// 		HWType:        iana.HWTypeEthernet,
-	// 		Time:          dhcpv6.GetTime(),
-	// 		LinkLayerAddr: mac,
-	// 	}))
-	// }
+	if auth.Key == nil && (auth.Protocol == dhcp6c.AuthProtocolDelayedV4 || auth.Protocol == dhcp6c.AuthProtocolDelayed) {
+		return nil, fmt.Errorf("-auth protocol %d needs -auth-key", auth.Protocol)
+	}
+	if *optAuthCounter != "" {
+		auth.Counter = &dhcp6c.FileCounter{Path: *optAuthCounter}
+	}
+	return auth, nil
+}
 
-	adv, err := Solicit(context.Background(), *optDryRun, duid, client, modifiers...)
+// information sends an Information-Request and displays the stateless
+// configuration found in the reply.
+func information(ctx context.Context, dryRun bool, duid dhcpv6.DUID, c *dhcp6c.Client, modifiers ...dhcpv6.Modifier) error {
+	if dryRun {
+		req, err := dhcp6c.NewInformationRequest(duid, modifiers...)
+		if err != nil {
+			return err
+		}
+		c.PrintMessage("will send:", req)
+		return nil
+	}
+	reply, err := c.InformationRequest(ctx, duid, dhcp6c.WithRequestedOptions(requestedOptions...))
+	if err != nil {
+		return err
+	}
+	info := dhcp6c.ParseInformation(reply)
+	if report != nil {
+		reportInformation(info, true)
+		return nil
+	}
+	printInformation(log.Default(), info)
+	log.Printf("information refresh time = %s\n", info.RefreshTime)
+	return nil
+}
 
-	// Summary() prints a verbose representation of the exchanged packets.
-	if adv != nil {
-		if adv.MessageType != dhcpv6.MessageTypeAdvertise {
-			log.Fatal("unexcepted message type")
+// printInformation logs the configuration options of a Reply (or Advertise).
+func printInformation(l *log.Logger, info *dhcp6c.Information) {
+	for _, ip := range info.DNS {
+		l.Printf("dns server = %s\n", anonymizeIP(ip))
+	}
+	for _, domain := range info.DomainSearch {
+		l.Printf("search domain = %s\n", domain)
+	}
+	for _, ip := range info.SNTP {
+		l.Printf("sntp server = %s\n", anonymizeIP(ip))
+	}
+	for _, ip := range info.NTP {
+		l.Printf("ntp server = %s\n", anonymizeIP(ip))
+	}
+	for _, name := range info.NTPFQDN {
+		l.Printf("ntp server = %s\n", name)
+	}
+	if info.AFTR != "" {
+		l.Printf("aftr = %s\n", info.AFTR)
+	}
+	for _, c := range info.S46 {
+		mechanism := dhcp6c.S46Mechanism(c.Container)
+		for _, r := range c.Rules {
+			kind := "bmr"
+			if r.FMR {
+				kind = "fmr"
+			}
+			l.Printf("%s rule = %s -> %s ea-len=%d (%s)%s\n", mechanism, anonymizeNet(r.IPv4Prefix), anonymizeNet(r.IPv6Prefix), r.EALen, kind, portParams(r.PortParams))
 		}
-		opts := adv.GetOption(dhcpv6.OptionIAPD)
-		if opts == nil {
-			log.Fatal("no IAPD found")
+		for _, br := range c.BRs {
+			l.Printf("%s br = %s\n", mechanism, anonymizeIP(br))
 		}
-		for _, opt := range opts {
-			iapd := dhcpv6.OptIAPD{}
-			if err := iapd.FromBytes(opt.ToBytes()); err != nil {
-				log.Fatal("cant parse iadp")
-			}
-			prefixes := iapd.Options.Prefixes()
-			if prefixes == nil {
-				log.Fatal("no prefix found")
-			}
-			for _, p := range prefixes {
-				log.Printf("got a prefix = %s (pttl=%s,vttl=%s)\n", utils.AnonymizeIPNet(p.Prefix, utils.FormatV4First, *optAnonymize), p.PreferredLifetime, p.ValidLifetime)
-			}
+		if c.DMR != nil {
+			l.Printf("%s dmr = %s\n", mechanism, anonymizeNet(c.DMR))
+		}
+		for _, b := range c.Bindings {
+			l.Printf("%s binding = %s -> %s%s\n", mechanism, anonymizeIP(b.IPv4), anonymizeNet(b.IPv6Prefix), portParams(b.PortParams))
 		}
 	}
-	// error handling is done *after* printing, so we still print the
-	// exchanged packets if any, as explained above.
-	if err != nil {
-		log.Fatal(err)
+	for _, opt := range info.Other {
+		switch _, generic := opt.(*dhcpv6.OptionGeneric); {
+		case !generic:
+			l.Printf("option %s\n", opt)
+		case optionName(opt.Code()) == "":
+			l.Printf("option %d = %x\n", opt.Code(), opt.ToBytes())
+		default:
+			l.Printf("option %s (%d) = %x\n", opt.Code(), opt.Code(), opt.ToBytes())
+		}
 	}
 }
 
-// NewSolicit creates a new SOLICIT message with given duid
-// derive the IAID in the IA_NA option.
-func NewSolicit(duid dhcpv6.DUID, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
-	if duid == nil {
-		return nil, errors.New("no duid")
+// optionName returns the name of code, empty if unknown.
+func optionName(code dhcpv6.OptionCode) string {
+	if name := code.String(); !strings.HasPrefix(name, "unknown") {
+		return name
 	}
+	return ""
+}
 
-	m, err := dhcpv6.NewMessage()
-	if err != nil {
-		return nil, err
+// portParams formats the port set of a S46 rule or binding, empty if nil.
+func portParams(p *dhcp6c.S46PortParams) string {
+	if p == nil {
+		return ""
+	}
+	return fmt.Sprintf(" psid=%#x psid-len=%d offset=%d", p.PSID, p.PSIDLen, p.Offset)
+}
+
+// parseORO parses the -oro option codes.
+func parseORO(s string) ([]dhcpv6.OptionCode, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var codes []dhcpv6.OptionCode
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if code, ok := optionNames[strings.ToLower(f)]; ok {
+			codes = append(codes, code)
+			continue
+		}
+		v, err := strconv.ParseUint(f, 10, 16)
+		if err != nil || v == 0 {
+			return nil, fmt.Errorf("bad -oro option code %q", f)
+		}
+		codes = append(codes, dhcpv6.OptionCode(v))
 	}
-	m.MessageType = dhcpv6.MessageTypeSolicit
-	m.AddOption(dhcpv6.OptClientID(duid))
-	m.AddOption(dhcpv6.OptRequestedOption(
-		dhcpv6.OptionDNSRecursiveNameServer,
-		dhcpv6.OptionDomainSearchList,
-	))
-	m.AddOption(dhcpv6.OptElapsedTime(0))
-	for _, mod := range modifiers {
-		mod(m)
-	}
-	return m, nil
+	return codes, nil
 }
 
-// Solicit sends a solicitation message and returns the first valid
-// advertisement received.
-func Solicit(ctx context.Context, dryRun bool, duid dhcpv6.DUID, c *dhcp6c.Client, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
-	solicit, err := NewSolicit(duid, modifiers...)
+// Solicit sends a solicitation message and returns the advertisements
+// received.
+func Solicit(ctx context.Context, dryRun bool, duid dhcpv6.DUID, c *dhcp6c.Client, modifiers ...dhcpv6.Modifier) ([]*dhcp6c.Advertisement, error) {
+	solicit, err := dhcp6c.NewSolicit(duid, modifiers...)
 	if err != nil {
 		return nil, err
 	}
@@ -342,9 +677,37 @@ func Solicit(ctx context.Context, dryRun bool, duid dhcpv6.DUID, c *dhcp6c.Clien
 		c.PrintMessage("will send:", solicit)
 		return nil, nil
 	}
-	msg, err := c.SendAndRead(ctx, c.RemoteAddr(), solicit, dhcp6c.IsMessageType(dhcpv6.MessageTypeAdvertise))
-	if err != nil {
-		return nil, err
+	return c.CollectAdvertises(ctx, solicit)
+}
+
+// printAdvertisements displays a comparison table of the servers that
+// answered, best one first, on the output of l.
+func printAdvertisements(l *log.Logger, ads []*dhcp6c.Advertisement) {
+	sorted := slices.Clone(ads)
+	dhcp6c.SortAdvertisements(sorted)
+	w := tabwriter.NewWriter(l.Writer(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tDUID\tPREF\tRTT\tSTATUS\tPREFIXES")
+	for _, a := range sorted {
+		status := "Success"
+		if s := a.Status(); s != nil {
+			status = s.StatusCode.String()
+		} else {
+			for _, iapd := range a.Message.Options.IAPD() {
+				if s := iapd.Options.Status(); s != nil && s.StatusCode != iana.StatusSuccess {
+					status = s.StatusCode.String()
+					break
+				}
+			}
+		}
+		var prefixes []string
+		for _, p := range a.Prefixes() {
+			prefixes = append(prefixes, utils.AnonymizeIPNet(p.Prefix, utils.FormatV4First, *optAnonymize))
+		}
+		if prefixes == nil {
+			prefixes = []string{"-"}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", a.Peer, a.Message.Options.ServerID(), a.Preference,
+			a.RTT.Round(time.Millisecond), status, strings.Join(prefixes, ","))
 	}
-	return msg, nil
+	w.Flush()
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/nspeed-app/testdhcpv6pd/metrics"
+	"github.com/nspeed-app/testdhcpv6pd/monitor"
+	"github.com/nspeed-app/testdhcpv6pd/store"
+)
+
+// jsonEvent is a line written to stdout for each monitor event with -json.
+type jsonEvent struct {
+	Time      string       `json:"time"`
+	Event     string       `json:"event"`
+	IAID      *uint32      `json:"iaid,omitempty"`
+	Old       []jsonPrefix `json:"old,omitempty"`
+	New       []jsonPrefix `json:"new,omitempty"`
+	OldServer string       `json:"old_server,omitempty"`
+	NewServer string       `json:"new_server,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// monitorStateFile returns the file keeping the last probe of -monitor:
+// monitor-<name> next to the client state file.
+func monitorStateFile(iface string) (string, error) {
+	file, err := stateFile(iface + ".json")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(file), "monitor-"+filepath.Base(file)), nil
+}
+
+// serveMetrics serves the metrics of exporter on /metrics at addr.
+func serveMetrics(addr string, exporter *metrics.Exporter) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	go func() {
+		log.Fatal(http.Serve(ln, mux))
+	}()
+	return nil
+}
+
+// runMonitor probes with Solicit messages every -monitor interval and prints
+// the changes until ctx is done. The events of interface iface also feed
+// exporter if not nil.
+func runMonitor(ctx context.Context, m *monitor.Monitor, iface string, exporter *metrics.Exporter) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.Run(ctx)
+	}()
+	for e := range m.Events() {
+		if exporter != nil {
+			exporter.Observe(iface, e)
+		}
+		if *optJSON {
+			printJSONEvent(e)
+		} else {
+			printEvent(e)
+		}
+	}
+	if err := <-errc; err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+func iapdPrefixes(iapd *monitor.IAPD) string {
+	if iapd == nil || len(iapd.Prefixes) == 0 {
+		return "-"
+	}
+	var s []string
+	for _, p := range iapd.Prefixes {
+		s = append(s, fmt.Sprintf("%s (pttl=%s,vttl=%s)", anonymizePrefix(p), p.Preferred, p.Valid))
+	}
+	return strings.Join(s, ", ")
+}
+
+func printEvent(e monitor.Event) {
+	switch e.Type {
+	case monitor.EventProbed:
+		if !*optNoDebug {
+			log.Printf("probe: server %s answered in %s", e.Result.ServerDUID, e.Result.RTT)
+		}
+	case monitor.EventProbeFailed:
+		log.Printf("probe failed: %s", e.Err)
+	case monitor.EventServerChanged:
+		log.Printf("%s: %s -> %s", e.Type, e.OldServer, e.NewServer)
+	default:
+		log.Printf("%s: IA_PD iaid=%#x %s -> %s", e.Type, e.IAID, iapdPrefixes(e.Old), iapdPrefixes(e.New))
+	}
+}
+
+func jsonPrefixes(iapd *monitor.IAPD) []jsonPrefix {
+	if iapd == nil {
+		return nil
+	}
+	var prefixes []jsonPrefix
+	for _, p := range iapd.Prefixes {
+		prefixes = append(prefixes, jsonPrefix{
+			Prefix:    anonymizePrefix(p),
+			Preferred: seconds(p.Preferred),
+			Valid:     seconds(p.Valid),
+		})
+	}
+	return prefixes
+}
+
+func printJSONEvent(e monitor.Event) {
+	j := jsonEvent{
+		Time:      e.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Event:     e.Type.String(),
+		Old:       jsonPrefixes(e.Old),
+		New:       jsonPrefixes(e.New),
+		OldServer: e.OldServer,
+		NewServer: e.NewServer,
+	}
+	switch e.Type {
+	case monitor.EventProbed, monitor.EventProbeFailed, monitor.EventServerChanged:
+	default:
+		j.IAID = &e.IAID
+	}
+	if e.Err != nil {
+		j.Error = e.Err.Error()
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
+
+func anonymizePrefix(p store.Prefix) string {
+	return anonymizeNet(&net.IPNet{IP: p.Prefix.Addr().AsSlice(), Mask: net.CIDRMask(p.Prefix.Bits(), 128)})
+}
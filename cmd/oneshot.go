@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/hooks"
+)
+
+// oneShot is the default run of the command line: a Solicit, followed by a
+// Request with -r or -release. The results are logged to log, or added to the
+// report with -json.
+type oneShot struct {
+	client *dhcp6c.Client
+	duid   dhcpv6.DUID
+	// hints are the requested prefixes, indexed by IAID - 1.
+	hints []*net.IPNet
+	// restored is the lease saved by the previous run, nil if none. With
+	// request, it's extended instead of soliciting a new one if possible,
+	// its prefixes are the hints of the Solicit otherwise.
+	restored *dhcp6c.Lease
+	// timeout bounds the Renew and the Rebind of restored, 0 means until
+	// T2 and until it expires.
+	timeout time.Duration
+	// request continues with a Request, release gives the committed
+	// prefixes back at the end.
+	request bool
+	release bool
+	// stop restores the default behaviour of Ctrl-C before releasing, may
+	// be nil.
+	stop func()
+	log  *log.Logger
+}
+
+// run solicits with modifiers and requests the selected Advertise. If ctx is
+// cancelled during the Request, the advertised prefixes are released with
+// release as the server may have committed them anyway.
+func (o *oneShot) run(ctx context.Context, modifiers ...dhcpv6.Modifier) error {
+	if o.restored != nil {
+		if o.request {
+			lease, mt, err := o.refresh(ctx)
+			if err == nil {
+				return o.extended(lease, mt)
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+			o.log.Printf("saved lease not extended (%v), soliciting its prefixes", err)
+		}
+		modifiers = append(modifiers, dhcp6c.WithLeaseHints(o.restored))
+	}
+
+	ads, err := Solicit(ctx, false, o.duid, o.client, modifiers...)
+
+	// the Advertise are displayed even if the exchange failed
+	var selected *dhcp6c.Advertisement
+	if len(ads) > 0 {
+		selected = dhcp6c.SelectByPreference(ads)
+		adv := ads[0].Message
+		if selected != nil {
+			adv = selected.Message
+		}
+		if err == nil {
+			err = checkIAPDs(adv)
+		}
+		if report != nil {
+			reportAdvertisements(ads, selected, o.hints)
+			if !o.request {
+				reportInformation(dhcp6c.ParseInformation(adv), false)
+			}
+		} else {
+			if len(ads) > 1 {
+				printAdvertisements(o.log, ads)
+			}
+			printIAPDs(o.log, adv, "got a prefix", false)
+			if !o.request {
+				printInformation(o.log, dhcp6c.ParseInformation(adv))
+			}
+		}
+	}
+	if err != nil || !o.request || len(ads) == 0 {
+		return err
+	}
+	if selected == nil {
+		return errors.New("no advertise with a prefix to request")
+	}
+	adv := selected.Message
+
+	// 4 messages exchange: request the advertised prefixes with our own DUID
+	request, err := dhcp6c.NewRequestFromAdvertise(adv, dhcpv6.WithClientID(o.duid), dhcp6c.WithRequestedOptions(requestedOptions...))
+	if err != nil {
+		return err
+	}
+	x, err := o.client.Exchange(ctx, o.client.RemoteAddr(), request, dhcp6c.IsMessageType(dhcpv6.MessageTypeReply))
+	if err != nil {
+		if o.release && ctx.Err() != nil {
+			o.releaseLease(&dhcp6c.Lease{
+				ClientID: o.duid,
+				ServerID: adv.Options.ServerID(),
+				IAPDs:    adv.Options.IAPD(),
+			})
+		}
+		return err
+	}
+	reply := x.Response
+	if report != nil {
+		report.Reply = newJSONMessage(reply, x.Peer, x.RTT, x.Transmissions, o.hints)
+	}
+	if status := reply.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		return fmt.Errorf("request failed: %s", status)
+	}
+	if err := checkIAPDs(reply); err != nil {
+		return err
+	}
+	if report != nil {
+		reportInformation(dhcp6c.ParseInformation(reply), false)
+	} else {
+		printIAPDs(o.log, reply, "committed prefix", true)
+		printInformation(o.log, dhcp6c.ParseInformation(reply))
+	}
+
+	if o.release || hookRunner != nil || applier != nil || clientState != nil {
+		// no peer: the Release is multicast unless the server sent the
+		// Server Unicast option
+		lease, err := dhcp6c.NewLease(reply, nil)
+		if err != nil {
+			return err
+		}
+		onLease(hooks.Bound, nil, lease)
+		if o.release {
+			o.releaseLease(lease)
+		}
+	}
+	return nil
+}
+
+// refresh extends the restored lease: a Renew with its server until T2, then
+// a Rebind with any server until it expires. It returns the type of the
+// message that extended it.
+func (o *oneShot) refresh(ctx context.Context) (*dhcp6c.Lease, dhcpv6.MessageType, error) {
+	var modifiers []dhcpv6.Modifier
+	if requestedOptions != nil {
+		modifiers = append(modifiers, dhcp6c.WithRequestedOptions(requestedOptions...))
+	}
+	lease, err := o.until(ctx, o.restored.RebindAt(), func(ctx context.Context) (*dhcp6c.Lease, error) {
+		return o.client.Renew(ctx, o.restored, modifiers...)
+	})
+	if err == nil || ctx.Err() != nil {
+		return lease, dhcpv6.MessageTypeRenew, err
+	}
+	lease, err = o.until(ctx, o.restored.Expires(), func(ctx context.Context) (*dhcp6c.Lease, error) {
+		return o.client.Rebind(ctx, o.restored, modifiers...)
+	})
+	return lease, dhcpv6.MessageTypeRebind, err
+}
+
+// until calls fn with a context done at deadline, or after o.timeout if
+// sooner.
+func (o *oneShot) until(ctx context.Context, deadline time.Time, fn func(ctx context.Context) (*dhcp6c.Lease, error)) (*dhcp6c.Lease, error) {
+	if o.timeout > 0 && time.Now().Add(o.timeout).Before(deadline) {
+		deadline = time.Now().Add(o.timeout)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	return fn(ctx)
+}
+
+// extended reports the restored lease extended by a message of type mt, the
+// hooks see it as rebooted.
+func (o *oneShot) extended(lease *dhcp6c.Lease, mt dhcpv6.MessageType) error {
+	if report != nil {
+		report.Extended = mt.String()
+		report.Reply = newJSONLease(lease, o.hints)
+	} else {
+		what := "renewed"
+		if mt == dhcpv6.MessageTypeRebind {
+			what = "rebound"
+		}
+		printLease(o.log, what, lease)
+	}
+	onLease(hooks.Reboot, nil, lease)
+	if o.release {
+		o.releaseLease(lease)
+	}
+	return nil
+}
+
+// releaseLease gives lease back, a Ctrl-C then exits.
+func (o *oneShot) releaseLease(lease *dhcp6c.Lease) {
+	if o.stop != nil {
+		o.stop()
+	}
+	release(o.log, o.client, lease)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/fakeserver"
+)
+
+var testMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x0a}
+
+// newOneShot returns a one-shot run against srv, logging to the returned
+// buffer.
+func newOneShot(t *testing.T, srv *fakeserver.Server) (*oneShot, *bytes.Buffer) {
+	t.Helper()
+	client, err := dhcp6c.NewWithConn(srv.Pipe(), testMAC, dhcp6c.WithTimeout(50*time.Millisecond), dhcp6c.WithRetry(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	var buf bytes.Buffer
+	return &oneShot{
+		client: client,
+		duid:   &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC},
+		log:    log.New(&buf, "", 0),
+	}, &buf
+}
+
+// withIAPD requests an IA_PD with a /56 hint, like the default -p.
+func withIAPD() dhcpv6.Modifier {
+	return dhcp6c.WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{
+		Prefix: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(56, 128)},
+	})
+}
+
+func TestOneShotAdvertise(t *testing.T) {
+	srv := fakeserver.New(fakeserver.Scenario{Logf: t.Logf})
+	o, buf := newOneShot(t, srv)
+	if err := o.run(context.Background(), withIAPD()); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "got a prefix = 2001:db8::/56") {
+		t.Errorf("output %q has no advertised prefix", out)
+	}
+	for _, b := range srv.Bindings() {
+		if b.Committed {
+			t.Errorf("prefix %s committed without -r", b.Prefix)
+		}
+	}
+}
+
+func TestOneShotRequest(t *testing.T) {
+	srv := fakeserver.New(fakeserver.Scenario{Logf: t.Logf})
+	o, buf := newOneShot(t, srv)
+	o.request = true
+	if err := o.run(context.Background(), withIAPD()); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "committed prefix = 2001:db8::/56") {
+		t.Errorf("output %q has no committed prefix", out)
+	}
+	bindings := srv.Bindings()
+	if len(bindings) != 1 || !bindings[0].Committed {
+		t.Errorf("got bindings %+v, want one committed", bindings)
+	}
+}
+
+func TestOneShotRelease(t *testing.T) {
+	srv := fakeserver.New(fakeserver.Scenario{Logf: t.Logf})
+	o, _ := newOneShot(t, srv)
+	o.request = true
+	o.release = true
+	if err := o.run(context.Background(), withIAPD()); err != nil {
+		t.Fatal(err)
+	}
+	if bindings := srv.Bindings(); len(bindings) != 0 {
+		t.Errorf("got bindings %+v after the Release", bindings)
+	}
+	if got := srv.Received(); got[len(got)-1].MessageType != dhcpv6.MessageTypeRelease {
+		t.Errorf("last message received is %s, want RELEASE", got[len(got)-1].MessageType)
+	}
+}
+
+func TestOneShotNoPrefix(t *testing.T) {
+	srv := fakeserver.New(fakeserver.Scenario{
+		Faults: []fakeserver.Fault{{Type: dhcpv6.MessageTypeSolicit, IAPDStatus: iana.StatusNoPrefixAvail}},
+		Logf:   t.Logf,
+	})
+	o, buf := newOneShot(t, srv)
+	o.request = true
+	err := o.run(context.Background(), withIAPD())
+	if err == nil || err.Error() != "no advertise with a prefix to request" {
+		t.Errorf("got error %v", err)
+	}
+	if out := buf.String(); !strings.Contains(out, "NoPrefixAvail") {
+		t.Errorf("output %q has no status", out)
+	}
+}
+
+func TestOneShotJSON(t *testing.T) {
+	report = &jsonReport{}
+	t.Cleanup(func() { report = nil })
+	srv := fakeserver.New(fakeserver.Scenario{
+		Faults: []fakeserver.Fault{{Type: dhcpv6.MessageTypeRequest, Count: 1, Drop: true}},
+		Logf:   t.Logf,
+	})
+	o, buf := newOneShot(t, srv)
+	o.request = true
+	if err := o.run(context.Background(), withIAPD()); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("logged %q with -json", buf.String())
+	}
+	if len(report.Advertises) != 1 || !report.Advertises[0].Selected || report.Advertises[0].Retransmissions != 0 {
+		t.Errorf("got advertises %+v, want one selected without retransmission", report.Advertises)
+	}
+	if report.Reply == nil || len(report.Reply.IAPDs) != 1 || len(report.Reply.IAPDs[0].Prefixes) != 1 {
+		t.Fatalf("got reply %+v, want one IA_PD with a prefix", report.Reply)
+	}
+	if p := report.Reply.IAPDs[0].Prefixes[0].Prefix; p != "2001:db8::/56" {
+		t.Errorf("got prefix %s, want 2001:db8::/56", p)
+	}
+	if n := report.Reply.Retransmissions; n != 1 {
+		t.Errorf("got %d retransmissions of the Request, want 1", n)
+	}
+}
+
+// bind returns a lease committed by srv, like the one saved by a previous
+// run.
+func bind(t *testing.T, srv *fakeserver.Server) *dhcp6c.Lease {
+	t.Helper()
+	duid := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC}
+	solicit, err := dhcp6c.NewSolicit(duid, withIAPD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adv, _ := srv.Handle(solicit)
+	request, err := dhcp6c.NewRequestFromAdvertise(adv, dhcpv6.WithClientID(duid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := srv.Handle(request)
+	lease, err := dhcp6c.NewLease(reply, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lease
+}
+
+func TestOneShotRenew(t *testing.T) {
+	srv := fakeserver.New(fakeserver.Scenario{Logf: t.Logf})
+	o, buf := newOneShot(t, srv)
+	o.restored = bind(t, srv)
+	o.request = true
+	if err := o.run(context.Background(), withIAPD()); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "renewed prefix = 2001:db8::/56") {
+		t.Errorf("output %q has no renewed prefix", out)
+	}
+	received := srv.Received()
+	if last := received[len(received)-1].MessageType; last != dhcpv6.MessageTypeRenew {
+		t.Errorf("last message received is %s, want RENEW", last)
+	}
+	if n := len(received); n != 3 {
+		t.Errorf("received %d messages, want the Solicit and Request of bind and a Renew", n)
+	}
+}
+
+func TestOneShotRenewJSON(t *testing.T) {
+	report = &jsonReport{}
+	t.Cleanup(func() { report = nil })
+	srv := fakeserver.New(fakeserver.Scenario{
+		Faults: []fakeserver.Fault{{Type: dhcpv6.MessageTypeRenew, Status: iana.StatusUnspecFail}},
+		Logf:   t.Logf,
+	})
+	o, _ := newOneShot(t, srv)
+	o.restored = bind(t, srv)
+	o.request = true
+	if err := o.run(context.Background(), withIAPD()); err != nil {
+		t.Fatal(err)
+	}
+	if report.Extended != "REBIND" || len(report.Advertises) != 0 {
+		t.Errorf("extended by %q after %d advertises, want a REBIND", report.Extended, len(report.Advertises))
+	}
+	if report.Reply == nil || len(report.Reply.IAPDs) != 1 || report.Reply.IAPDs[0].Prefixes[0].Prefix != "2001:db8::/56" {
+		t.Errorf("got reply %+v, want the rebound prefix", report.Reply)
+	}
+}
+
+func TestOneShotRestoredUnknown(t *testing.T) {
+	// the server doesn't know the saved lease: a new one is solicited with
+	// its prefix as hint
+	srv := fakeserver.New(fakeserver.Scenario{Logf: t.Logf})
+	o, buf := newOneShot(t, srv)
+	o.restored = bind(t, fakeserver.New(fakeserver.Scenario{
+		Pool: &net.IPNet{IP: net.ParseIP("2001:db8:ff00::"), Mask: net.CIDRMask(40, 128)},
+		Logf: t.Logf,
+	}))
+	o.request = true
+	if err := o.run(context.Background(), withIAPD()); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "saved lease not extended") || !strings.Contains(out, "committed prefix") {
+		t.Errorf("output %q, want a new lease after the failed refresh", out)
+	}
+	var solicit *dhcpv6.Message
+	for _, msg := range srv.Received() {
+		if msg.MessageType == dhcpv6.MessageTypeSolicit {
+			solicit = msg
+			break
+		}
+	}
+	if solicit == nil {
+		t.Fatal("no Solicit sent")
+	}
+	var hints []string
+	for _, iapd := range solicit.Options.IAPD() {
+		for _, p := range iapd.Options.Prefixes() {
+			hints = append(hints, p.Prefix.String())
+		}
+	}
+	if !slices.Contains(hints, "2001:db8:ff00::/56") {
+		t.Errorf("got hints %v, want the saved prefix", hints)
+	}
+}
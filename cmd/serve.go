@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/nspeed-app/testdhcpv6pd/server"
+)
+
+// poolsFlag implement flag.Value interface
+type poolsFlag []server.Pool
+
+// String() for flag.Value interface
+func (p *poolsFlag) String() string {
+	return fmt.Sprintf("%v", *p)
+}
+
+// Set() for flag.Value interface
+func (p *poolsFlag) Set(value string) error {
+	pool, err := server.ParsePool(value)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, pool)
+	return nil
+}
+
+// serve runs the "serve" command: a DHCPv6-PD server on an interface.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var pools poolsFlag
+	fs.Var(&pools, "pool", "delegate prefixes of the given length out of a prefix, e.g. 2001:db8::/48=56 (repeatable)")
+	bindings := fs.String("bindings", "", "file persisting the bindings (none by default)")
+	preferred := fs.Duration("preferred", server.DefaultPreferred, "preferred lifetime of the delegated prefixes")
+	valid := fs.Duration("valid", server.DefaultValid, "valid lifetime of the delegated prefixes")
+	t1 := fs.Duration("t1", 0, "T1 timer (default is 0.5 times the preferred lifetime)")
+	t2 := fs.Duration("t2", 0, "T2 timer (default is 0.8 times the preferred lifetime)")
+	preference := fs.Uint("preference", 0, "Preference option value of the Advertise messages")
+	rapid := fs.Bool("rapid", false, "commit on a Solicit with the Rapid Commit option")
+	dns := fs.String("dns", "", "comma separated DNS servers to send")
+	domains := fs.String("domains", "", "comma separated domain search list to send")
+	noDebug := fs.Bool("s", false, "dont print debug messages")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s serve [options] [interface name] or [interface index]\n", os.Args[0])
+		displayInterfaces()
+		fmt.Println("\nAvailable options:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || len(pools) == 0 {
+		fs.Usage()
+		os.Exit(0)
+	}
+	iface, err := parseInterface(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *preference > 255 {
+		log.Fatal("preference must be 0 to 255")
+	}
+
+	logger := NewMyLogger()
+	logger.Debug = !*noDebug
+	cfg := server.Config{
+		// a DUID-LL stays the same across restarts
+		ServerID: &dhcpv6.DUIDLL{
+			HWType:        iana.HWTypeEthernet,
+			LinkLayerAddr: iface.HardwareAddr,
+		},
+		Pools:        pools,
+		Preferred:    *preferred,
+		Valid:        *valid,
+		T1:           *t1,
+		T2:           *t2,
+		Preference:   uint8(*preference),
+		RapidCommit:  *rapid,
+		BindingsFile: *bindings,
+		Logger:       &logger,
+	}
+	if *dns != "" {
+		for _, s := range strings.Split(*dns, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				log.Fatalf("bad DNS server %q", s)
+			}
+			cfg.DNS = append(cfg.DNS, ip)
+		}
+	}
+	if *domains != "" {
+		cfg.DomainSearch = strings.Split(*domains, ",")
+	}
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := server.Listen(iface.Name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Printf("Serving DHCPv6-PD on interface %s, pools %v, lifetimes %s/%s", iface.Name, pools, *preferred, *valid)
+	for _, b := range srv.Bindings() {
+		if b.Declined {
+			log.Printf("declined %s by %s/%d (until %s)", b.Prefix, b.DUID, b.IAID, b.Expires.Format(time.DateTime))
+			continue
+		}
+		log.Printf("binding %s/%d = %s (expires in %s)", b.DUID, b.IAID, b.Prefix, time.Until(b.Expires).Round(time.Second))
+	}
+	if err := srv.Serve(conn); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/nspeed-app/testdhcpv6pd/store"
+)
+
+// stateFile returns the -state file, by default name in the testdhcpv6pd
+// directory of the user cache directory.
+func stateFile(name string) (string, error) {
+	if *optState != "" {
+		return *optState, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no default state file, use -state: %v", err)
+	}
+	return filepath.Join(dir, "testdhcpv6pd", name), nil
+}
+
+// openClientState opens the state of the client of iface, one file per
+// interface by default.
+func openClientState(iface string) (*store.Store, error) {
+	file, err := stateFile(iface + ".json")
+	if err != nil {
+		return nil, err
+	}
+	return store.Open(file)
+}
+
+// clientIdentity returns the DUID and the n IAIDs to use: the saved ones
+// unless a DUID is given on the command line (explicit), so the server sees
+// the same client from one run to the next. Without state, they are duid and
+// 1 to n.
+func clientIdentity(st *store.Store, duid dhcpv6.DUID, explicit bool, n int) (dhcpv6.DUID, []uint32, error) {
+	if st == nil {
+		iaids := make([]uint32, n)
+		for i := range iaids {
+			iaids[i] = uint32(i + 1)
+		}
+		return duid, iaids, nil
+	}
+	if !explicit {
+		saved, err := st.DUID()
+		if err != nil {
+			return nil, nil, err
+		}
+		if saved != nil {
+			duid = saved
+		}
+	}
+	if err := st.SetDUID(duid); err != nil {
+		return nil, nil, err
+	}
+	iaids, err := st.IAIDs(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return duid, iaids, nil
+}
@@ -1,37 +1,181 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
 
-	// External dependency for UUID parsing
-	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+var (
+	optFile   = flag.String("f", "", "read the message from this file (- for stdin): raw bytes, hex or base64 text, or a pcap or pcapng capture")
+	optFormat = flag.String("in", "auto", "input format: auto, hex, base64 or raw")
+	optJSON   = flag.Bool("json", false, "write the decoded tree as JSON")
+	optDUID   = flag.Bool("duid", false, "decode a DUID instead of a message (the default when the data starts with a DUID type)")
+	optV      = flag.Bool("v", false, "with a capture, also decode the options of each message")
 )
 
 func main() {
-	// --- Argument Parsing ---
-	if len(os.Args) != 2 {
-		fmt.Fprintln(os.Stderr, "Usage: decode_duid <DUID_hex_string>")
-		fmt.Fprintln(os.Stderr, "Example: decode_duid 00:01:00:01:2c:3d:4e:5f:aa:bb:cc:dd:ee:ff")
-		fmt.Fprintln(os.Stderr, "DUID hex string is missing or extra arguments provided. Please try again.")
-		os.Exit(1)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: decode [options] <hex or base64 message>")
+		fmt.Fprintln(os.Stderr, "       decode [options] -f <file>")
+		fmt.Fprintln(os.Stderr, "       decode [options] -f <pcap or pcapng capture>")
+		fmt.Fprintln(os.Stderr, "Example: decode 00:01:00:01:2c:3d:4e:5f:aa:bb:cc:dd:ee:ff")
+		fmt.Fprintln(os.Stderr, "\nAvailable options:")
+		flag.PrintDefaults()
 	}
-	duidHexString := os.Args[1]
-	cleanedHexString := strings.ReplaceAll(duidHexString, ":", "")
+	flag.Parse()
+	log.SetFlags(0)
 
-	duidBytes, err := hex.DecodeString(cleanedHexString)
+	var in []byte
+	var err error
+	switch {
+	case *optFile == "-":
+		in, err = io.ReadAll(os.Stdin)
+	case *optFile != "":
+		in, err = os.ReadFile(*optFile)
+	case flag.NArg() == 1:
+		in = []byte(flag.Arg(0))
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *optFile != "" && dhcp6c.IsPcap(in) {
+		decodeCapture(in)
+		return
+	}
+	b, err := parseInput(in, *optFormat)
 	if err != nil {
-		log.Fatalf("Error: Invalid hex string format provided: '%s'\n%v\nEnsure the string contains only hex characters (0-9, a-f, A-F) and optional colons.", duidHexString, err)
+		log.Fatal(err)
 	}
 
-	duid, err := dhcpv6.DUIDFromBytes(duidBytes)
+	var node *Node
+	if *optDUID || isDUID(b) {
+		node = DecodeDUID(b)
+	} else {
+		node = DecodeMessage(payload(b))
+	}
+	if *optJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(node); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printNode(os.Stdout, node, 0)
+}
 
+// decodeCapture analyzes the DHCPv6 transactions of a capture. A truncated
+// capture is analyzed up to where it's cut.
+func decodeCapture(in []byte) {
+	packets, bad, err := ReadCapture(bytes.NewReader(in))
 	if err != nil {
-		log.Fatalf("error %s decoding as DUID", err)
+		log.Printf("warning: %v, analyzing the %d DHCPv6 packets read", err, len(packets)+bad)
+	}
+	if bad > 0 {
+		log.Printf("warning: %d DHCPv6 packets not decoded", bad)
 	}
+	txs := Analyze(packets)
+	if *optJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(jsonTransactions(txs, *optV)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printTransactions(os.Stdout, txs, *optV)
+}
 
-	println(duid.String())
+// parseInput decodes the input in format, auto detects raw bytes, hex (with
+// spaces, : or - separators, and an optional 0x prefix) and base64.
+func parseInput(in []byte, format string) ([]byte, error) {
+	text := string(bytes.TrimSpace(in))
+	clean := strings.NewReplacer(":", "", "-", "", " ", "", "\n", "", "\r", "", "\t", "").Replace(strings.TrimPrefix(text, "0x"))
+	switch format {
+	case "raw":
+		return in, nil
+	case "hex":
+		return hex.DecodeString(clean)
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	case "auto":
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+	if b, err := hex.DecodeString(clean); err == nil {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), "")); err == nil && len(text) > 0 {
+		return b, nil
+	}
+	if *optFile == "" {
+		return nil, fmt.Errorf("%q is neither hex nor base64", text)
+	}
+	return in, nil
+}
+
+// isDUID tells if b looks like a DUID: message type 0 doesn't exist, a DUID
+// starts with its 16 bits type.
+func isDUID(b []byte) bool {
+	return len(b) >= 3 && b[0] == 0 && b[1] >= 1 && b[1] <= 4
+}
+
+// payload strips the Ethernet, IPv6 and UDP headers of a frame or packet
+// copied from a capture, b is returned as is if it doesn't start with them.
+func payload(b []byte) []byte {
+	// Ethernet with the IPv6 EtherType
+	if len(b) > 14+40+8 && binary.BigEndian.Uint16(b[12:]) == 0x86dd && b[14]>>4 == 6 {
+		b = b[14:]
+	}
+	// IPv6 carrying UDP
+	if len(b) > 40+8 && b[0]>>4 == 6 && b[6] == 17 {
+		b = b[40:]
+	} else {
+		return b
+	}
+	return b[8:]
+}
+
+// printNode writes n and its children as an indented tree.
+func printNode(w io.Writer, n *Node, depth int) {
+	var sb strings.Builder
+	sb.WriteString(strings.Repeat("  ", depth))
+	if n.Code != 0 || n.Name != "DUID" {
+		fmt.Fprintf(&sb, "%s (%d)", n.Name, n.Code)
+	} else {
+		sb.WriteString(n.Name)
+	}
+	if n.Length > 0 {
+		fmt.Fprintf(&sb, " len=%d", n.Length)
+	}
+	for i, f := range n.Fields {
+		if i == 0 {
+			sb.WriteString(":")
+		}
+		fmt.Fprintf(&sb, " %s=%s", f.Name, f.Value)
+		if f.Note != "" {
+			fmt.Fprintf(&sb, " (%s)", f.Note)
+		}
+	}
+	fmt.Fprintln(w, sb.String())
+	for _, c := range n.Children {
+		printNode(w, c, depth+1)
+	}
+	if n.Error != "" {
+		fmt.Fprintf(w, "%s  error: %s\n", strings.Repeat("  ", depth), n.Error)
+	}
 }
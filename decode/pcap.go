@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// Packet is a DHCPv6 message found in a capture.
+type Packet struct {
+	Time time.Time
+	Src  netip.AddrPort
+	Dst  netip.AddrPort
+	// Msg is the message, the relayed one for Relay-Forward and Relay-Reply
+	// messages.
+	Msg *dhcpv6.Message
+	// Relay is the outermost relay message, nil if not relayed.
+	Relay *dhcpv6.RelayMessage
+	Raw   []byte
+}
+
+// fromClient tells if the message is sent by a client.
+func (p *Packet) fromClient() bool {
+	switch p.Msg.MessageType {
+	case dhcpv6.MessageTypeAdvertise, dhcpv6.MessageTypeReply, dhcpv6.MessageTypeReconfigure:
+		return false
+	}
+	return true
+}
+
+// ReadCapture returns the DHCPv6 messages (UDP port 546 or 547) of a pcap or
+// pcapng capture. The packets that don't decode are skipped, their number is
+// returned. On a read error, the messages read until then are returned with
+// it.
+func ReadCapture(r io.Reader) ([]*Packet, int, error) {
+	captured, err := dhcp6c.ReadPcap(r)
+	var packets []*Packet
+	bad := 0
+	for _, c := range captured {
+		p := &Packet{Time: c.Time, Src: c.Src.AddrPort(), Dst: c.Dst.AddrPort(), Raw: c.Data}
+		d, err := dhcpv6.FromBytes(c.Data)
+		if err != nil {
+			bad++
+			continue
+		}
+		if relay, ok := d.(*dhcpv6.RelayMessage); ok {
+			p.Relay = relay
+			if p.Msg, err = relay.GetInnerMessage(); err != nil {
+				bad++
+				continue
+			}
+		} else {
+			p.Msg = d.(*dhcpv6.Message)
+		}
+		packets = append(packets, p)
+	}
+	return packets, bad, err
+}
+
+// Transaction is the messages of a transaction ID: a client message, its
+// retransmissions and the answers of the servers.
+type Transaction struct {
+	XID dhcpv6.TransactionID
+	// Client is the Client ID of the first client message.
+	Client  dhcpv6.DUID
+	Packets []*Packet
+	// Server is the server chosen by the client (the Server ID of its
+	// Request for a Solicit) or the one that replied.
+	Server dhcpv6.DUID
+	// Reply is the answer of Server, nil if none.
+	Reply *dhcpv6.Message
+	// Anomalies are the problems found.
+	Anomalies []string
+}
+
+// Type returns the type of the client message, the type of the first message
+// if there is none.
+func (t *Transaction) Type() dhcpv6.MessageType {
+	for _, p := range t.Packets {
+		if p.fromClient() {
+			return p.Msg.MessageType
+		}
+	}
+	return t.Packets[0].Msg.MessageType
+}
+
+func (t *Transaction) anomaly(format string, args ...any) {
+	t.Anomalies = append(t.Anomalies, fmt.Sprintf(format, args...))
+}
+
+func sameDUID(a, b dhcpv6.DUID) bool {
+	return a != nil && b != nil && bytes.Equal(a.ToBytes(), b.ToBytes())
+}
+
+// Analyze groups the packets into transactions, in the order of their first
+// message, finds the chosen servers and flags the anomalies.
+func Analyze(packets []*Packet) []*Transaction {
+	var txs []*Transaction
+	byXID := make(map[dhcpv6.TransactionID]*Transaction)
+	for _, p := range packets {
+		t, ok := byXID[p.Msg.TransactionID]
+		if !ok {
+			t = &Transaction{XID: p.Msg.TransactionID}
+			byXID[p.Msg.TransactionID] = t
+			txs = append(txs, t)
+		}
+		if t.Client == nil && p.fromClient() {
+			t.Client = p.Msg.Options.ClientID()
+		}
+		t.Packets = append(t.Packets, p)
+	}
+
+	for i, t := range txs {
+		typ := t.Type()
+		var answers []*Packet
+		for _, p := range t.Packets {
+			if !p.fromClient() {
+				answers = append(answers, p)
+				if cid := p.Msg.Options.ClientID(); t.Client != nil && !sameDUID(cid, t.Client) {
+					t.anomaly("%s from %s with a mismatched Client ID %s", p.Msg.MessageType, p.Src.Addr(), duidHex(cid))
+				}
+				checkStatus(t, p)
+			}
+		}
+		if t.Client == nil {
+			t.anomaly("no client message captured")
+			continue
+		}
+		switch typ {
+		case dhcpv6.MessageTypeSolicit:
+			replied := slices.ContainsFunc(answers, func(p *Packet) bool { return p.Msg.MessageType == dhcpv6.MessageTypeReply })
+			if len(answers) == 0 {
+				t.anomaly("no Advertise")
+			}
+			if replied {
+				// Rapid Commit
+				t.setReply(answers)
+				break
+			}
+			// the server of the next Request of the client
+			for _, next := range txs[i+1:] {
+				if next.Type() == dhcpv6.MessageTypeRequest && sameDUID(next.Client, t.Client) {
+					t.Server = next.Packets[0].Msg.Options.ServerID()
+					if !slices.ContainsFunc(answers, func(p *Packet) bool { return sameDUID(p.Msg.Options.ServerID(), t.Server) }) {
+						t.anomaly("the Request goes to %s which didn't advertise", t.Server)
+					}
+					break
+				}
+			}
+		case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeRelease,
+			dhcpv6.MessageTypeDecline, dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeInformationRequest:
+			if len(answers) == 0 {
+				t.anomaly("no Reply")
+				break
+			}
+			t.setReply(answers)
+		}
+	}
+	return txs
+}
+
+// setReply sets the Reply of t, the last one received.
+func (t *Transaction) setReply(answers []*Packet) {
+	for _, p := range slices.Backward(answers) {
+		if p.Msg.MessageType == dhcpv6.MessageTypeReply {
+			t.Reply = p.Msg
+			t.Server = p.Msg.Options.ServerID()
+			return
+		}
+	}
+}
+
+// checkStatus flags the error status codes and the inconsistent timers of an
+// answer.
+func checkStatus(t *Transaction, p *Packet) {
+	if status := p.Msg.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		t.anomaly("%s from %s: %s status (%s)", p.Msg.MessageType, p.Src.Addr(), status.StatusCode, status.StatusMessage)
+	}
+	for _, iapd := range p.Msg.Options.IAPD() {
+		if status := iapd.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			t.anomaly("%s from %s: IA_PD %#x %s status (%s)", p.Msg.MessageType, p.Src.Addr(), iapd.IaId[:], status.StatusCode, status.StatusMessage)
+		}
+		if iapd.T1 > iapd.T2 && iapd.T2 != 0 {
+			t.anomaly("%s from %s: IA_PD %#x T1 %s > T2 %s", p.Msg.MessageType, p.Src.Addr(), iapd.IaId[:], iapd.T1, iapd.T2)
+		}
+		for _, prefix := range iapd.Options.Prefixes() {
+			if prefix.PreferredLifetime > prefix.ValidLifetime {
+				t.anomaly("%s from %s: prefix %s preferred lifetime %s > valid lifetime %s", p.Msg.MessageType, p.Src.Addr(),
+					prefix.Prefix, prefix.PreferredLifetime, prefix.ValidLifetime)
+			}
+		}
+	}
+}
+
+// lifetime formats a lifetime.
+func lifetime(d time.Duration) string {
+	if d == dhcp6c.InfiniteLifetime {
+		return "infinite"
+	}
+	return d.String()
+}
+
+// prefixes describes the delegated prefixes of msg.
+func prefixes(msg *dhcpv6.Message) []string {
+	var s []string
+	for _, iapd := range msg.Options.IAPD() {
+		for _, p := range iapd.Options.Prefixes() {
+			s = append(s, fmt.Sprintf("%s (iaid=%#x,pltime=%s,vltime=%s)", p.Prefix, iapd.IaId[:], lifetime(p.PreferredLifetime), lifetime(p.ValidLifetime)))
+		}
+	}
+	return s
+}
+
+// duidHex returns d in hex digits, "-" if nil.
+func duidHex(d dhcpv6.DUID) string {
+	if d == nil {
+		return "-"
+	}
+	return hex.EncodeToString(d.ToBytes())
+}
+
+// printTransactions writes each exchange with the times relative to the start
+// of the capture and of the transaction. With verbose, the option tree of
+// each message follows.
+func printTransactions(w io.Writer, txs []*Transaction, verbose bool) {
+	if len(txs) == 0 {
+		fmt.Fprintln(w, "no DHCPv6 message found")
+		return
+	}
+	start := txs[0].Packets[0].Time
+	for _, t := range txs {
+		first := t.Packets[0].Time
+		fmt.Fprintf(w, "transaction %#06x %s at +%.3fs client %s\n", t.XID[:], t.Type(), first.Sub(start).Seconds(), duidHex(t.Client))
+		sent := make(map[dhcpv6.MessageType]int)
+		for _, p := range t.Packets {
+			var notes []string
+			if p.fromClient() {
+				if n := sent[p.Msg.MessageType]; n > 0 {
+					notes = append(notes, fmt.Sprintf("retransmission %d", n))
+				}
+				sent[p.Msg.MessageType]++
+			} else {
+				notes = append(notes, "server "+duidHex(p.Msg.Options.ServerID()))
+				if pref := p.Msg.GetOneOption(dhcpv6.OptionPreference); pref != nil {
+					notes = append(notes, fmt.Sprintf("preference %d", pref.ToBytes()[0]))
+				}
+				if s := prefixes(p.Msg); s != nil {
+					notes = append(notes, strings.Join(s, ", "))
+				}
+			}
+			if p.Relay != nil {
+				notes = append(notes, fmt.Sprintf("relayed (%s, link %s)", p.Relay.MessageType, p.Relay.LinkAddr))
+			}
+			fmt.Fprintf(w, "  +%.3fs %-11s %s -> %s", p.Time.Sub(first).Seconds(), p.Msg.MessageType, p.Src.Addr(), p.Dst.Addr())
+			if notes != nil {
+				fmt.Fprintf(w, "  %s", strings.Join(notes, "; "))
+			}
+			fmt.Fprintln(w)
+			if verbose {
+				var b bytes.Buffer
+				printNode(&b, DecodeMessage(p.Raw), 0)
+				for _, line := range strings.SplitAfter(strings.TrimSuffix(b.String(), "\n"), "\n") {
+					fmt.Fprintf(w, "      %s", line)
+				}
+				fmt.Fprintln(w)
+			}
+		}
+		if t.Server != nil {
+			fmt.Fprintf(w, "  => server %s", duidHex(t.Server))
+			if t.Reply != nil {
+				if s := prefixes(t.Reply); s != nil {
+					fmt.Fprintf(w, " delegated %s", strings.Join(s, ", "))
+				}
+			}
+			fmt.Fprintln(w)
+		}
+		for _, a := range t.Anomalies {
+			fmt.Fprintf(w, "  ! %s\n", a)
+		}
+	}
+}
+
+// jsonTransaction is a Transaction for -json.
+type jsonTransaction struct {
+	XID       string       `json:"transaction_id"`
+	Type      string       `json:"type"`
+	Start     float64      `json:"start"`
+	Client    string       `json:"client_duid"`
+	Server    string       `json:"server_duid,omitempty"`
+	Delegated []string     `json:"delegated,omitempty"`
+	Messages  []jsonPacket `json:"messages"`
+	Anomalies []string     `json:"anomalies,omitempty"`
+}
+
+// jsonPacket is a Packet for -json, Offset is relative to the first message
+// of the transaction.
+type jsonPacket struct {
+	Offset  float64 `json:"offset"`
+	Type    string  `json:"type"`
+	Src     string  `json:"src"`
+	Dst     string  `json:"dst"`
+	Relayed bool    `json:"relayed,omitempty"`
+	Tree    *Node   `json:"tree,omitempty"`
+}
+
+// jsonTransactions converts the transactions for -json, with the option
+// trees if verbose.
+func jsonTransactions(txs []*Transaction, verbose bool) []jsonTransaction {
+	out := []jsonTransaction{}
+	if len(txs) == 0 {
+		return out
+	}
+	start := txs[0].Packets[0].Time
+	for _, t := range txs {
+		first := t.Packets[0].Time
+		jt := jsonTransaction{
+			XID:       fmt.Sprintf("%#06x", t.XID[:]),
+			Type:      t.Type().String(),
+			Start:     first.Sub(start).Seconds(),
+			Client:    duidHex(t.Client),
+			Anomalies: t.Anomalies,
+		}
+		if t.Server != nil {
+			jt.Server = duidHex(t.Server)
+		}
+		if t.Reply != nil {
+			jt.Delegated = prefixes(t.Reply)
+		}
+		for _, p := range t.Packets {
+			jp := jsonPacket{
+				Offset:  p.Time.Sub(first).Seconds(),
+				Type:    p.Msg.MessageType.String(),
+				Src:     p.Src.String(),
+				Dst:     p.Dst.String(),
+				Relayed: p.Relay != nil,
+			}
+			if verbose {
+				jp.Tree = DecodeMessage(p.Raw)
+			}
+			jt.Messages = append(jt.Messages, jp)
+		}
+		out = append(out, jt)
+	}
+	return out
+}
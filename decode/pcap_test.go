@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+var (
+	clientAddr  = &net.UDPAddr{IP: net.ParseIP("fe80::a"), Port: dhcpv6.DefaultClientPort}
+	serversAddr = &net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers, Port: dhcpv6.DefaultServerPort}
+	server1     = &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultServerPort}
+	server2     = &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: dhcpv6.DefaultServerPort}
+
+	clientDUID  = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 0xa}}
+	otherDUID   = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 0xb}}
+	server1DUID = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	server2DUID = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}
+)
+
+// newMessage returns a message of type mt in transaction xid with the Client
+// ID client, the Server ID server if not nil, and an IA_PD delegating prefix
+// if not empty or with status if not Success.
+func newMessage(mt dhcpv6.MessageType, xid byte, client, server dhcpv6.DUID, prefix string, status iana.StatusCode) *dhcpv6.Message {
+	msg := &dhcpv6.Message{MessageType: mt, TransactionID: dhcpv6.TransactionID{0, 0, xid}}
+	msg.AddOption(dhcpv6.OptClientID(client))
+	if server != nil {
+		msg.AddOption(dhcpv6.OptServerID(server))
+	}
+	iapd := &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 1}}
+	if prefix != "" {
+		_, p, _ := net.ParseCIDR(prefix)
+		iapd.T1, iapd.T2 = 30*time.Minute, 48*time.Minute
+		iapd.Options.Add(&dhcpv6.OptIAPrefix{PreferredLifetime: time.Hour, ValidLifetime: 2 * time.Hour, Prefix: p})
+	}
+	if status != iana.StatusSuccess {
+		iapd.Options.Add(&dhcpv6.OptStatusCode{StatusCode: status})
+	}
+	msg.AddOption(iapd)
+	return msg
+}
+
+// capture returns the packets of a capture written with PcapWriter:
+//   - 0x01: a Solicit retransmitted, advertised by server 1 and by server 2
+//     with NoPrefixAvail
+//   - 0x02: the Request to server 1 and its Reply
+//   - 0x03: a Solicit without Advertise
+//   - 0x04: a Renew answered with another Client ID
+func capture(t *testing.T) []*Packet {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := dhcp6c.NewPcapWriter(&buf, "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	for i, p := range []struct {
+		src, dst *net.UDPAddr
+		msg      *dhcpv6.Message
+	}{
+		{clientAddr, serversAddr, newMessage(dhcpv6.MessageTypeSolicit, 1, clientDUID, nil, "", iana.StatusSuccess)},
+		{clientAddr, serversAddr, newMessage(dhcpv6.MessageTypeSolicit, 1, clientDUID, nil, "", iana.StatusSuccess)},
+		{server2, clientAddr, newMessage(dhcpv6.MessageTypeAdvertise, 1, clientDUID, server2DUID, "", iana.StatusNoPrefixAvail)},
+		{server1, clientAddr, newMessage(dhcpv6.MessageTypeAdvertise, 1, clientDUID, server1DUID, "2001:db8::/56", iana.StatusSuccess)},
+		{clientAddr, serversAddr, newMessage(dhcpv6.MessageTypeRequest, 2, clientDUID, server1DUID, "2001:db8::/56", iana.StatusSuccess)},
+		{server1, clientAddr, newMessage(dhcpv6.MessageTypeReply, 2, clientDUID, server1DUID, "2001:db8::/56", iana.StatusSuccess)},
+		{clientAddr, serversAddr, newMessage(dhcpv6.MessageTypeSolicit, 3, clientDUID, nil, "", iana.StatusSuccess)},
+		{clientAddr, serversAddr, newMessage(dhcpv6.MessageTypeRenew, 4, clientDUID, server1DUID, "2001:db8::/56", iana.StatusSuccess)},
+		{server1, clientAddr, newMessage(dhcpv6.MessageTypeReply, 4, otherDUID, server1DUID, "2001:db8::/56", iana.StatusSuccess)},
+	} {
+		if err := w.WritePacket(start.Add(time.Duration(i)*time.Second), p.src, p.dst, p.msg.ToBytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packets, bad, err := ReadCapture(&buf)
+	if err != nil || bad != 0 || len(packets) != 9 {
+		t.Fatalf("read %d packets, %d bad: %v", len(packets), bad, err)
+	}
+	return packets
+}
+
+// hasAnomaly tells if one of the anomalies of t contains s.
+func hasAnomaly(t *Transaction, s string) bool {
+	return slices.ContainsFunc(t.Anomalies, func(a string) bool { return strings.Contains(a, s) })
+}
+
+func TestAnalyze(t *testing.T) {
+	txs := Analyze(capture(t))
+	if len(txs) != 4 {
+		t.Fatalf("got %d transactions, want 4", len(txs))
+	}
+	for i, want := range []struct {
+		typ     dhcpv6.MessageType
+		packets int
+	}{
+		{dhcpv6.MessageTypeSolicit, 4},
+		{dhcpv6.MessageTypeRequest, 2},
+		{dhcpv6.MessageTypeSolicit, 1},
+		{dhcpv6.MessageTypeRenew, 2},
+	} {
+		if tx := txs[i]; tx.XID != (dhcpv6.TransactionID{0, 0, byte(i + 1)}) || tx.Type() != want.typ || len(tx.Packets) != want.packets {
+			t.Errorf("transaction %d is %#x %s with %d packets, want %s with %d", i, tx.XID[:], tx.Type(), len(tx.Packets), want.typ, want.packets)
+		}
+	}
+
+	// the Solicit chose the server of the Request, despite the first
+	// Advertise
+	solicit := txs[0]
+	if !sameDUID(solicit.Server, server1DUID) {
+		t.Errorf("Solicit chose %s, want server 1", duidHex(solicit.Server))
+	}
+	if !hasAnomaly(solicit, "NoPrefixAvail") || len(solicit.Anomalies) != 1 {
+		t.Errorf("got anomalies %q, want the NoPrefixAvail of server 2", solicit.Anomalies)
+	}
+
+	if request := txs[1]; request.Reply == nil || !sameDUID(request.Server, server1DUID) || len(request.Anomalies) != 0 {
+		t.Errorf("got Request %+v, want the Reply of server 1 without anomaly", request)
+	}
+	if !hasAnomaly(txs[2], "no Advertise") {
+		t.Errorf("got anomalies %q, want no Advertise", txs[2].Anomalies)
+	}
+	if !hasAnomaly(txs[3], "mismatched Client ID "+duidHex(otherDUID)) {
+		t.Errorf("got anomalies %q, want a mismatched Client ID", txs[3].Anomalies)
+	}
+
+	var out bytes.Buffer
+	printTransactions(&out, txs, false)
+	if n := strings.Count(out.String(), "retransmission 1"); n != 1 {
+		t.Errorf("got %d retransmissions in\n%s", n, out.String())
+	}
+	if !strings.Contains(out.String(), "=> server "+duidHex(server1DUID)+" delegated 2001:db8::/56") {
+		t.Errorf("no delegation by server 1 in\n%s", out.String())
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// Node is a decoded message, option or DUID.
+type Node struct {
+	Name string `json:"name"`
+	// Code is the message type or the option code.
+	Code int `json:"code"`
+	// Length is the length of the option data.
+	Length   int     `json:"length,omitempty"`
+	Fields   []Field `json:"fields,omitempty"`
+	Children []*Node `json:"options,omitempty"`
+	// Unknown is set for the options this tool doesn't know.
+	Unknown bool   `json:"unknown,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Field is a value of a Node, Note explains it (names of codes, lifetimes...).
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Note  string `json:"note,omitempty"`
+}
+
+func (n *Node) add(name, value string) {
+	n.Fields = append(n.Fields, Field{Name: name, Value: value})
+}
+
+func (n *Node) addNote(name, value, note string) {
+	n.Fields = append(n.Fields, Field{Name: name, Value: value, Note: note})
+}
+
+// lifetime adds a lifetime (or T1/T2) field in seconds.
+func (n *Node) lifetime(name string, v uint32) {
+	d := time.Duration(v) * time.Second
+	switch {
+	case d == dhcp6c.InfiniteLifetime:
+		n.addNote(name, strconv.FormatUint(uint64(v), 10), "infinite")
+	case v == 0:
+		n.addNote(name, "0", "unset")
+	default:
+		n.addNote(name, strconv.FormatUint(uint64(v), 10), d.String())
+	}
+}
+
+// DecodeMessage decodes a DHCPv6 message, relayed messages included.
+func DecodeMessage(b []byte) *Node {
+	if len(b) < 4 {
+		return &Node{Name: "message", Error: fmt.Sprintf("too short (%d bytes)", len(b))}
+	}
+	mt := dhcpv6.MessageType(b[0])
+	n := &Node{Name: mt.String(), Code: int(b[0])}
+	if strings.HasPrefix(n.Name, "unknown") {
+		n.Name = "unknown message"
+	}
+	if mt == dhcpv6.MessageTypeRelayForward || mt == dhcpv6.MessageTypeRelayReply {
+		if len(b) < 34 {
+			n.Error = fmt.Sprintf("relay message too short (%d bytes)", len(b))
+			return n
+		}
+		n.add("hop-count", strconv.Itoa(int(b[1])))
+		n.add("link-address", netip.AddrFrom16([16]byte(b[2:18])).String())
+		n.add("peer-address", netip.AddrFrom16([16]byte(b[18:34])).String())
+		n.Children, n.Error = decodeOptions(b[34:])
+		return n
+	}
+	n.add("transaction-id", fmt.Sprintf("%#06x", uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3])))
+	n.Children, n.Error = decodeOptions(b[4:])
+	if n.Name == "unknown message" && n.Error == "" {
+		n.Error = "unknown message type"
+	}
+	return n
+}
+
+// decodeOptions decodes a list of options, the error tells why it stopped
+// before the end.
+func decodeOptions(b []byte) ([]*Node, string) {
+	var nodes []*Node
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nodes, fmt.Sprintf("%d trailing bytes: %x", len(b), b)
+		}
+		code := binary.BigEndian.Uint16(b)
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			n := &Node{Name: optionName(code), Code: int(code), Length: l}
+			n.Error = fmt.Sprintf("truncated, %d bytes left: %x", len(b)-4, b[4:])
+			return append(nodes, n), ""
+		}
+		nodes = append(nodes, decodeOption(code, b[4:4+l]))
+		b = b[4+l:]
+	}
+	return nodes, ""
+}
+
+// decodeOption decodes the data of an option.
+func decodeOption(code uint16, data []byte) *Node {
+	oc := dhcpv6.OptionCode(code)
+	n := &Node{Name: optionName(code), Code: int(code), Length: len(data)}
+	short := func(min int) bool {
+		if len(data) < min {
+			n.Error = fmt.Sprintf("too short, at least %d bytes expected: %x", min, data)
+			return true
+		}
+		return false
+	}
+	switch oc {
+	case dhcpv6.OptionClientID, dhcpv6.OptionServerID:
+		decodeDUID(n, data)
+	case dhcpv6.OptionIANA, dhcpv6.OptionIAPD:
+		if short(12) {
+			break
+		}
+		n.add("iaid", fmt.Sprintf("%#08x", binary.BigEndian.Uint32(data)))
+		n.lifetime("t1", binary.BigEndian.Uint32(data[4:]))
+		n.lifetime("t2", binary.BigEndian.Uint32(data[8:]))
+		n.Children, n.Error = decodeOptions(data[12:])
+	case dhcpv6.OptionIATA:
+		if short(4) {
+			break
+		}
+		n.add("iaid", fmt.Sprintf("%#08x", binary.BigEndian.Uint32(data)))
+		n.Children, n.Error = decodeOptions(data[4:])
+	case dhcpv6.OptionIAAddr:
+		if short(24) {
+			break
+		}
+		n.add("address", netip.AddrFrom16([16]byte(data)).String())
+		n.lifetime("preferred", binary.BigEndian.Uint32(data[16:]))
+		n.lifetime("valid", binary.BigEndian.Uint32(data[20:]))
+		n.Children, n.Error = decodeOptions(data[24:])
+	case dhcpv6.OptionIAPrefix:
+		if short(25) {
+			break
+		}
+		n.lifetime("preferred", binary.BigEndian.Uint32(data))
+		n.lifetime("valid", binary.BigEndian.Uint32(data[4:]))
+		prefix := netip.PrefixFrom(netip.AddrFrom16([16]byte(data[9:25])), int(data[8]))
+		if prefix.Bits() == 0 && prefix.Addr().IsUnspecified() {
+			n.addNote("prefix", prefix.String(), "no hint")
+		} else {
+			n.add("prefix", prefix.String())
+		}
+		n.Children, n.Error = decodeOptions(data[25:])
+	case dhcpv6.OptionORO:
+		if len(data)%2 != 0 {
+			n.Error = "odd length"
+			break
+		}
+		for i := 0; i < len(data); i += 2 {
+			c := binary.BigEndian.Uint16(data[i:])
+			n.addNote("option", strconv.Itoa(int(c)), dhcpv6.OptionCode(c).String())
+		}
+	case dhcpv6.OptionPreference:
+		if short(1) {
+			break
+		}
+		n.add("preference", strconv.Itoa(int(data[0])))
+	case dhcpv6.OptionElapsedTime:
+		if short(2) {
+			break
+		}
+		v := binary.BigEndian.Uint16(data)
+		n.addNote("elapsed", strconv.Itoa(int(v)), (time.Duration(v) * 10 * time.Millisecond).String())
+	case dhcpv6.OptionRelayMsg:
+		inner := DecodeMessage(data)
+		n.Children = []*Node{inner}
+	case dhcpv6.OptionAuth:
+		auth := &dhcp6c.OptAuth{}
+		if err := auth.FromBytes(data); err != nil {
+			n.Error = err.Error()
+			break
+		}
+		n.addNote("protocol", strconv.Itoa(int(auth.Protocol)), authProtocols[auth.Protocol])
+		n.add("algorithm", strconv.Itoa(int(auth.Algorithm)))
+		n.addNote("rdm", strconv.Itoa(int(auth.RDM)), map[uint8]string{0: "monotonic counter"}[auth.RDM])
+		n.add("replay-detection", fmt.Sprintf("%#016x", auth.ReplayDetection))
+		n.addNote("information", hex.EncodeToString(auth.AuthInfo), printable(auth.AuthInfo))
+	case dhcpv6.OptionUnicast:
+		if len(data) != 16 {
+			n.Error = "bad length"
+			break
+		}
+		n.add("address", netip.AddrFrom16([16]byte(data)).String())
+	case dhcpv6.OptionStatusCode:
+		if short(2) {
+			break
+		}
+		sc := iana.StatusCode(binary.BigEndian.Uint16(data))
+		n.addNote("status", strconv.Itoa(int(sc)), sc.String())
+		if len(data) > 2 {
+			n.add("message", string(data[2:]))
+		}
+	case dhcpv6.OptionRapidCommit, dhcpv6.OptionReconfAccept:
+		if len(data) != 0 {
+			n.Error = "should be empty"
+		}
+	case dhcpv6.OptionReconfMessage:
+		if short(1) {
+			break
+		}
+		n.addNote("message-type", strconv.Itoa(int(data[0])), dhcpv6.MessageType(data[0]).String())
+	case dhcpv6.OptionInterfaceID:
+		n.addNote("interface-id", hex.EncodeToString(data), printable(data))
+	case dhcpv6.OptionVendorClass, dhcpv6.OptionVendorOpts, dhcpv6.OptionRemoteID:
+		if short(4) {
+			break
+		}
+		n.add("enterprise-number", strconv.FormatUint(uint64(binary.BigEndian.Uint32(data)), 10))
+		n.addNote("data", hex.EncodeToString(data[4:]), printable(data[4:]))
+	case dhcpv6.OptionUserClass, dhcpv6.OptionRelayAgentSubscriberID:
+		n.addNote("data", hex.EncodeToString(data), printable(data))
+	case dhcpv6.OptionDNSRecursiveNameServer, dhcpv6.OptionSNTPServerList:
+		if len(data)%16 != 0 {
+			n.Error = "length is not a multiple of 16"
+			break
+		}
+		for i := 0; i < len(data); i += 16 {
+			n.add("address", netip.AddrFrom16([16]byte(data[i:])).String())
+		}
+	case dhcpv6.OptionDomainSearchList:
+		names, err := domainNames(data)
+		for _, name := range names {
+			n.add("domain", name)
+		}
+		if err != nil {
+			n.Error = err.Error()
+		}
+	case dhcpv6.OptionInformationRefreshTime, dhcpv6.OptionSolMaxRT, dhcpv6.OptionInfMaxRT:
+		if short(4) {
+			break
+		}
+		n.lifetime("seconds", binary.BigEndian.Uint32(data))
+	case dhcpv6.OptionNTPServer:
+		n.Children, n.Error = decodeSuboptions(data, ntpSuboption)
+	case dhcpv6.OptionAFTRName:
+		names, err := domainNames(data)
+		for _, name := range names {
+			n.add("name", name)
+		}
+		if err != nil {
+			n.Error = err.Error()
+		}
+	case dhcpv6.OptionS46ContMapE, dhcpv6.OptionS46ContMapT, dhcpv6.OptionS46ContLW:
+		n.Name = dhcp6c.S46Mechanism(oc) + " container"
+		n.Children, n.Error = decodeOptions(data)
+	case dhcpv6.OptionS46Rule:
+		if short(8) {
+			break
+		}
+		if data[0]&1 != 0 {
+			n.addNote("flags", strconv.Itoa(int(data[0])), "forwarding mapping rule")
+		} else {
+			n.add("flags", strconv.Itoa(int(data[0])))
+		}
+		n.add("ea-len", strconv.Itoa(int(data[1])))
+		n.add("ipv4-prefix", fmt.Sprintf("%s/%d", netip.AddrFrom4([4]byte(data[3:7])), data[2]))
+		rest := decodePrefix6(n, "ipv6-prefix", int(data[7]), data[8:])
+		n.Children, n.Error = decodeOptions(rest)
+	case dhcpv6.OptionS46BR:
+		if len(data) != 16 {
+			n.Error = "bad length"
+			break
+		}
+		n.add("address", netip.AddrFrom16([16]byte(data)).String())
+	case dhcpv6.OptionS46DMR:
+		if short(1) {
+			break
+		}
+		if rest := decodePrefix6(n, "prefix", int(data[0]), data[1:]); len(rest) > 0 {
+			n.Error = fmt.Sprintf("%d trailing bytes: %x", len(rest), rest)
+		}
+	case dhcpv6.OptionS46V4V6Bind:
+		if short(5) {
+			break
+		}
+		n.add("ipv4-address", netip.AddrFrom4([4]byte(data)).String())
+		rest := decodePrefix6(n, "ipv6-prefix", int(data[4]), data[5:])
+		n.Children, n.Error = decodeOptions(rest)
+	case dhcpv6.OptionS46PortParams:
+		if len(data) != 4 {
+			n.Error = "bad length"
+			break
+		}
+		n.add("offset", strconv.Itoa(int(data[0])))
+		n.add("psid-len", strconv.Itoa(int(data[1])))
+		psid := binary.BigEndian.Uint16(data[2:])
+		if k := data[1]; k > 0 && k <= 16 {
+			n.addNote("psid", fmt.Sprintf("%#04x", psid), fmt.Sprintf("%#x", psid>>(16-k)))
+		} else {
+			n.add("psid", fmt.Sprintf("%#04x", psid))
+		}
+	case dhcpv6.OptionS46Priority:
+		if len(data)%2 != 0 {
+			n.Error = "length is not a multiple of 2"
+			break
+		}
+		for i := 0; i < len(data); i += 2 {
+			code := dhcpv6.OptionCode(binary.BigEndian.Uint16(data[i:]))
+			n.addNote("option", strconv.Itoa(int(code)), dhcp6c.S46Mechanism(code))
+		}
+	case dhcpv6.OptionClientLinkLayerAddr:
+		if short(2) {
+			break
+		}
+		hw := iana.HWType(binary.BigEndian.Uint16(data))
+		n.addNote("hw-type", strconv.Itoa(int(hw)), hw.String())
+		n.add("address", net.HardwareAddr(data[2:]).String())
+	default:
+		n.Unknown = n.Name == "unknown option"
+		if !n.Unknown {
+			n.Name += " (not decoded)"
+		}
+		n.addNote("data", hex.EncodeToString(data), printable(data))
+	}
+	return n
+}
+
+// decodeSuboptions decodes the suboptions in b with decode.
+func decodeSuboptions(b []byte, decode func(code uint16, data []byte) *Node) ([]*Node, string) {
+	var nodes []*Node
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nodes, fmt.Sprintf("%d trailing bytes: %x", len(b), b)
+		}
+		code := binary.BigEndian.Uint16(b)
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return nodes, fmt.Sprintf("suboption %d truncated, %d bytes left: %x", code, len(b)-4, b[4:])
+		}
+		nodes = append(nodes, decode(code, b[4:4+l]))
+		b = b[4+l:]
+	}
+	return nodes, ""
+}
+
+// ntpSuboptions are the names of the NTP server suboptions, RFC 5908.
+var ntpSuboptions = map[uint16]string{
+	1: "server address",
+	2: "multicast address",
+	3: "server FQDN",
+}
+
+// ntpSuboption decodes a suboption of the NTP server option.
+func ntpSuboption(code uint16, data []byte) *Node {
+	n := &Node{Name: ntpSuboptions[code], Code: int(code), Length: len(data)}
+	switch code {
+	case 1, 2:
+		if len(data) != 16 {
+			n.Error = "bad length"
+			break
+		}
+		n.add("address", netip.AddrFrom16([16]byte(data)).String())
+	case 3:
+		names, err := domainNames(data)
+		for _, name := range names {
+			n.add("name", name)
+		}
+		if err != nil {
+			n.Error = err.Error()
+		}
+	default:
+		n.Name = "unknown suboption"
+		n.Unknown = true
+		n.addNote("data", hex.EncodeToString(data), printable(data))
+	}
+	return n
+}
+
+// decodePrefix6 adds an IPv6 prefix of bits length stored in the minimum
+// number of bytes of b (RFC 7598), it returns the bytes after it.
+func decodePrefix6(n *Node, name string, bits int, b []byte) []byte {
+	l := (bits + 7) / 8
+	if bits > 128 || len(b) < l {
+		n.Error = fmt.Sprintf("bad %s of %d bits: %x", name, bits, b)
+		return nil
+	}
+	var a [16]byte
+	copy(a[:], b[:l])
+	n.add(name, netip.PrefixFrom(netip.AddrFrom16(a), bits).Masked().String())
+	return b[l:]
+}
+
+// optionName returns the name of an option code.
+func optionName(code uint16) string {
+	name := dhcpv6.OptionCode(code).String()
+	if strings.HasPrefix(name, "unknown") {
+		return "unknown option"
+	}
+	return name
+}
+
+// authProtocols are the names of the Authentication protocols.
+var authProtocols = map[uint8]string{
+	dhcp6c.AuthProtocolConfigurationToken: "configuration token",
+	dhcp6c.AuthProtocolDelayedV4:          "delayed authentication (RFC 3118)",
+	dhcp6c.AuthProtocolDelayed:            "delayed authentication",
+	dhcp6c.AuthProtocolReconfigureKey:     "reconfigure key",
+}
+
+// duidTypes are the names of the DUID types.
+var duidTypes = map[uint16]string{
+	1: "DUID-LLT",
+	2: "DUID-EN",
+	3: "DUID-LL",
+	4: "DUID-UUID",
+}
+
+// duidEpoch is the origin of the DUID-LLT time.
+var duidEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// decodeDUID adds the fields of a DUID to n.
+func decodeDUID(n *Node, b []byte) {
+	if len(b) < 3 {
+		n.Error = fmt.Sprintf("DUID too short: %x", b)
+		return
+	}
+	typ := binary.BigEndian.Uint16(b)
+	name, ok := duidTypes[typ]
+	if !ok {
+		name = "unknown"
+	}
+	n.addNote("type", strconv.Itoa(int(typ)), name)
+	data := b[2:]
+	switch {
+	case typ == 1 && len(data) >= 6:
+		hw := iana.HWType(binary.BigEndian.Uint16(data))
+		n.addNote("hw-type", strconv.Itoa(int(hw)), hw.String())
+		t := binary.BigEndian.Uint32(data[2:])
+		n.addNote("time", strconv.FormatUint(uint64(t), 10), duidEpoch.Add(time.Duration(t)*time.Second).Format(time.RFC3339))
+		n.add("link-layer-address", net.HardwareAddr(data[6:]).String())
+	case typ == 2 && len(data) >= 4:
+		pen := binary.BigEndian.Uint32(data)
+		n.addNote("enterprise-number", strconv.FormatUint(uint64(pen), 10), map[uint32]string{43793: "systemd"}[pen])
+		n.add("identifier", hex.EncodeToString(data[4:]))
+	case typ == 3 && len(data) >= 2:
+		hw := iana.HWType(binary.BigEndian.Uint16(data))
+		n.addNote("hw-type", strconv.Itoa(int(hw)), hw.String())
+		n.add("link-layer-address", net.HardwareAddr(data[2:]).String())
+	case typ == 4 && len(data) == 16:
+		n.add("uuid", fmt.Sprintf("%x-%x-%x-%x-%x", data[:4], data[4:6], data[6:8], data[8:10], data[10:]))
+	default:
+		n.add("data", hex.EncodeToString(data))
+	}
+	n.add("duid", hex.EncodeToString(b))
+}
+
+// DecodeDUID decodes a DUID alone.
+func DecodeDUID(b []byte) *Node {
+	n := &Node{Name: "DUID", Length: len(b)}
+	decodeDUID(n, b)
+	return n
+}
+
+// domainNames decodes a list of uncompressed DNS names (RFC 8415 section
+// 10).
+func domainNames(b []byte) ([]string, error) {
+	var names []string
+	var labels []string
+	for len(b) > 0 {
+		l := int(b[0])
+		if l == 0 {
+			names = append(names, strings.Join(labels, ".")+".")
+			labels = nil
+			b = b[1:]
+			continue
+		}
+		if l > 63 || len(b) < 1+l {
+			return names, fmt.Errorf("bad domain name label at %x", b)
+		}
+		labels = append(labels, string(b[1:1+l]))
+		b = b[1+l:]
+	}
+	if labels != nil {
+		// a partial name, without the root label
+		names = append(names, strings.Join(labels, "."))
+	}
+	return names, nil
+}
+
+// printable returns b as a string if it's printable ASCII, empty otherwise.
+func printable(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return ""
+		}
+	}
+	return strconv.Quote(string(b))
+}
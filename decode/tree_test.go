@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// relayedSolicit is a Solicit relayed twice, the first relay adding an
+// Interface ID.
+const relayedSolicit = "0x0c0120010db800020000000000000000000120010db8000100000000000000000001000900730c0020010db8000100000000000000000001fe80000000000000000000000000000a00090045011234560001000a0003000102000000000a00080002000000190029000000010000000000000000001a0019000000000000000038000000000000000000000000000000000012000465746830"
+
+func TestDecodeMessageRelay(t *testing.T) {
+	b, err := parseInput([]byte(relayedSolicit), "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printNode(&out, DecodeMessage(b), 0)
+	want := `RELAY-FORW (12): hop-count=1 link-address=2001:db8:2::1 peer-address=2001:db8:1::1
+  Relay Message (9) len=115
+    RELAY-FORW (12): hop-count=0 link-address=2001:db8:1::1 peer-address=fe80::a
+      Relay Message (9) len=69
+        SOLICIT (1): transaction-id=0x123456
+          Client ID (1) len=10: type=3 (DUID-LL) hw-type=1 (Ethernet) link-layer-address=02:00:00:00:00:0a duid=0003000102000000000a
+          Elapsed Time (8) len=2: elapsed=0 (0s)
+          IAPD (25) len=41: iaid=0x00000001 t1=0 (unset) t2=0 (unset)
+            IA Prefix (26) len=25: preferred=0 (unset) valid=0 (unset) prefix=::/56
+      Interface ID (18) len=4: interface-id=65746830 ("eth0")
+`
+	if out.String() != want {
+		t.Errorf("got\n%swant\n%s", out.String(), want)
+	}
+}
+
+func TestDecodeMessageTruncated(t *testing.T) {
+	b, err := parseInput([]byte(relayedSolicit), "hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := DecodeMessage(b[:len(b)-2])
+	if len(n.Children) != 1 || !strings.HasPrefix(n.Children[0].Error, "truncated") {
+		t.Errorf("got %+v, want the Relay Message option truncated", n.Children)
+	}
+	if n := DecodeMessage(b[:20]); !strings.Contains(n.Error, "relay message too short") {
+		t.Errorf("got error %q for a cut relay header", n.Error)
+	}
+}
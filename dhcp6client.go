@@ -50,13 +50,19 @@ type pendingCh struct {
 	done <-chan struct{}
 
 	// ch is used by the receive loop to distribute DHCP messages.
-	ch chan<- *dhcpv6.Message
+	ch chan<- *response
+}
+
+// response is a DHCP message and the address it was received from.
+type response struct {
+	msg  *dhcpv6.Message
+	peer net.Addr
 }
 
 // Client is a DHCPv6 client.
 type Client struct {
 	ifaceHWAddr net.HardwareAddr
-	conn        net.PacketConn
+	conn        Transport
 	timeout     time.Duration
 	retry       int
 	logger      Logger
@@ -64,6 +70,17 @@ type Client struct {
 	// bufferCap is the channel capacity for each TransactionID.
 	bufferCap int
 
+	// retransmissions holds the RFC 8415 retransmission parameters per
+	// message type, the others use timeout and retry.
+	retransmissions map[dhcpv6.MessageType]Retransmission
+
+	// reconfigure receives the Reconfigure messages (they have no pending
+	// TransactionID).
+	reconfigure chan *Reconfigure
+
+	// auth signs the sent messages and validates the received ones if set.
+	auth *Authenticator
+
 	// serverAddr is the UDP address to send all packets to.
 	//
 	// This may be an actual broadcast address, or a unicast address.
@@ -81,6 +98,16 @@ type Client struct {
 	// printDropped logs dropped packets to logger if true.
 	printDropped bool
 
+	// invalid and unauthenticated count the dropped packets, updated
+	// atomically (see Stats).
+	invalid         uint64
+	unauthenticated uint64
+
+	// pcap records the packets if set, pcapFailed is an atomic bool set to
+	// 1 once a write failed.
+	pcap       *PcapWriter
+	pcapFailed uint32
+
 	pendingMu sync.Mutex
 	// pending stores the distribution channels for each pending
 	// TransactionID. receiveLoop uses this map to determine which channel
@@ -150,8 +177,8 @@ func New(iface string, opts ...ClientOpt) (*Client, error) {
 }
 
 // NewWithConn creates a new DHCP client that sends and receives packets on the
-// given interface.
-func NewWithConn(conn net.PacketConn, ifaceHWAddr net.HardwareAddr, opts ...ClientOpt) (*Client, error) {
+// given interface, through conn (a net.PacketConn or any other Transport).
+func NewWithConn(conn Transport, ifaceHWAddr net.HardwareAddr, opts ...ClientOpt) (*Client, error) {
 	c := &Client{
 		ifaceHWAddr: ifaceHWAddr,
 		timeout:     5 * time.Second,
@@ -163,7 +190,10 @@ func NewWithConn(conn net.PacketConn, ifaceHWAddr net.HardwareAddr, opts ...Clie
 
 		done:    make(chan struct{}),
 		pending: make(map[dhcpv6.TransactionID]*pendingCh),
+
+		retransmissions: make(map[dhcpv6.MessageType]Retransmission),
 	}
+	c.reconfigure = make(chan *Reconfigure, c.bufferCap)
 
 	for _, opt := range opts {
 		opt(c)
@@ -203,6 +233,9 @@ func (c *Client) Close() error {
 }
 
 func isErrClosing(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return true
+	}
 	// Unfortunately, the epoll-connection-closed error is internal to the
 	// net library.
 	return strings.Contains(err.Error(), "use of closed network connection")
@@ -216,17 +249,19 @@ func (c *Client) receiveLoop() {
 			// TODO: Clients can send a "max packet size" option in their
 			// packets, IIRC. Choose a reasonable size and set it.
 			b := make([]byte, 1500)
-			n, _, err := c.conn.ReadFrom(b)
+			n, peer, err := c.conn.ReadFrom(b)
 			if err != nil {
 				if !isErrClosing(err) {
 					c.logger.Printf("error reading from UDP connection: %v", err)
 				}
 				return
 			}
+			c.record(false, peer, b[:n])
 
 			msg, err := dhcpv6.MessageFromBytes(b[:n])
 			if err != nil {
 				// Not a valid DHCP packet; keep listening.
+				atomic.AddUint64(&c.invalid, 1)
 				if c.printDropped {
 					if len(b) > 12 {
 						b = b[:12]
@@ -236,6 +271,14 @@ func (c *Client) receiveLoop() {
 				continue
 			}
 
+			if c.auth != nil && (msg.MessageType == dhcpv6.MessageTypeAdvertise || msg.MessageType == dhcpv6.MessageTypeReply) {
+				if err := c.auth.Validate(msg, b[:n]); err != nil {
+					atomic.AddUint64(&c.unauthenticated, 1)
+					c.logger.Printf("Dropping %s with invalid authentication: %v", msg.MessageType, err)
+					continue
+				}
+			}
+
 			c.pendingMu.Lock()
 			p, ok := c.pending[msg.TransactionID]
 			if ok {
@@ -245,8 +288,10 @@ func (c *Client) receiveLoop() {
 					delete(c.pending, msg.TransactionID)
 
 				// This send may block.
-				case p.ch <- msg:
+				case p.ch <- &response{msg: msg, peer: peer}:
 				}
+			} else if msg.MessageType == dhcpv6.MessageTypeReconfigure {
+				c.dispatchReconfigure(msg, b[:n], peer)
 			} else if c.printDropped {
 				// The Stringer will print the transaction ID.
 				c.logger.Printf("No client waiting for msg with this XID: %s", msg)
@@ -259,7 +304,9 @@ func (c *Client) receiveLoop() {
 // ClientOpt is a function that configures the Client.
 type ClientOpt func(*Client)
 
-// WithTimeout configures the retransmission timeout.
+// WithTimeout configures the retransmission timeout, doubled at each
+// retransmission. It doesn't apply to the message types with RFC 8415
+// retransmission parameters (see WithRetransmissions).
 //
 // Default is 5 seconds.
 func WithTimeout(d time.Duration) ClientOpt {
@@ -275,7 +322,10 @@ func WithLogDroppedPackets() ClientOpt {
 	}
 }
 
-// WithRetry configures the number of retransmissions to attempt.
+// WithRetry configures the number of times a message is sent, the first
+// transmission included, a negative value means until the context is done.
+// It doesn't apply to the message types with RFC 8415 retransmission
+// parameters (see WithRetransmissions).
 //
 // Default is 3.
 func WithRetry(r int) ClientOpt {
@@ -284,8 +334,8 @@ func WithRetry(r int) ClientOpt {
 	}
 }
 
-// WithConn configures the packet connection to use.
-func WithConn(conn net.PacketConn) ClientOpt {
+// WithConn configures the packet connection (or other Transport) to use.
+func WithConn(conn Transport) ClientOpt {
 	return func(c *Client) {
 		c.conn = conn
 	}
@@ -356,6 +406,25 @@ func (c *Client) InterfaceAddr() net.HardwareAddr {
 	return b
 }
 
+// Stats counts the packets the client received and dropped.
+type Stats struct {
+	// Invalid is the number of packets that failed to parse as DHCPv6
+	// messages.
+	Invalid uint64
+	// Unauthenticated is the number of Advertise and Reply messages that
+	// failed the Authenticator validation.
+	Unauthenticated uint64
+}
+
+// Stats returns the counters of the dropped packets since the client was
+// created.
+func (c *Client) Stats() Stats {
+	return Stats{
+		Invalid:         atomic.LoadUint64(&c.invalid),
+		Unauthenticated: atomic.LoadUint64(&c.unauthenticated),
+	}
+}
+
 // RapidSolicit sends a solicitation message with the RapidCommit option and
 // returns the first valid reply received.
 func (c *Client) RapidSolicit(ctx context.Context, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
@@ -397,12 +466,15 @@ func (c *Client) Solicit(ctx context.Context, modifiers ...dhcpv6.Modifier) (*dh
 }
 
 // Request requests an IP Assignment from peer given an advertise message.
+//
+// The Client ID is copied from the advertise message (it's the one we sent in
+// the solicit), use dhcpv6.WithClientID as a modifier to override it.
 func (c *Client) Request(ctx context.Context, advertise *dhcpv6.Message, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
-	request, err := dhcpv6.NewRequestFromAdvertise(advertise, modifiers...)
+	request, err := NewRequestFromAdvertise(advertise, modifiers...)
 	if err != nil {
 		return nil, err
 	}
-	return c.SendAndRead(ctx, c.serverAddr, request, nil)
+	return c.SendAndRead(ctx, c.serverAddr, request, IsMessageType(dhcpv6.MessageTypeReply))
 }
 
 // send sends p to destination and returns a response channel.
@@ -411,14 +483,14 @@ func (c *Client) Request(ctx context.Context, advertise *dhcpv6.Message, modifie
 // received.
 //
 // Responses will be matched by transaction ID.
-func (c *Client) send(dest net.Addr, msg *dhcpv6.Message) (<-chan *dhcpv6.Message, func(), error) {
+func (c *Client) send(dest net.Addr, msg *dhcpv6.Message) (<-chan *response, func(), error) {
 	c.pendingMu.Lock()
 	if _, ok := c.pending[msg.TransactionID]; ok {
 		c.pendingMu.Unlock()
 		return nil, nil, fmt.Errorf("transaction ID %s already in use", msg.TransactionID)
 	}
 
-	ch := make(chan *dhcpv6.Message, c.bufferCap)
+	ch := make(chan *response, c.bufferCap)
 	done := make(chan struct{})
 	c.pending[msg.TransactionID] = &pendingCh{done: done, ch: ch}
 	c.pendingMu.Unlock()
@@ -440,10 +512,18 @@ func (c *Client) send(dest net.Addr, msg *dhcpv6.Message) (<-chan *dhcpv6.Messag
 		c.pendingMu.Unlock()
 	}
 
-	if _, err := c.conn.WriteTo(msg.ToBytes(), dest); err != nil {
+	if c.auth != nil {
+		if err := c.auth.Sign(msg); err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("error signing packet: %v", err)
+		}
+	}
+	b := msg.ToBytes()
+	if _, err := c.conn.WriteTo(b, dest); err != nil {
 		cancel()
 		return nil, nil, fmt.Errorf("error writing packet to connection: %v", err)
 	}
+	c.record(true, dest, b)
 	return ch, cancel, nil
 }
 
@@ -455,12 +535,56 @@ var errDeadlineExceeded = errors.New("INTERNAL ERROR: deadline exceeded")
 //
 // If match is nil, the first packet matching the Transaction ID is returned.
 func (c *Client) SendAndRead(ctx context.Context, dest *net.UDPAddr, msg *dhcpv6.Message, match Matcher) (*dhcpv6.Message, error) {
-	var response *dhcpv6.Message
-	err := c.retryFn(func(timeout time.Duration) error {
+	response, _, err := c.SendAndReadFrom(ctx, dest, msg, match)
+	return response, err
+}
+
+// SendAndReadFrom is like SendAndRead but also returns the address the
+// response was received from (nil if the connection is not an UDP one).
+func (c *Client) SendAndReadFrom(ctx context.Context, dest *net.UDPAddr, msg *dhcpv6.Message, match Matcher) (*dhcpv6.Message, *net.UDPAddr, error) {
+	x, err := c.Exchange(ctx, dest, msg, match)
+	if err != nil {
+		return nil, nil, err
+	}
+	return x.Response, x.Peer, nil
+}
+
+// Exchange is the outcome of a message sent and its response.
+type Exchange struct {
+	Response *dhcpv6.Message
+	// Peer is the address the response was received from (nil if the
+	// connection is not an UDP one).
+	Peer *net.UDPAddr
+	// Transmissions is the number of times the message was sent, 1 without
+	// retransmission.
+	Transmissions int
+	// Duration is the time since the first transmission and RTT the time
+	// since the last one.
+	Duration time.Duration
+	RTT      time.Duration
+}
+
+// Exchange is like SendAndRead but also returns the timings and number of
+// transmissions of the exchange.
+func (c *Client) Exchange(ctx context.Context, dest *net.UDPAddr, msg *dhcpv6.Message, match Matcher) (*Exchange, error) {
+	x := &Exchange{}
+	if err := c.initialDelay(ctx, msg.MessageType); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var sent time.Time
+	err := c.retryFn(msg.MessageType, func(timeout time.Duration) error {
+		// RFC 8415 section 21.9: the elapsed time is updated in each
+		// retransmission
+		if msg.GetOneOption(dhcpv6.OptionElapsedTime) != nil {
+			msg.UpdateOption(dhcpv6.OptElapsedTime(elapsedSince(start)))
+		}
 		ch, rem, err := c.send(dest, msg)
 		if err != nil {
 			return err
 		}
+		sent = time.Now()
+		x.Transmissions++
 		c.logger.PrintMessage("sent message", msg)
 		defer rem()
 
@@ -475,10 +599,13 @@ func (c *Client) SendAndRead(ctx context.Context, dest *net.UDPAddr, msg *dhcpv6
 			case <-ctx.Done():
 				return ctx.Err()
 
-			case packet := <-ch:
-				if match == nil || match(packet) {
-					c.logger.PrintMessage("received message", packet)
-					response = packet
+			case r := <-ch:
+				if match == nil || match(r.msg) {
+					c.logger.PrintMessage("received message", r.msg)
+					x.Response = r.msg
+					x.Peer, _ = r.peer.(*net.UDPAddr)
+					x.Duration = time.Since(start)
+					x.RTT = time.Since(sent)
 					return nil
 				}
 			}
@@ -490,22 +617,58 @@ func (c *Client) SendAndRead(ctx context.Context, dest *net.UDPAddr, msg *dhcpv6
 	if err != nil {
 		return nil, err
 	}
-	return response, nil
+	return x, nil
 }
 
-func (c *Client) retryFn(fn func(timeout time.Duration) error) error {
-	timeout := c.timeout
+// retryFn calls fn with the retransmission timeouts of the message type mt
+// until it succeeds or the retransmissions are exhausted.
+//
+// With RFC 8415 retransmission parameters, the timeouts are the section 15
+// ones until MRC or MRD is reached, the first one of a Solicit being strictly
+// greater than IRT. Otherwise fn is called retry times with the client
+// timeout, doubled each time.
+func (c *Client) retryFn(mt dhcpv6.MessageType, fn func(timeout time.Duration) error) error {
+	r, ok := c.retransmissions[mt]
+	if !ok {
+		timeout := c.timeout
+		for i := 0; i < c.retry || c.retry < 0; i++ {
+			switch err := fn(timeout); err {
+			case nil:
+				return nil
+
+			case errDeadlineExceeded:
+				// Double timeout, then retry.
+				timeout *= 2
+
+			default:
+				return err
+			}
+		}
+		return errDeadlineExceeded
+	}
+
+	start := time.Now()
+	var timeout time.Duration
 
 	// Each retry takes the amount of timeout at worst.
-	for i := 0; i < c.retry || c.retry < 0; i++ {
+	for i := 0; r.MRC <= 0 || i < r.MRC; i++ {
+		timeout = r.nextRT(timeout, mt == dhcpv6.MessageTypeSolicit && i == 0)
+		if r.MRD > 0 {
+			left := r.MRD - time.Since(start)
+			if left <= 0 {
+				break
+			}
+			if timeout > left {
+				timeout = left
+			}
+		}
 		switch err := fn(timeout); err {
 		case nil:
 			// Got it!
 			return nil
 
 		case errDeadlineExceeded:
-			// Double timeout, then retry.
-			timeout *= 2
+			// retry with the next timeout
 
 		default:
 			return err
@@ -0,0 +1,338 @@
+package dhcp6c
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var testMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x0a}
+
+// testServer answers the messages read on conn with answer until conn is
+// closed, no answer if it returns nil. The messages received are sent to the
+// returned channel.
+func testServer(t *testing.T, conn *MemConn, answer func(msg *dhcpv6.Message) *dhcpv6.Message) <-chan *dhcpv6.Message {
+	t.Helper()
+	received := make(chan *dhcpv6.Message, 64)
+	go func() {
+		for {
+			msg, from, err := conn.ReadMessage()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				t.Errorf("server: %v", err)
+				return
+			}
+			received <- msg
+			if resp := answer(msg); resp != nil {
+				conn.WriteMessage(resp, from)
+			}
+		}
+	}()
+	return received
+}
+
+// newTestClient returns a client on one end of a pipe, the other end is
+// served by answer.
+func newTestClient(t *testing.T, answer func(msg *dhcpv6.Message) *dhcpv6.Message, opts ...ClientOpt) (*Client, <-chan *dhcpv6.Message) {
+	t.Helper()
+	conn, server := NewMemPipe(nil, nil)
+	received := testServer(t, server, answer)
+	c, err := NewWithConn(conn, testMAC, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		server.Close()
+	})
+	return c, received
+}
+
+// reply returns an answer of type mt to msg, with its transaction ID and
+// Client ID.
+func reply(msg *dhcpv6.Message, mt dhcpv6.MessageType) *dhcpv6.Message {
+	resp := &dhcpv6.Message{MessageType: mt, TransactionID: msg.TransactionID}
+	if cid := msg.Options.ClientID(); cid != nil {
+		resp.AddOption(dhcpv6.OptClientID(cid))
+	}
+	resp.AddOption(dhcpv6.OptServerID(&dhcpv6.DUIDLL{HWType: 1, LinkLayerAddr: testMAC}))
+	return resp
+}
+
+func TestSendAndRead(t *testing.T) {
+	c, received := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		if msg.MessageType != dhcpv6.MessageTypeInformationRequest {
+			return nil
+		}
+		return reply(msg, dhcpv6.MessageTypeReply)
+	}, WithTimeout(time.Second), WithRetry(1))
+
+	req, err := NewInformationRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.SendAndRead(context.Background(), c.RemoteAddr(), req, IsMessageType(dhcpv6.MessageTypeReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageType != dhcpv6.MessageTypeReply || resp.TransactionID != req.TransactionID {
+		t.Errorf("got %s xid %s, want REPLY xid %s", resp.MessageType, resp.TransactionID, req.TransactionID)
+	}
+	if n := len(received); n != 1 {
+		t.Errorf("server received %d messages, want 1", n)
+	}
+}
+
+func TestSendAndReadMatch(t *testing.T) {
+	// the Advertise is not what the client waits for, the Reply is
+	c, _ := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		return reply(msg, dhcpv6.MessageTypeAdvertise)
+	}, WithTimeout(20*time.Millisecond), WithRetry(2))
+
+	req, err := NewInformationRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.SendAndRead(context.Background(), c.RemoteAddr(), req, IsMessageType(dhcpv6.MessageTypeReply))
+	if !errors.Is(err, ErrNoResponse) {
+		t.Errorf("got %v, want ErrNoResponse", err)
+	}
+}
+
+func TestSendAndReadNoResponse(t *testing.T) {
+	c, received := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		return nil
+	}, WithTimeout(10*time.Millisecond), WithRetry(3))
+
+	req, err := NewInformationRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := c.Exchange(context.Background(), c.RemoteAddr(), req, nil)
+	if !errors.Is(err, ErrNoResponse) {
+		t.Fatalf("got %v, want ErrNoResponse", err)
+	}
+	if x != nil {
+		t.Errorf("got an exchange %+v", x)
+	}
+	// each retransmission is the same transaction with a larger Elapsed
+	// Time
+	var last time.Duration
+	for i := 0; i < 3; i++ {
+		msg := <-received
+		if msg.TransactionID != req.TransactionID {
+			t.Errorf("transmission %d: xid %s, want %s", i, msg.TransactionID, req.TransactionID)
+		}
+		elapsed := msg.Options.ElapsedTime()
+		if i > 0 && elapsed <= last {
+			t.Errorf("transmission %d: elapsed time %s, want more than %s", i, elapsed, last)
+		}
+		last = elapsed
+	}
+	if n := len(received); n != 0 {
+		t.Errorf("server received %d more messages, want 3 in total", n)
+	}
+}
+
+func TestSendAndReadNoRetry(t *testing.T) {
+	c, received := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		return reply(msg, dhcpv6.MessageTypeReply)
+	}, WithRetry(0))
+
+	req, err := NewInformationRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SendAndRead(context.Background(), c.RemoteAddr(), req, nil); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("got %v, want ErrNoResponse", err)
+	}
+	if n := len(received); n != 0 {
+		t.Errorf("server received %d messages, want 0", n)
+	}
+}
+
+func TestSendAndReadContext(t *testing.T) {
+	c, _ := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		return nil
+	}, WithTimeout(time.Hour), WithRetry(-1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := NewInformationRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SendAndRead(ctx, c.RemoteAddr(), req, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRetryFn(t *testing.T) {
+	c, _ := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		return nil
+	}, WithTimeout(10*time.Millisecond), WithRetry(4))
+
+	var timeouts []time.Duration
+	err := c.retryFn(dhcpv6.MessageTypeRequest, func(timeout time.Duration) error {
+		timeouts = append(timeouts, timeout)
+		return errDeadlineExceeded
+	})
+	if err != errDeadlineExceeded {
+		t.Errorf("got %v, want errDeadlineExceeded", err)
+	}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond}
+	if len(timeouts) != len(want) {
+		t.Fatalf("got %d calls, want %d", len(timeouts), len(want))
+	}
+	for i := range want {
+		if timeouts[i] != want[i] {
+			t.Errorf("call %d: timeout %s, want %s", i, timeouts[i], want[i])
+		}
+	}
+
+	// success and other errors stop the retries
+	calls := 0
+	err = c.retryFn(dhcpv6.MessageTypeRequest, func(timeout time.Duration) error {
+		calls++
+		if calls == 2 {
+			return nil
+		}
+		return errDeadlineExceeded
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("got %v after %d calls, want nil after 2", err, calls)
+	}
+	errFailed := errors.New("failed")
+	calls = 0
+	err = c.retryFn(dhcpv6.MessageTypeRequest, func(timeout time.Duration) error {
+		calls++
+		return errFailed
+	})
+	if err != errFailed || calls != 1 {
+		t.Errorf("got %v after %d calls, want errFailed after 1", err, calls)
+	}
+}
+
+func TestRetryFnRetransmission(t *testing.T) {
+	r := Retransmission{IRT: 100 * time.Millisecond, MRT: 300 * time.Millisecond, MRC: 5}
+	c, _ := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		return nil
+	}, WithRetransmission(dhcpv6.MessageTypeSolicit, r), WithRetransmission(dhcpv6.MessageTypeRequest, r))
+
+	for _, mt := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest} {
+		var timeouts []time.Duration
+		err := c.retryFn(mt, func(timeout time.Duration) error {
+			timeouts = append(timeouts, timeout)
+			return errDeadlineExceeded
+		})
+		if err != errDeadlineExceeded {
+			t.Errorf("%s: got %v, want errDeadlineExceeded", mt, err)
+		}
+		if len(timeouts) != r.MRC {
+			t.Fatalf("%s: got %d calls, want MRC %d", mt, len(timeouts), r.MRC)
+		}
+		// RFC 8415 section 15: RT = IRT + RAND*IRT, then 2*RTprev +
+		// RAND*RTprev, then MRT + RAND*MRT, RAND in [-0.1, 0.1] and
+		// strictly positive for the first Solicit
+		first := timeouts[0]
+		if mt == dhcpv6.MessageTypeSolicit && (first <= r.IRT || first > r.IRT*11/10) {
+			t.Errorf("%s: first timeout %s, want in (%s, %s]", mt, first, r.IRT, r.IRT*11/10)
+		}
+		if first < r.IRT*9/10 || first > r.IRT*11/10 {
+			t.Errorf("%s: first timeout %s, want IRT %s +/- 10%%", mt, first, r.IRT)
+		}
+		if second := timeouts[1]; second < first*19/10 || second > first*21/10 {
+			t.Errorf("%s: second timeout %s, want about twice %s", mt, second, first)
+		}
+		for i, timeout := range timeouts[2:] {
+			if timeout < r.MRT*9/10 || timeout > r.MRT*11/10 {
+				t.Errorf("%s: timeout %d is %s, want MRT %s +/- 10%%", mt, i+2, timeout, r.MRT)
+			}
+		}
+	}
+}
+
+func TestRetryFnMRD(t *testing.T) {
+	c, _ := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		return nil
+	}, WithRetransmission(dhcpv6.MessageTypeRequest, Retransmission{IRT: 10 * time.Millisecond, MRD: 50 * time.Millisecond}))
+
+	start := time.Now()
+	var total time.Duration
+	err := c.retryFn(dhcpv6.MessageTypeRequest, func(timeout time.Duration) error {
+		total += timeout
+		time.Sleep(timeout)
+		return errDeadlineExceeded
+	})
+	if err != errDeadlineExceeded {
+		t.Errorf("got %v, want errDeadlineExceeded", err)
+	}
+	if total > 50*time.Millisecond {
+		t.Errorf("timeouts add up to %s, more than MRD", total)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("gave up after %s, before MRD", d)
+	}
+}
+
+func TestRapidSolicit(t *testing.T) {
+	c, received := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		if msg.MessageType != dhcpv6.MessageTypeSolicit || msg.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+			return nil
+		}
+		resp := reply(msg, dhcpv6.MessageTypeReply)
+		resp.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit})
+		return resp
+	}, WithTimeout(time.Second), WithRetry(1))
+
+	resp, err := c.RapidSolicit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageType != dhcpv6.MessageTypeReply {
+		t.Errorf("got %s, want REPLY", resp.MessageType)
+	}
+	if n := len(received); n != 1 {
+		t.Errorf("server received %d messages, want the Solicit only", n)
+	}
+}
+
+func TestRapidSolicitAdvertise(t *testing.T) {
+	// without Rapid Commit, the client requests the advertised lease
+	c, received := newTestClient(t, func(msg *dhcpv6.Message) *dhcpv6.Message {
+		var resp *dhcpv6.Message
+		switch msg.MessageType {
+		case dhcpv6.MessageTypeSolicit:
+			resp = reply(msg, dhcpv6.MessageTypeAdvertise)
+		case dhcpv6.MessageTypeRequest:
+			resp = reply(msg, dhcpv6.MessageTypeReply)
+		default:
+			return nil
+		}
+		for _, iapd := range msg.Options.IAPD() {
+			resp.AddOption(iapd)
+		}
+		return resp
+	}, WithTimeout(time.Second), WithRetry(1))
+
+	resp, err := c.RapidSolicit(context.Background(), WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{
+		Prefix: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(56, 128)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageType != dhcpv6.MessageTypeReply {
+		t.Errorf("got %s, want REPLY", resp.MessageType)
+	}
+	for _, want := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest} {
+		if msg := <-received; msg.MessageType != want {
+			t.Errorf("server received %s, want %s", msg.MessageType, want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Package downstream configures the LAN side of a delegating requesting
+// router from a lease: each downstream interface gets a /64 of the delegated
+// prefixes and an address in it, with the lifetimes of the lease, and an
+// unreachable route covers each delegated prefix so the unassigned part is
+// not routed back upstream (RFC 7084 WPD-5). The /64 routes of the
+// interfaces are more specific and take precedence.
+//
+// The changes go through a Backend: NewNetlink on Linux, or a Fake that
+// keeps them in memory to dry-run or test the logic without root.
+//
+//	a := downstream.New(backend, "eth1", "eth2")
+//	err := a.Apply(lease) // on each Reply
+//	err = a.Remove()      // on release or expiry
+package downstream
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// Address is an address assigned to a downstream interface, Prefix is the
+// address with the /64 length.
+type Address struct {
+	Interface string
+	Prefix    netip.Prefix
+	Preferred time.Duration
+	Valid     time.Duration
+}
+
+func (a Address) String() string {
+	return fmt.Sprintf("%s on %s (pltime=%s,vltime=%s)", a.Prefix, a.Interface, a.Preferred, a.Valid)
+}
+
+// Route is an unreachable route covering a delegated prefix. Valid is the
+// lifetime of the prefix, but the kernel doesn't expire unreachable routes:
+// Applier.Remove must be called when the lease expires.
+type Route struct {
+	Prefix netip.Prefix
+	Valid  time.Duration
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("unreachable %s (vltime=%s)", r.Prefix, r.Valid)
+}
+
+// Backend applies the changes to the system.
+type Backend interface {
+	// AddAddress adds the address, or updates its lifetimes.
+	AddAddress(a Address) error
+	DelAddress(a Address) error
+	// AddRoute adds the unreachable route, or replaces it.
+	AddRoute(r Route) error
+	DelRoute(r Route) error
+}
+
+// SubnetLen is the length of the prefixes assigned to the interfaces.
+const SubnetLen = 64
+
+// Applier assigns the delegated prefixes to the downstream interfaces and
+// remembers what it applied to undo it.
+type Applier struct {
+	backend Backend
+	ifaces  []string
+
+	// HostID is the interface identifier of the addresses, 1 by default
+	// (the ::1 address of each /64).
+	HostID uint64
+
+	mu     sync.Mutex
+	addrs  []Address
+	routes []Route
+}
+
+// New returns an applier configuring ifaces through backend, in order: the
+// first interface gets the first /64 of the first delegated prefix and so on.
+func New(backend Backend, ifaces ...string) *Applier {
+	return &Applier{backend: backend, ifaces: ifaces, HostID: 1}
+}
+
+// remaining returns what is left of lifetime d at now for a lease obtained
+// at obtained.
+func remaining(d time.Duration, obtained, now time.Time) time.Duration {
+	if d == dhcp6c.InfiniteLifetime {
+		return d
+	}
+	return max(d-now.Sub(obtained), 0).Truncate(time.Second)
+}
+
+// nthSubnet returns the nth /64 of prefix.
+func nthSubnet(prefix netip.Prefix, n uint64, hostID uint64) netip.Prefix {
+	a := prefix.Masked().Addr().As16()
+	v := new(big.Int).SetBytes(a[:])
+	v.Add(v, new(big.Int).Lsh(new(big.Int).SetUint64(n), 128-SubnetLen))
+	v.Add(v, new(big.Int).SetUint64(hostID))
+	v.FillBytes(a[:])
+	return netip.PrefixFrom(netip.AddrFrom16(a), SubnetLen)
+}
+
+// Plan returns the addresses and routes lease gives the interfaces at now.
+// The interfaces left without a /64 are reported in the error.
+func Plan(lease *dhcp6c.Lease, ifaces []string, hostID uint64, now time.Time) ([]Address, []Route, error) {
+	var addrs []Address
+	var routes []Route
+	next := 0
+	for _, p := range lease.Prefixes() {
+		addr, ok := netip.AddrFromSlice(p.Prefix.IP)
+		bits, _ := p.Prefix.Mask.Size()
+		if !ok || bits > SubnetLen {
+			continue
+		}
+		prefix := netip.PrefixFrom(addr.Unmap(), bits).Masked()
+		valid := remaining(p.ValidLifetime, lease.Obtained, now)
+		preferred := min(remaining(p.PreferredLifetime, lease.Obtained, now), valid)
+		routes = append(routes, Route{Prefix: prefix, Valid: valid})
+		subnets := uint64(1) << min(SubnetLen-bits, 63)
+		for n := uint64(0); n < subnets && next < len(ifaces); n++ {
+			addrs = append(addrs, Address{
+				Interface: ifaces[next],
+				Prefix:    nthSubnet(prefix, n, hostID),
+				Preferred: preferred,
+				Valid:     valid,
+			})
+			next++
+		}
+	}
+	if next < len(ifaces) {
+		return addrs, routes, fmt.Errorf("no /%d left in the delegated prefixes for %v", SubnetLen, ifaces[next:])
+	}
+	return addrs, routes, nil
+}
+
+// Apply configures the interfaces from lease: the addresses and routes of
+// the previous lease that are gone are removed, the others are added or
+// their lifetimes updated.
+func (a *Applier) Apply(lease *dhcp6c.Lease) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	addrs, routes, planErr := Plan(lease, a.ifaces, a.HostID, time.Now())
+	errs := []error{planErr}
+	for _, old := range a.addrs {
+		if !slices.ContainsFunc(addrs, func(n Address) bool { return n.Interface == old.Interface && n.Prefix == old.Prefix }) {
+			errs = append(errs, a.backend.DelAddress(old))
+		}
+	}
+	for _, old := range a.routes {
+		if !slices.ContainsFunc(routes, func(n Route) bool { return n.Prefix == old.Prefix }) {
+			errs = append(errs, a.backend.DelRoute(old))
+		}
+	}
+	// the routes first, so the unassigned part of a new prefix is never
+	// routed upstream
+	a.routes = a.routes[:0]
+	for _, r := range routes {
+		if err := a.backend.AddRoute(r); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		a.routes = append(a.routes, r)
+	}
+	a.addrs = a.addrs[:0]
+	for _, addr := range addrs {
+		if err := a.backend.AddAddress(addr); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		a.addrs = append(a.addrs, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// Remove removes all that was applied, when the lease is released or
+// expired.
+func (a *Applier) Remove() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var errs []error
+	for _, addr := range a.addrs {
+		errs = append(errs, a.backend.DelAddress(addr))
+	}
+	for _, r := range a.routes {
+		errs = append(errs, a.backend.DelRoute(r))
+	}
+	a.addrs, a.routes = nil, nil
+	return errors.Join(errs...)
+}
+
+// Addresses returns the addresses currently applied.
+func (a *Applier) Addresses() []Address {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.addrs)
+}
+
+// Routes returns the unreachable routes currently applied.
+func (a *Applier) Routes() []Route {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.routes)
+}
+
+// Fake is a Backend keeping the addresses and routes in memory, to dry-run
+// or test the Applier without root.
+type Fake struct {
+	// Logf, if set, gets a line for each change.
+	Logf func(format string, args ...any)
+
+	mu     sync.Mutex
+	addrs  map[string]Address
+	routes map[netip.Prefix]Route
+}
+
+// NewFake returns an empty fake backend.
+func NewFake() *Fake {
+	return &Fake{
+		addrs:  make(map[string]Address),
+		routes: make(map[netip.Prefix]Route),
+	}
+}
+
+func (f *Fake) logf(format string, args ...any) {
+	if f.Logf != nil {
+		f.Logf(format, args...)
+	}
+}
+
+func addressKey(a Address) string {
+	return a.Interface + "/" + a.Prefix.String()
+}
+
+// AddAddress implements Backend.
+func (f *Fake) AddAddress(a Address) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addrs[addressKey(a)] = a
+	f.logf("add address %s", a)
+	return nil
+}
+
+// DelAddress implements Backend.
+func (f *Fake) DelAddress(a Address) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.addrs, addressKey(a))
+	f.logf("delete address %s", a)
+	return nil
+}
+
+// AddRoute implements Backend.
+func (f *Fake) AddRoute(r Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes[r.Prefix] = r
+	f.logf("add route %s", r)
+	return nil
+}
+
+// DelRoute implements Backend.
+func (f *Fake) DelRoute(r Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.routes, r.Prefix)
+	f.logf("delete route %s", r)
+	return nil
+}
+
+// Addresses returns the addresses of the fake system.
+func (f *Fake) Addresses() []Address {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addrs := make([]Address, 0, len(f.addrs))
+	for _, a := range f.addrs {
+		addrs = append(addrs, a)
+	}
+	slices.SortFunc(addrs, func(a, b Address) int {
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+	return addrs
+}
+
+// Routes returns the routes of the fake system.
+func (f *Fake) Routes() []Route {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	routes := make([]Route, 0, len(f.routes))
+	for _, r := range f.routes {
+		routes = append(routes, r)
+	}
+	slices.SortFunc(routes, func(a, b Route) int {
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+	return routes
+}
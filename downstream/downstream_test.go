@@ -0,0 +1,170 @@
+package downstream
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// newLease returns a lease obtained at obtained delegating prefixes with the
+// same lifetimes.
+func newLease(obtained time.Time, preferred, valid time.Duration, prefixes ...string) *dhcp6c.Lease {
+	iapd := &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 1}}
+	for _, s := range prefixes {
+		p := netip.MustParsePrefix(s)
+		iapd.Options.Add(&dhcpv6.OptIAPrefix{
+			PreferredLifetime: preferred,
+			ValidLifetime:     valid,
+			Prefix:            &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), 128)},
+		})
+	}
+	return &dhcp6c.Lease{IAPDs: []*dhcpv6.OptIAPD{iapd}, Obtained: obtained}
+}
+
+func TestPlan(t *testing.T) {
+	now := time.Now()
+	lease := newLease(now, time.Hour, 2*time.Hour, "2001:db8:0:ff00::/56")
+	addrs, routes, err := Plan(lease, []string{"eth1", "eth2", "eth3"}, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Address{
+		{Interface: "eth1", Prefix: netip.MustParsePrefix("2001:db8:0:ff00::1/64"), Preferred: time.Hour, Valid: 2 * time.Hour},
+		{Interface: "eth2", Prefix: netip.MustParsePrefix("2001:db8:0:ff01::1/64"), Preferred: time.Hour, Valid: 2 * time.Hour},
+		{Interface: "eth3", Prefix: netip.MustParsePrefix("2001:db8:0:ff02::1/64"), Preferred: time.Hour, Valid: 2 * time.Hour},
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("got addresses %v, want %v", addrs, want)
+	}
+	for i := range want {
+		if addrs[i] != want[i] {
+			t.Errorf("address %d is %s, want %s", i, addrs[i], want[i])
+		}
+	}
+	if len(routes) != 1 || routes[0] != (Route{Prefix: netip.MustParsePrefix("2001:db8:0:ff00::/56"), Valid: 2 * time.Hour}) {
+		t.Errorf("got routes %v, want the unreachable /56", routes)
+	}
+}
+
+func TestPlanTooFewSubnets(t *testing.T) {
+	// a /63 holds 2 /64, and a /65 is too long to be split
+	now := time.Now()
+	lease := newLease(now, time.Hour, 2*time.Hour, "2001:db8::/63", "2001:db8:1::/65")
+	addrs, routes, err := Plan(lease, []string{"eth1", "eth2", "eth3"}, 1, now)
+	if err == nil || !strings.Contains(err.Error(), "[eth3]") {
+		t.Errorf("got error %v, want eth3 left without /64", err)
+	}
+	if len(addrs) != 2 || addrs[1].Interface != "eth2" || addrs[1].Prefix != netip.MustParsePrefix("2001:db8:0:1::1/64") {
+		t.Errorf("got addresses %v, want eth1 and eth2 configured", addrs)
+	}
+	if len(routes) != 1 {
+		t.Errorf("got routes %v, want the /63 only", routes)
+	}
+}
+
+func TestPlanLifetimes(t *testing.T) {
+	// the lifetimes shrink with the time since the lease was obtained, the
+	// preferred one never exceeds the valid one and infinite stays infinite
+	obtained := time.Now()
+	lease := newLease(obtained, time.Hour, 2*time.Hour, "2001:db8::/64")
+	for _, tt := range []struct {
+		elapsed          time.Duration
+		preferred, valid time.Duration
+	}{
+		{0, time.Hour, 2 * time.Hour},
+		{30*time.Minute + 500*time.Millisecond, 29*time.Minute + 59*time.Second, 89*time.Minute + 59*time.Second},
+		{90 * time.Minute, 0, 30 * time.Minute},
+		{3 * time.Hour, 0, 0},
+	} {
+		addrs, routes, err := Plan(lease, []string{"eth1"}, 1, obtained.Add(tt.elapsed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := addrs[0]; a.Preferred != tt.preferred || a.Valid != tt.valid {
+			t.Errorf("after %s: got %s/%s, want %s/%s", tt.elapsed, a.Preferred, a.Valid, tt.preferred, tt.valid)
+		}
+		if routes[0].Valid != tt.valid {
+			t.Errorf("after %s: route valid for %s, want %s", tt.elapsed, routes[0].Valid, tt.valid)
+		}
+	}
+
+	infinite := newLease(obtained, dhcp6c.InfiniteLifetime, dhcp6c.InfiniteLifetime, "2001:db8::/64")
+	addrs, _, _ := Plan(infinite, []string{"eth1"}, 1, obtained.Add(time.Hour))
+	if a := addrs[0]; a.Preferred != dhcp6c.InfiniteLifetime || a.Valid != dhcp6c.InfiniteLifetime {
+		t.Errorf("got %s/%s, want infinite lifetimes", a.Preferred, a.Valid)
+	}
+}
+
+func TestApply(t *testing.T) {
+	fake := NewFake()
+	fake.Logf = t.Logf
+	a := New(fake, "eth1", "eth2")
+	if err := a.Apply(newLease(time.Now(), time.Hour, 2*time.Hour, "2001:db8::/56")); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := fake.Addresses(); len(addrs) != 2 || addrs[0].Prefix != netip.MustParsePrefix("2001:db8::1/64") {
+		t.Errorf("got addresses %v", addrs)
+	}
+
+	// a renewal with the same prefix updates the lifetimes
+	if err := a.Apply(newLease(time.Now(), 30*time.Minute, time.Hour, "2001:db8::/56")); err != nil {
+		t.Fatal(err)
+	}
+	addrs := fake.Addresses()
+	// minus the time Apply took
+	if len(addrs) != 2 || addrs[0].Valid > time.Hour || addrs[0].Valid < time.Hour-time.Second || addrs[0].Preferred > 30*time.Minute {
+		t.Errorf("got addresses %v, want updated lifetimes", addrs)
+	}
+
+	// a new prefix replaces the addresses and the route of the old one
+	if err := a.Apply(newLease(time.Now(), time.Hour, 2*time.Hour, "2001:db8:1::/56")); err != nil {
+		t.Fatal(err)
+	}
+	addrs = fake.Addresses()
+	want := []string{"2001:db8:1::1/64", "2001:db8:1:1::1/64"}
+	if len(addrs) != len(want) {
+		t.Fatalf("got addresses %v, want %v", addrs, want)
+	}
+	for i, w := range want {
+		if addrs[i].Prefix.String() != w {
+			t.Errorf("address %d is %s, want %s", i, addrs[i].Prefix, w)
+		}
+	}
+	if routes := fake.Routes(); len(routes) != 1 || routes[0].Prefix != netip.MustParsePrefix("2001:db8:1::/56") {
+		t.Errorf("got routes %v, want the new /56 only", routes)
+	}
+	if len(a.Addresses()) != 2 || len(a.Routes()) != 1 {
+		t.Errorf("applier remembers %v and %v", a.Addresses(), a.Routes())
+	}
+
+	if err := a.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Addresses()) != 0 || len(fake.Routes()) != 0 {
+		t.Errorf("left %v and %v after Remove", fake.Addresses(), fake.Routes())
+	}
+	if len(a.Addresses()) != 0 || len(a.Routes()) != 0 {
+		t.Errorf("applier remembers %v and %v after Remove", a.Addresses(), a.Routes())
+	}
+}
+
+func TestApplyTooFewSubnets(t *testing.T) {
+	// the interfaces that fit are configured despite the error
+	fake := NewFake()
+	a := New(fake, "eth1", "eth2")
+	err := a.Apply(newLease(time.Now(), time.Hour, 2*time.Hour, "2001:db8::/64"))
+	if err == nil {
+		t.Error("no error for eth2")
+	}
+	if addrs := fake.Addresses(); len(addrs) != 1 || addrs[0].Interface != "eth1" {
+		t.Errorf("got addresses %v, want eth1 configured", addrs)
+	}
+	if routes := fake.Routes(); len(routes) != 1 {
+		t.Errorf("got routes %v, want the /64", routes)
+	}
+}
@@ -0,0 +1,204 @@
+package downstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkBackend applies the changes with rtnetlink messages, one socket per
+// request (the changes are rare).
+type netlinkBackend struct {
+	seq atomic.Uint32
+}
+
+// NewNetlink returns the Backend configuring the Linux kernel through
+// rtnetlink. It needs the cap_net_admin capability.
+func NewNetlink() (Backend, error) {
+	return &netlinkBackend{}, nil
+}
+
+// lifetime converts d to the seconds of the netlink messages.
+func lifetime(d time.Duration) uint32 {
+	if d >= dhcp6c.InfiniteLifetime {
+		return 0xffffffff
+	}
+	return uint32(d / time.Second)
+}
+
+// attr appends a route attribute to b.
+func attr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofRtAttr + len(data)
+	b = binary.NativeEndian.AppendUint16(b, uint16(l))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, data...)
+	for len(b)%unix.NLMSG_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func u32(v uint32) []byte {
+	return binary.NativeEndian.AppendUint32(nil, v)
+}
+
+// request sends a netlink message and waits for its acknowledgment.
+func (n *netlinkBackend) request(typ uint16, flags uint16, payload []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	seq := n.seq.Add(1)
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(payload))
+	*(*unix.NlMsghdr)(unsafe.Pointer(&msg[0])) = unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(payload)),
+		Type:  typ,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   seq,
+	}
+	msg = append(msg, payload...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	b := make([]byte, 4096)
+	for {
+		nr, _, err := unix.Recvfrom(fd, b, 0)
+		if err != nil {
+			return err
+		}
+		for data := b[:nr]; len(data) >= unix.SizeofNlMsghdr; {
+			h := (*unix.NlMsghdr)(unsafe.Pointer(&data[0]))
+			l := int(h.Len)
+			if l < unix.SizeofNlMsghdr || l > len(data) {
+				return errors.New("netlink: bad message length")
+			}
+			if h.Seq == seq && h.Type == unix.NLMSG_ERROR {
+				if l < unix.SizeofNlMsghdr+unix.SizeofNlMsgerr {
+					return errors.New("netlink: short error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(data[unix.SizeofNlMsghdr:])); errno != 0 {
+					return unix.Errno(-errno)
+				}
+				return nil
+			}
+			data = data[min((l+unix.NLMSG_ALIGNTO-1)&^(unix.NLMSG_ALIGNTO-1), len(data)):]
+		}
+	}
+}
+
+// addrMsg builds the RTM_NEWADDR/RTM_DELADDR payload of a.
+func addrMsg(a Address, cacheinfo bool) ([]byte, error) {
+	iface, err := net.InterfaceByName(a.Interface)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	*(*unix.IfAddrmsg)(unsafe.Pointer(&b[0])) = unix.IfAddrmsg{
+		Family:    unix.AF_INET6,
+		Prefixlen: uint8(a.Prefix.Bits()),
+		Scope:     unix.RT_SCOPE_UNIVERSE,
+		Index:     uint32(iface.Index),
+	}
+	ip := a.Prefix.Addr().As16()
+	b = attr(b, unix.IFA_ADDRESS, ip[:])
+	if cacheinfo {
+		ci := make([]byte, unix.SizeofIfaCacheinfo)
+		*(*unix.IfaCacheinfo)(unsafe.Pointer(&ci[0])) = unix.IfaCacheinfo{
+			Prefered: lifetime(a.Preferred),
+			Valid:    lifetime(a.Valid),
+		}
+		b = attr(b, unix.IFA_CACHEINFO, ci)
+	}
+	return b, nil
+}
+
+// AddAddress implements Backend.
+func (n *netlinkBackend) AddAddress(a Address) error {
+	b, err := addrMsg(a, true)
+	if err == nil {
+		err = n.request(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, b)
+	}
+	if err != nil {
+		return fmt.Errorf("add address %s: %w", a, err)
+	}
+	return nil
+}
+
+// DelAddress implements Backend, an address already gone (expired) is not
+// an error. The kernel keeps the prefix route of an address with lifetimes
+// until it expires, it's deleted too.
+func (n *netlinkBackend) DelAddress(a Address) error {
+	b, err := addrMsg(a, false)
+	if err == nil {
+		err = n.request(unix.RTM_DELADDR, 0, b)
+	}
+	if err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) && !errors.Is(err, unix.ENODEV) {
+		return fmt.Errorf("delete address %s: %w", a, err)
+	}
+	iface, err := net.InterfaceByName(a.Interface)
+	if err != nil {
+		return nil
+	}
+	b = make([]byte, unix.SizeofRtMsg)
+	*(*unix.RtMsg)(unsafe.Pointer(&b[0])) = unix.RtMsg{
+		Family:  unix.AF_INET6,
+		Dst_len: uint8(a.Prefix.Bits()),
+		Table:   unix.RT_TABLE_MAIN,
+		Type:    unix.RTN_UNICAST,
+	}
+	dst := a.Prefix.Masked().Addr().As16()
+	b = attr(b, unix.RTA_DST, dst[:])
+	b = attr(b, unix.RTA_OIF, u32(uint32(iface.Index)))
+	err = n.request(unix.RTM_DELROUTE, 0, b)
+	if err != nil && !errors.Is(err, unix.ESRCH) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("delete route of %s: %w", a, err)
+	}
+	return nil
+}
+
+// routeMsg builds the RTM_NEWROUTE/RTM_DELROUTE payload of r. There's no
+// RTA_EXPIRES: the kernel doesn't expire unreachable routes.
+func routeMsg(r Route) []byte {
+	b := make([]byte, unix.SizeofRtMsg)
+	*(*unix.RtMsg)(unsafe.Pointer(&b[0])) = unix.RtMsg{
+		Family:   unix.AF_INET6,
+		Dst_len:  uint8(r.Prefix.Bits()),
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_DHCP,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNREACHABLE,
+	}
+	ip := r.Prefix.Addr().As16()
+	return attr(b, unix.RTA_DST, ip[:])
+}
+
+// AddRoute implements Backend.
+func (n *netlinkBackend) AddRoute(r Route) error {
+	if err := n.request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, routeMsg(r)); err != nil {
+		return fmt.Errorf("add route %s: %w", r, err)
+	}
+	return nil
+}
+
+// DelRoute implements Backend, a route already gone (expired) is not an
+// error.
+func (n *netlinkBackend) DelRoute(r Route) error {
+	err := n.request(unix.RTM_DELROUTE, 0, routeMsg(r))
+	if err != nil && !errors.Is(err, unix.ESRCH) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("delete route %s: %w", r, err)
+	}
+	return nil
+}
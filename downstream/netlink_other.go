@@ -0,0 +1,11 @@
+//go:build !linux
+
+package downstream
+
+import "errors"
+
+// NewNetlink returns the Backend configuring the Linux kernel through
+// rtnetlink, it's only available on Linux.
+func NewNetlink() (Backend, error) {
+	return nil, errors.New("netlink is only supported on Linux")
+}
@@ -0,0 +1,192 @@
+// Package duid builds the DHCP Unique Identifiers of a client: the 4 types of
+// RFC 8415 section 11, the ones systemd-networkd derives from the machine-id,
+// and the ones other clients saved to their files, to take over their
+// identity (and their prefixes).
+//
+//	+------+------------------------------------------------------+
+//	| Type | Description                                          |
+//	+------+------------------------------------------------------+
+//	| 1    | Link-layer address plus time                         |
+//	| 2    | Vendor-assigned unique ID based on Enterprise Number |
+//	| 3    | Link-layer address                                   |
+//	| 4    | Universally Unique Identifier (UUID) [RFC6355]       |
+//	+------+------------------------------------------------------+
+//
+// The length of a DUID (not including the type code) is at least 1 octet and
+// at most 128 octets.
+package duid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// MaxLen is the maximum length of a DUID, with its type.
+const MaxLen = 2 + 128
+
+// LLT returns the DUID-LLT of the Ethernet address mac, t is in seconds since
+// 2000-01-01 UTC (dhcpv6.GetTime for now).
+func LLT(mac net.HardwareAddr, t uint32) dhcpv6.DUID {
+	return &dhcpv6.DUIDLLT{HWType: iana.HWTypeEthernet, Time: t, LinkLayerAddr: mac}
+}
+
+// LL returns the DUID-LL of the Ethernet address mac.
+func LL(mac net.HardwareAddr) dhcpv6.DUID {
+	return &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: mac}
+}
+
+// EN returns the DUID-EN of the IANA private enterprise number and the
+// identifier assigned by this enterprise.
+func EN(enterprise uint32, id []byte) (dhcpv6.DUID, error) {
+	if len(id) == 0 || 2+4+len(id) > MaxLen {
+		return nil, fmt.Errorf("DUID-EN identifier must be 1 to %d bytes long", MaxLen-6)
+	}
+	return &dhcpv6.DUIDEN{EnterpriseNumber: enterprise, EnterpriseIdentifier: id}, nil
+}
+
+// ParseEN parses a DUID-EN given as enterprise:identifier, the identifier in
+// hex digits (: separators allowed), for instance 32473:0123456789ab.
+func ParseEN(s string) (dhcpv6.DUID, error) {
+	pen, id, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("bad DUID-EN %q, expecting enterprise:identifier", s)
+	}
+	enterprise, err := strconv.ParseUint(pen, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad DUID-EN enterprise number %q: %v", pen, err)
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(id, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("bad DUID-EN identifier %q: %v", id, err)
+	}
+	return EN(uint32(enterprise), b)
+}
+
+// UUID returns the DUID-UUID of u.
+func UUID(u uuid.UUID) dhcpv6.DUID {
+	return &dhcpv6.DUIDUUID{UUID: u}
+}
+
+// Parse parses a whole DUID (type included) given in hex digits, separated by
+// : or - or not, like dhcpcd and most clients print them.
+func Parse(s string) (dhcpv6.DUID, error) {
+	h := strings.NewReplacer(":", "", "-", "", " ", "").Replace(strings.TrimSpace(s))
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, fmt.Errorf("bad DUID %q: %v", s, err)
+	}
+	return FromBytes(b)
+}
+
+// FromBytes decodes a whole DUID, checking its length.
+func FromBytes(b []byte) (dhcpv6.DUID, error) {
+	if len(b) < 3 || len(b) > MaxLen {
+		return nil, fmt.Errorf("bad DUID length %d", len(b))
+	}
+	return dhcpv6.DUIDFromBytes(b)
+}
+
+// ReadFile reads the DUID saved by another client:
+//
+//   - dhcpcd (/var/lib/dhcpcd/duid) and most others: hex digits, : separated or
+//     not
+//   - dhclient (/var/lib/dhclient/dhclient6.leases): the default-duid
+//     statement, an octal escaped string
+//   - wide-dhcpv6 (/var/lib/dhcpv6/dhcp6c_duid): a 16 bits length in host
+//     order followed by the DUID
+//   - otherwise the raw DUID
+func ReadFile(file string) (dhcpv6.DUID, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	d, err := decodeFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return d, nil
+}
+
+// decodeFile decodes the content of a DUID file.
+func decodeFile(b []byte) (dhcpv6.DUID, error) {
+	if bytes.Contains(b, []byte("default-duid")) {
+		return dhclientDUID(b)
+	}
+	if text := bytes.TrimSpace(b); len(text) > 0 && isHexText(text) {
+		return Parse(string(text))
+	}
+	if len(b) > 2 {
+		// the length is in host order, little endian on most hosts
+		if l := int(binary.LittleEndian.Uint16(b)); l == len(b)-2 {
+			return FromBytes(b[2:])
+		}
+		if l := int(binary.BigEndian.Uint16(b)); l == len(b)-2 {
+			return FromBytes(b[2:])
+		}
+	}
+	return FromBytes(b)
+}
+
+// isHexText tells if b only holds hex digits and separators.
+func isHexText(b []byte) bool {
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F', c == ':', c == '-', c == ' ':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// dhclientDUID decodes the last default-duid statement of a dhclient leases
+// file, for instance default-duid "\000\001\000\001\036\245\3441\000\014)\237\3142";
+func dhclientDUID(b []byte) (dhcpv6.DUID, error) {
+	var quoted string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if v, ok := strings.CutPrefix(line, "default-duid "); ok {
+			quoted = strings.TrimSuffix(strings.TrimSpace(v), ";")
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+		return nil, errors.New("bad default-duid statement")
+	}
+	var d []byte
+	for in := quoted[1 : len(quoted)-1]; in != ""; {
+		if in[0] != '\\' {
+			d = append(d, in[0])
+			in = in[1:]
+			continue
+		}
+		if len(in) >= 4 {
+			if v, err := strconv.ParseUint(in[1:4], 8, 8); err == nil {
+				d = append(d, byte(v))
+				in = in[4:]
+				continue
+			}
+		}
+		if len(in) < 2 {
+			return nil, errors.New("bad escape in default-duid")
+		}
+		d = append(d, in[1])
+		in = in[2:]
+	}
+	return FromBytes(d)
+}
@@ -0,0 +1,129 @@
+package duid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// SystemdPEN is the private enterprise number of systemd, the one of the
+// DUID-EN of systemd-networkd.
+const SystemdPEN = 43793
+
+// the application specific keys of systemd-networkd (dhcp-identifier.c)
+var (
+	enHashKey = [16]byte{0x80, 0x11, 0x8c, 0xc2, 0xfe, 0x4a, 0x03, 0xee, 0x3e, 0xd6, 0x0c, 0x6f, 0x36, 0x39, 0x14, 0x09}
+	uuidAppID = [16]byte{0xa5, 0x0a, 0xd1, 0x12, 0xbf, 0x60, 0x45, 0x77, 0xa2, 0xfb, 0x74, 0x1a, 0xb1, 0x95, 0x5b, 0x03}
+)
+
+// machineIDFiles are where the machine ID is looked for.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// MachineID reads the machine ID from file, /etc/machine-id (or the D-Bus one)
+// if empty.
+func MachineID(file string) ([16]byte, error) {
+	files := machineIDFiles
+	if file != "" {
+		files = []string{file}
+	}
+	var id [16]byte
+	err := errors.New("no machine-id")
+	for _, f := range files {
+		var b []byte
+		if b, err = os.ReadFile(f); err != nil {
+			continue
+		}
+		var h []byte
+		h, err = hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(h) != len(id) {
+			err = fmt.Errorf("bad machine-id in %s", f)
+			continue
+		}
+		copy(id[:], h)
+		if id == [16]byte{} {
+			err = fmt.Errorf("empty machine-id in %s", f)
+			continue
+		}
+		return id, nil
+	}
+	return id, err
+}
+
+// SystemdEN returns the DUID-EN systemd-networkd uses by default
+// (DUIDType=vendor): the systemd enterprise number and a hash of the machine
+// ID, so the machine ID itself is not disclosed.
+func SystemdEN(machineID [16]byte) dhcpv6.DUID {
+	hash := siphash24(machineID[:], enHashKey)
+	return &dhcpv6.DUIDEN{
+		EnterpriseNumber:     SystemdPEN,
+		EnterpriseIdentifier: binary.LittleEndian.AppendUint64(nil, hash),
+	}
+}
+
+// SystemdUUID returns the DUID-UUID of systemd-networkd (DUIDType=uuid): the
+// application specific UUID of the machine ID
+// (sd_id128_get_machine_app_specific).
+func SystemdUUID(machineID [16]byte) dhcpv6.DUID {
+	mac := hmac.New(sha256.New, machineID[:])
+	mac.Write(uuidAppID[:])
+	var u uuid.UUID
+	copy(u[:], mac.Sum(nil))
+	// a random (version 4) UUID
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return UUID(u)
+}
+
+// siphash24 is SipHash-2-4 of b with key, as used by systemd.
+func siphash24(b []byte, key [16]byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	n := len(b)
+	for ; len(b) >= 8; b = b[8:] {
+		compress(binary.LittleEndian.Uint64(b))
+	}
+	var last [8]byte
+	copy(last[:], b)
+	last[7] = byte(n)
+	compress(binary.LittleEndian.Uint64(last[:]))
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
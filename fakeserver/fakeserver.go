@@ -0,0 +1,392 @@
+// Package fakeserver is an in-process DHCPv6-PD server answering
+// Solicit/Request/Renew/Rebind/Release/Decline/Information-Request from a
+// Scenario, with fault injection (dropped or delayed packets, error status
+// codes, wrong transaction ID, missing Server ID, shrunk lifetimes) to check
+// how dhcp6c.Client and the code on top of it cope with misbehaving servers.
+//
+// It serves any net.PacketConn, usually the server end of dhcp6c.NewMemPipe
+// (see Server.Pipe):
+//
+//	srv := fakeserver.New(fakeserver.Scenario{
+//		Faults: []fakeserver.Fault{{Drop: true, Count: 2}},
+//	})
+//	conn := srv.Pipe()
+//	client, err := dhcp6c.NewWithConn(conn, mac)
+package fakeserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// Defaults of the Scenario fields.
+var (
+	DefaultPool      = &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(48, 128)}
+	DefaultPrefixLen = 56
+	DefaultPreferred = 1 * time.Hour
+	DefaultValid     = 2 * time.Hour
+	DefaultServerID  = &dhcpv6.DUIDLL{
+		HWType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+	}
+)
+
+// Scenario describes the server: what it delegates and the faults it
+// injects.
+type Scenario struct {
+	// ServerID is the server DUID, DefaultServerID if nil.
+	ServerID dhcpv6.DUID
+	// Pool is the aggregate the prefixes of length PrefixLen are delegated
+	// from, in order, one per DUID and IAID (DefaultPool and
+	// DefaultPrefixLen if unset).
+	Pool      *net.IPNet
+	PrefixLen int
+	// Preferred and Valid are the lifetimes of the prefixes
+	// (DefaultPreferred and DefaultValid if 0), T1 and T2 the timers of the
+	// IA_PD (0 lets the client choose).
+	Preferred time.Duration
+	Valid     time.Duration
+	T1        time.Duration
+	T2        time.Duration
+	// Preference is sent in the Preference option of the Advertise messages
+	// if not 0.
+	Preference uint8
+	// RapidCommit answers the Solicit messages with the Rapid Commit option
+	// with a Reply.
+	RapidCommit bool
+	// DNS is sent in the Reply to Information-Request messages.
+	DNS []net.IP
+
+	// Faults are applied to the messages received, see Fault.
+	Faults []Fault
+
+	// Logf logs what the server does if set (t.Logf for instance).
+	Logf func(format string, args ...any)
+}
+
+// Fault alters the answer to the messages it matches. All the matching
+// faults of a Scenario apply.
+type Fault struct {
+	// Type restricts the fault to a received message type, 0 matches all.
+	Type dhcpv6.MessageType
+	// Count is the number of messages the fault applies to, 0 means all.
+	// Use Drop with Count to drop the first N messages. The messages the
+	// server ignores (Request for another server...) don't count.
+	Count int
+
+	// Drop ignores the message.
+	Drop bool
+	// Delay delays the answer.
+	Delay time.Duration
+	// Status adds a top level Status Code option (UseMulticast,
+	// UnspecFail...) and IAPDStatus answers each IA_PD with a Status Code
+	// option (NoPrefixAvail, NoBinding...) instead of its prefixes.
+	Status     iana.StatusCode
+	IAPDStatus iana.StatusCode
+	// WrongXID answers with another transaction ID.
+	WrongXID bool
+	// NoServerID omits the Server ID option.
+	NoServerID bool
+	// Preferred and Valid replace the lifetimes of the prefixes if not 0,
+	// to shrink them.
+	Preferred time.Duration
+	Valid     time.Duration
+}
+
+// Binding is a prefix delegated to a client IA_PD.
+type Binding struct {
+	ClientID dhcpv6.DUID
+	IAID     [4]byte
+	Prefix   *net.IPNet
+	// Committed is set once the client got it in a Reply (not only
+	// advertised).
+	Committed bool
+}
+
+// Server is a fake DHCPv6-PD server.
+type Server struct {
+	scenario Scenario
+
+	mu       sync.Mutex
+	faults   []Fault
+	next     int64
+	bindings map[string]*Binding
+	received []*dhcpv6.Message
+}
+
+// New returns a server playing s.
+func New(s Scenario) *Server {
+	if s.ServerID == nil {
+		s.ServerID = DefaultServerID
+	}
+	if s.Pool == nil {
+		s.Pool = DefaultPool
+	}
+	if s.PrefixLen == 0 {
+		s.PrefixLen = DefaultPrefixLen
+	}
+	if s.Preferred == 0 {
+		s.Preferred = DefaultPreferred
+	}
+	if s.Valid == 0 {
+		s.Valid = DefaultValid
+	}
+	return &Server{
+		scenario: s,
+		faults:   append([]Fault(nil), s.Faults...),
+		bindings: make(map[string]*Binding),
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.scenario.Logf != nil {
+		s.scenario.Logf(format, args...)
+	}
+}
+
+// Pipe serves the server end of a new dhcp6c.NewMemPipe and returns the
+// client end. Closing it stops the server.
+func (s *Server) Pipe() *dhcp6c.MemConn {
+	client, server := dhcp6c.NewMemPipe(nil, nil)
+	go func() {
+		<-client.Done()
+		server.Close()
+	}()
+	go s.Serve(server)
+	return client
+}
+
+// Serve answers the messages received on conn until it is closed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	b := make([]byte, 65536)
+	for {
+		n, peer, err := conn.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		msg, err := dhcpv6.MessageFromBytes(b[:n])
+		if err != nil {
+			s.logf("invalid message from %s: %v", peer, err)
+			continue
+		}
+		resp, delay := s.Handle(msg)
+		if resp == nil {
+			continue
+		}
+		write := func() {
+			if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+				s.logf("sending %s to %s: %v", resp.MessageType, peer, err)
+			}
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, write)
+		} else {
+			write()
+		}
+	}
+}
+
+// Received returns the messages received so far, including the dropped ones.
+func (s *Server) Received() []*dhcpv6.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*dhcpv6.Message(nil), s.received...)
+}
+
+// Bindings returns a copy of the current bindings.
+func (s *Server) Bindings() []Binding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var bindings []Binding
+	for _, b := range s.bindings {
+		bindings = append(bindings, *b)
+	}
+	return bindings
+}
+
+// fault merges the faults matching mt, and counts them.
+func (s *Server) fault(mt dhcpv6.MessageType) Fault {
+	var f Fault
+	for i := range s.faults {
+		sf := &s.faults[i]
+		if sf.Type != 0 && sf.Type != mt || sf.Count < 0 {
+			continue
+		}
+		if sf.Count > 0 {
+			sf.Count--
+			if sf.Count == 0 {
+				// used up
+				sf.Count = -1
+			}
+		}
+		f.Drop = f.Drop || sf.Drop
+		f.Delay += sf.Delay
+		f.WrongXID = f.WrongXID || sf.WrongXID
+		f.NoServerID = f.NoServerID || sf.NoServerID
+		if f.Status == 0 {
+			f.Status = sf.Status
+		}
+		if f.IAPDStatus == 0 {
+			f.IAPDStatus = sf.IAPDStatus
+		}
+		if f.Preferred == 0 {
+			f.Preferred = sf.Preferred
+		}
+		if f.Valid == 0 {
+			f.Valid = sf.Valid
+		}
+	}
+	return f
+}
+
+// Handle returns the answer to msg and how long to wait before sending it,
+// nil if msg is dropped or ignored.
+func (s *Server) Handle(msg *dhcpv6.Message) (*dhcpv6.Message, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, msg)
+
+	cid := msg.Options.ClientID()
+	if cid == nil {
+		s.logf("ignoring %s without Client ID", msg.MessageType)
+		return nil, 0
+	}
+	sid := msg.Options.ServerID()
+	ours := sid != nil && bytes.Equal(sid.ToBytes(), s.scenario.ServerID.ToBytes())
+
+	mt := dhcpv6.MessageTypeReply
+	commit := true
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeSolicit:
+		if sid != nil {
+			return nil, 0
+		}
+		if !s.scenario.RapidCommit || msg.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+			mt = dhcpv6.MessageTypeAdvertise
+			commit = false
+		}
+	case dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeInformationRequest:
+		if sid != nil && msg.MessageType == dhcpv6.MessageTypeRebind {
+			return nil, 0
+		}
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		if !ours {
+			s.logf("ignoring %s for another server", msg.MessageType)
+			return nil, 0
+		}
+	default:
+		s.logf("ignoring %s", msg.MessageType)
+		return nil, 0
+	}
+
+	// only the messages answered use up the faults
+	f := s.fault(msg.MessageType)
+	if f.Drop {
+		s.logf("dropping %s (xid %s)", msg.MessageType, msg.TransactionID)
+		return nil, 0
+	}
+
+	resp := &dhcpv6.Message{MessageType: mt, TransactionID: msg.TransactionID}
+	if f.WrongXID {
+		resp.TransactionID[0] ^= 0xff
+	}
+	resp.AddOption(dhcpv6.OptClientID(cid))
+	if !f.NoServerID {
+		resp.AddOption(dhcpv6.OptServerID(s.scenario.ServerID))
+	}
+	if mt == dhcpv6.MessageTypeAdvertise && s.scenario.Preference != 0 {
+		resp.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionPreference, OptionData: []byte{s.scenario.Preference}})
+	}
+	if msg.MessageType == dhcpv6.MessageTypeSolicit && mt == dhcpv6.MessageTypeReply {
+		resp.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit})
+	}
+	if f.Status != 0 {
+		resp.AddOption(&dhcpv6.OptStatusCode{StatusCode: f.Status, StatusMessage: f.Status.String()})
+		s.logf("answering %s with status %s", msg.MessageType, f.Status)
+		return resp, f.Delay
+	}
+
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeInformationRequest:
+		if len(s.scenario.DNS) > 0 {
+			resp.AddOption(dhcpv6.OptDNS(s.scenario.DNS...))
+		}
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		for _, iapd := range msg.Options.IAPD() {
+			delete(s.bindings, bindingKey(cid, iapd.IaId))
+		}
+		resp.AddOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess, StatusMessage: "released"})
+	default:
+		for _, iapd := range msg.Options.IAPD() {
+			resp.AddOption(s.iapd(msg.MessageType, cid, iapd, f, commit))
+		}
+	}
+	s.logf("answering %s (xid %s) with %s", msg.MessageType, msg.TransactionID, mt)
+	return resp, f.Delay
+}
+
+// iapd returns the IA_PD answering the one of the client.
+func (s *Server) iapd(mt dhcpv6.MessageType, cid dhcpv6.DUID, req *dhcpv6.OptIAPD, f Fault, commit bool) *dhcpv6.OptIAPD {
+	resp := &dhcpv6.OptIAPD{IaId: req.IaId, T1: s.scenario.T1, T2: s.scenario.T2}
+	key := bindingKey(cid, req.IaId)
+	b := s.bindings[key]
+
+	status := f.IAPDStatus
+	if status == 0 && (mt == dhcpv6.MessageTypeRenew || mt == dhcpv6.MessageTypeRebind) && (b == nil || !b.Committed) {
+		status = iana.StatusNoBinding
+	}
+	if status != 0 {
+		resp.T1, resp.T2 = 0, 0
+		resp.Options.Add(&dhcpv6.OptStatusCode{StatusCode: status, StatusMessage: status.String()})
+		return resp
+	}
+
+	if b == nil {
+		b = &Binding{ClientID: cid, IAID: req.IaId, Prefix: s.allocate()}
+		s.bindings[key] = b
+	}
+	b.Committed = b.Committed || commit
+	preferred, valid := s.scenario.Preferred, s.scenario.Valid
+	if f.Preferred != 0 {
+		preferred = f.Preferred
+	}
+	if f.Valid != 0 {
+		valid = f.Valid
+	}
+	resp.Options.Add(&dhcpv6.OptIAPrefix{
+		PreferredLifetime: preferred,
+		ValidLifetime:     valid,
+		Prefix:            b.Prefix,
+	})
+	return resp
+}
+
+// allocate returns the next prefix of the pool, wrapping around.
+func (s *Server) allocate() *net.IPNet {
+	poolLen, _ := s.scenario.Pool.Mask.Size()
+	count := new(big.Int).Lsh(big.NewInt(1), uint(s.scenario.PrefixLen-poolLen))
+	n := new(big.Int).Mod(big.NewInt(s.next), count)
+	s.next++
+
+	ip := new(big.Int).SetBytes(s.scenario.Pool.IP.To16())
+	ip.Add(ip, n.Lsh(n, uint(128-s.scenario.PrefixLen)))
+	b := make([]byte, net.IPv6len)
+	return &net.IPNet{IP: ip.FillBytes(b), Mask: net.CIDRMask(s.scenario.PrefixLen, 128)}
+}
+
+func bindingKey(cid dhcpv6.DUID, iaid [4]byte) string {
+	return fmt.Sprintf("%x/%d", cid.ToBytes(), binary.BigEndian.Uint32(iaid[:]))
+}
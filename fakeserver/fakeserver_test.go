@@ -0,0 +1,114 @@
+package fakeserver_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/fakeserver"
+)
+
+var clientID = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x0a}}
+
+func newSolicit(t *testing.T) *dhcpv6.Message {
+	t.Helper()
+	solicit, err := dhcp6c.NewSolicit(clientID, dhcp6c.WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{
+		Prefix: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(56, 128)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return solicit
+}
+
+func TestHandle(t *testing.T) {
+	srv := fakeserver.New(fakeserver.Scenario{Logf: t.Logf})
+	adv, _ := srv.Handle(newSolicit(t))
+	if adv == nil || adv.MessageType != dhcpv6.MessageTypeAdvertise {
+		t.Fatalf("got %v, want an ADVERTISE", adv)
+	}
+	if b := srv.Bindings(); len(b) != 1 || b[0].Committed {
+		t.Errorf("got bindings %+v after the Solicit, want one not committed", b)
+	}
+
+	request, err := dhcp6c.NewRequestFromAdvertise(adv, dhcpv6.WithClientID(clientID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := srv.Handle(request)
+	lease, err := dhcp6c.NewLease(reply, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := lease.Prefixes(); len(p) != 1 || p[0].Prefix.String() != "2001:db8::/56" {
+		t.Errorf("got prefixes %v, want 2001:db8::/56", p)
+	}
+	if b := srv.Bindings(); len(b) != 1 || !b[0].Committed {
+		t.Errorf("got bindings %+v after the Request, want one committed", b)
+	}
+
+	release, err := dhcp6c.NewRelease(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := srv.Handle(release); reply == nil || reply.MessageType != dhcpv6.MessageTypeReply {
+		t.Errorf("got %v, want a REPLY to the Release", reply)
+	}
+	if b := srv.Bindings(); len(b) != 0 {
+		t.Errorf("got bindings %+v after the Release", b)
+	}
+}
+
+func TestFaultIgnored(t *testing.T) {
+	// the Solicit sent to another server is ignored and doesn't use up the
+	// fault dropping the first Solicit
+	srv := fakeserver.New(fakeserver.Scenario{
+		Faults: []fakeserver.Fault{{Type: dhcpv6.MessageTypeSolicit, Count: 1, Drop: true}},
+		Logf:   t.Logf,
+	})
+	other := newSolicit(t)
+	other.AddOption(dhcpv6.OptServerID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}))
+	if resp, _ := srv.Handle(other); resp != nil {
+		t.Errorf("answered a Solicit for another server with %s", resp.MessageType)
+	}
+	if resp, _ := srv.Handle(newSolicit(t)); resp != nil {
+		t.Errorf("answered the first Solicit with %s, want it dropped", resp.MessageType)
+	}
+	if resp, _ := srv.Handle(newSolicit(t)); resp == nil {
+		t.Error("dropped the second Solicit")
+	}
+	if n := len(srv.Received()); n != 3 {
+		t.Errorf("received %d messages, want 3", n)
+	}
+}
+
+func TestFaultStatus(t *testing.T) {
+	srv := fakeserver.New(fakeserver.Scenario{
+		Faults: []fakeserver.Fault{
+			{Type: dhcpv6.MessageTypeSolicit, Count: 1, IAPDStatus: iana.StatusNoPrefixAvail},
+			{Type: dhcpv6.MessageTypeSolicit, Count: 1, WrongXID: true, NoServerID: true},
+		},
+		Logf: t.Logf,
+	})
+	solicit := newSolicit(t)
+	adv, _ := srv.Handle(solicit)
+	iapds := adv.Options.IAPD()
+	if len(iapds) != 1 || iapds[0].Options.Status() == nil || iapds[0].Options.Status().StatusCode != iana.StatusNoPrefixAvail {
+		t.Errorf("got IA_PDs %v, want NoPrefixAvail", iapds)
+	}
+	if adv.TransactionID == solicit.TransactionID {
+		t.Error("got the transaction ID of the Solicit")
+	}
+	if adv.Options.ServerID() != nil {
+		t.Error("got a Server ID")
+	}
+
+	// both faults are used up
+	solicit = newSolicit(t)
+	adv, _ = srv.Handle(solicit)
+	if adv.TransactionID != solicit.TransactionID || adv.Options.ServerID() == nil || len(adv.Options.IAPD()[0].Options.Prefixes()) != 1 {
+		t.Errorf("got %s, want an ADVERTISE without fault", adv.Summary())
+	}
+}
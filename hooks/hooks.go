@@ -0,0 +1,205 @@
+// Package hooks runs user executables when the delegated prefixes are
+// obtained, renewed, changed, expired or released, like the dhcpcd hooks: the
+// lease is passed in environment variables and the reason variable tells
+// what happened, so radvd, the firewall or the DNS can be reconfigured
+// without parsing the output of the tool.
+//
+// The variables follow the dhcpcd names, with new_ for the current lease and
+// old_ for the previous one:
+//
+//	reason=BOUND6
+//	interface=eth0
+//	protocol=dhcp6
+//	new_dhcp6_server_id=000300010242ac110002
+//	new_dhcp6_ia_pd1_iaid=1
+//	new_dhcp6_ia_pd1_t1=1800
+//	new_dhcp6_ia_pd1_t2=2880
+//	new_dhcp6_ia_pd1_prefix1=2001:db8:0:100::
+//	new_dhcp6_ia_pd1_prefix1_length=56
+//	new_dhcp6_ia_pd1_prefix1_pltime=3600
+//	new_dhcp6_ia_pd1_prefix1_vltime=7200
+//	new_delegated_dhcp6_prefix=2001:db8:0:100::/56
+package hooks
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// Reason is the value of the reason variable.
+type Reason string
+
+const (
+	// Bound: a lease was obtained with Solicit/Request.
+	Bound Reason = "BOUND6"
+	// Renew and Rebind: the lease was extended with the same prefixes.
+	Renew  Reason = "RENEW6"
+	Rebind Reason = "REBIND6"
+	// Reboot: the lease saved by a previous run was extended, only new_
+	// variables are set.
+	Reboot Reason = "REBOOT6"
+	// Changed: a Renew or Rebind got other prefixes than the ones of the
+	// old lease.
+	Changed Reason = "CHANGED6"
+	// Expire: the valid lifetime ran out, only old_ variables are set.
+	Expire Reason = "EXPIRE6"
+	// Release: the prefixes were given back, only old_ variables are set.
+	Release Reason = "RELEASE6"
+)
+
+// DefaultTimeout is the time a hook is given to complete before it's killed.
+const DefaultTimeout = 30 * time.Second
+
+// Runner runs the hooks of an interface.
+type Runner struct {
+	// Paths are the hooks: executables, or directories whose executable
+	// files are run in lexical order (like run-parts). Hidden files and
+	// backup files (ending with ~) of the directories are skipped.
+	Paths     []string
+	Interface string
+	// Timeout is the time each hook is given, DefaultTimeout if 0.
+	Timeout time.Duration
+	// Logger gets a line for each hook run, nothing is logged if nil.
+	Logger dhcp6c.Logger
+}
+
+// NewRunner returns a runner of the hooks found in paths for iface.
+func NewRunner(iface string, paths ...string) *Runner {
+	return &Runner{Paths: paths, Interface: iface}
+}
+
+// hooks returns the executables to run, in order.
+func (r *Runner) hooks() ([]string, error) {
+	var hooks []string
+	for _, p := range r.Paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			hooks = append(hooks, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+				continue
+			}
+			fi, err := os.Stat(filepath.Join(p, name))
+			if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0o111 == 0 {
+				continue
+			}
+			hooks = append(hooks, filepath.Join(p, name))
+		}
+	}
+	return hooks, nil
+}
+
+// Run runs all the hooks in turn with the environment describing the old
+// and new leases (either may be nil). A failing hook doesn't stop the next
+// ones, the errors are returned together.
+func (r *Runner) Run(ctx context.Context, reason Reason, old, new *dhcp6c.Lease) error {
+	hooks, err := r.hooks()
+	if err != nil {
+		return err
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	env := append(os.Environ(), Env(r.Interface, reason, old, new)...)
+	var errs []error
+	for _, hook := range hooks {
+		if r.Logger != nil {
+			r.Logger.Printf("running hook %s (%s)", hook, reason)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		cmd := exec.CommandContext(ctx, hook)
+		cmd.Env = env
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			errs = append(errs, fmt.Errorf("hook %s: %w", hook, err))
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// Env returns the variables passed to the hooks, as name=value.
+func Env(iface string, reason Reason, old, new *dhcp6c.Lease) []string {
+	env := []string{
+		"reason=" + string(reason),
+		"interface=" + iface,
+		"protocol=dhcp6",
+	}
+	env = append(env, leaseEnv("old_", old)...)
+	return append(env, leaseEnv("new_", new)...)
+}
+
+// PrefixesChanged tells if the leases don't delegate the same prefixes,
+// lifetimes aside. Either may be nil.
+func PrefixesChanged(old, new *dhcp6c.Lease) bool {
+	prefixes := func(l *dhcp6c.Lease) []string {
+		if l == nil {
+			return nil
+		}
+		var s []string
+		for _, p := range l.Prefixes() {
+			s = append(s, p.Prefix.String())
+		}
+		slices.Sort(s)
+		return s
+	}
+	return !slices.Equal(prefixes(old), prefixes(new))
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprint(uint32(d / time.Second))
+}
+
+func leaseEnv(prefix string, l *dhcp6c.Lease) []string {
+	if l == nil {
+		return nil
+	}
+	var env []string
+	set := func(name, value string) {
+		env = append(env, prefix+name+"="+value)
+	}
+	if l.ServerID != nil {
+		set("dhcp6_server_id", hex.EncodeToString(l.ServerID.ToBytes()))
+	}
+	var delegated []string
+	for i, iapd := range l.IAPDs {
+		pd := fmt.Sprintf("dhcp6_ia_pd%d_", i+1)
+		set(pd+"iaid", fmt.Sprint(binary.BigEndian.Uint32(iapd.IaId[:])))
+		set(pd+"t1", seconds(iapd.T1))
+		set(pd+"t2", seconds(iapd.T2))
+		for j, p := range iapd.Options.Prefixes() {
+			length, _ := p.Prefix.Mask.Size()
+			name := fmt.Sprintf("%sprefix%d", pd, j+1)
+			set(name, p.Prefix.IP.String())
+			set(name+"_length", fmt.Sprint(length))
+			set(name+"_pltime", seconds(p.PreferredLifetime))
+			set(name+"_vltime", seconds(p.ValidLifetime))
+			delegated = append(delegated, p.Prefix.String())
+		}
+	}
+	set("delegated_dhcp6_prefix", strings.Join(delegated, " "))
+	return env
+}
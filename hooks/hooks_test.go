@@ -0,0 +1,151 @@
+package hooks
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// newLease returns the lease of the package doc example, delegating prefix.
+func newLease(prefix string) *dhcp6c.Lease {
+	_, p, _ := net.ParseCIDR(prefix)
+	return &dhcp6c.Lease{
+		ServerID: &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}},
+		IAPDs: []*dhcpv6.OptIAPD{{
+			IaId: [4]byte{0, 0, 0, 1},
+			T1:   1800 * time.Second,
+			T2:   2880 * time.Second,
+			Options: dhcpv6.PDOptions{Options: dhcpv6.Options{&dhcpv6.OptIAPrefix{
+				PreferredLifetime: time.Hour,
+				ValidLifetime:     2 * time.Hour,
+				Prefix:            p,
+			}}},
+		}},
+	}
+}
+
+func TestEnv(t *testing.T) {
+	got := Env("eth0", Bound, nil, newLease("2001:db8:0:100::/56"))
+	want := []string{
+		"reason=BOUND6",
+		"interface=eth0",
+		"protocol=dhcp6",
+		"new_dhcp6_server_id=000300010242ac110002",
+		"new_dhcp6_ia_pd1_iaid=1",
+		"new_dhcp6_ia_pd1_t1=1800",
+		"new_dhcp6_ia_pd1_t2=2880",
+		"new_dhcp6_ia_pd1_prefix1=2001:db8:0:100::",
+		"new_dhcp6_ia_pd1_prefix1_length=56",
+		"new_dhcp6_ia_pd1_prefix1_pltime=3600",
+		"new_dhcp6_ia_pd1_prefix1_vltime=7200",
+		"new_delegated_dhcp6_prefix=2001:db8:0:100::/56",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// old_ then new_, only old_ on expiry
+	got = Env("eth0", Changed, newLease("2001:db8::/56"), newLease("2001:db8:0:100::/56"))
+	if !slices.Contains(got, "old_delegated_dhcp6_prefix=2001:db8::/56") ||
+		slices.Index(got, "old_dhcp6_ia_pd1_iaid=1") > slices.Index(got, "new_dhcp6_ia_pd1_iaid=1") {
+		t.Errorf("got %v, want the old_ variables first", got)
+	}
+	for _, v := range Env("eth0", Expire, newLease("2001:db8::/56"), nil) {
+		if strings.HasPrefix(v, "new_") {
+			t.Errorf("got %s on expiry", v)
+		}
+	}
+}
+
+func TestPrefixesChanged(t *testing.T) {
+	renewed := newLease("2001:db8:0:100::/56")
+	renewed.IAPDs[0].Options.Options[0].(*dhcpv6.OptIAPrefix).ValidLifetime = time.Hour
+	for _, tt := range []struct {
+		old, new *dhcp6c.Lease
+		want     bool
+	}{
+		{newLease("2001:db8:0:100::/56"), renewed, false},
+		{newLease("2001:db8:0:100::/56"), newLease("2001:db8::/56"), true},
+		{nil, newLease("2001:db8::/56"), true},
+		{newLease("2001:db8::/56"), nil, true},
+		{nil, nil, false},
+	} {
+		if got := PrefixesChanged(tt.old, tt.new); got != tt.want {
+			t.Errorf("PrefixesChanged(%v, %v) = %t, want %t", tt.old, tt.new, got, tt.want)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	dir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{
+		"20-radvd":    0o755,
+		"10-firewall": 0o700,
+		".hidden":     0o755,
+		"30-dns~":     0o755,
+		"40-notes":    0o644,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "50-dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	single := filepath.Join(t.TempDir(), "hook")
+	if err := os.WriteFile(single, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := NewRunner("eth0", single, dir).hooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{single, filepath.Join(dir, "10-firewall"), filepath.Join(dir, "20-radvd")}
+	if !slices.Equal(got, want) {
+		t.Errorf("got hooks %v, want %v", got, want)
+	}
+
+	if _, err := NewRunner("eth0", filepath.Join(dir, "missing")).hooks(); err == nil {
+		t.Error("no error for a missing hook")
+	}
+}
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hooks are shell scripts")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	for _, name := range []string{"10-fail", "20-log"} {
+		script := "#!/bin/sh\nexit 1\n"
+		if name == "20-log" {
+			script = "#!/bin/sh\necho \"$reason $interface $new_delegated_dhcp6_prefix\" > " + out + "\n"
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the failing hook doesn't stop the next one
+	err := NewRunner("eth0", dir).Run(context.Background(), Bound, nil, newLease("2001:db8::/56"))
+	if err == nil || !strings.Contains(err.Error(), "10-fail") {
+		t.Errorf("got error %v, want the one of 10-fail", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != "BOUND6 eth0 2001:db8::/56\n" {
+		t.Errorf("hook got %q", got)
+	}
+}
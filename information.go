@@ -0,0 +1,103 @@
+package dhcp6c
+
+import (
+	"context"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Information Refresh Time bounds, RFC 8415 section 7.6
+const (
+	IRTDefault = 86400 * time.Second
+	IRTMinimum = 600 * time.Second
+)
+
+// Information is the stateless configuration found in a Reply.
+type Information struct {
+	DNS          []net.IP
+	DomainSearch []string
+	SNTP         []net.IP
+	// NTP holds the server and multicast addresses of the NTP options
+	NTP     []net.IP
+	NTPFQDN []string
+	// AFTR is the DS-Lite tunnel endpoint name, empty if none.
+	AFTR string
+	// S46 are the MAP-E, MAP-T and lw4o6 containers, most preferred first.
+	S46 []*OptS46Container
+	// Other are the options the server sent that are neither decoded here
+	// nor part of the protocol (IAs, identifiers, status...).
+	Other []dhcpv6.Option
+	// RefreshTime is when the information should be asked again.
+	RefreshTime time.Duration
+}
+
+// informationOptions are the options of a Reply that are not stateless
+// configuration, or are decoded by ParseInformation.
+var informationOptions = []dhcpv6.OptionCode{
+	dhcpv6.OptionClientID, dhcpv6.OptionServerID, dhcpv6.OptionIANA, dhcpv6.OptionIATA, dhcpv6.OptionIAPD,
+	dhcpv6.OptionORO, dhcpv6.OptionPreference, dhcpv6.OptionElapsedTime, dhcpv6.OptionAuth, dhcpv6.OptionUnicast,
+	dhcpv6.OptionStatusCode, dhcpv6.OptionRapidCommit, dhcpv6.OptionReconfAccept, dhcpv6.OptionReconfMessage,
+	dhcpv6.OptionSolMaxRT, dhcpv6.OptionInfMaxRT, dhcpv6.OptionInformationRefreshTime,
+	dhcpv6.OptionDNSRecursiveNameServer, dhcpv6.OptionDomainSearchList, dhcpv6.OptionSNTPServerList,
+	dhcpv6.OptionNTPServer, dhcpv6.OptionAFTRName, dhcpv6.OptionS46Priority,
+	dhcpv6.OptionS46ContMapE, dhcpv6.OptionS46ContMapT, dhcpv6.OptionS46ContLW,
+}
+
+// ParseInformation extracts the stateless configuration options of msg.
+func ParseInformation(msg *dhcpv6.Message) *Information {
+	info := &Information{
+		DNS:         msg.Options.DNS(),
+		RefreshTime: msg.Options.InformationRefreshTime(IRTDefault),
+		AFTR:        GetAFTRName(msg),
+		S46:         GetS46Containers(msg),
+	}
+	if info.RefreshTime < IRTMinimum {
+		info.RefreshTime = IRTMinimum
+	}
+	if dsl := msg.Options.DomainSearchList(); dsl != nil {
+		info.DomainSearch = dsl.Labels
+	}
+	// SNTP (RFC 4075) is not decoded by dhcpv6: a list of addresses
+	for _, opt := range msg.GetOption(dhcpv6.OptionSNTPServerList) {
+		b := opt.ToBytes()
+		for len(b) >= net.IPv6len {
+			info.SNTP = append(info.SNTP, net.IP(b[:net.IPv6len]))
+			b = b[net.IPv6len:]
+		}
+	}
+	for _, opt := range msg.GetOption(dhcpv6.OptionNTPServer) {
+		ntp, ok := opt.(*dhcpv6.OptNTPServer)
+		if !ok {
+			continue
+		}
+		for _, subopt := range ntp.Suboptions {
+			switch so := subopt.(type) {
+			case *dhcpv6.NTPSuboptionSrvAddr:
+				info.NTP = append(info.NTP, net.IP(*so))
+			case *dhcpv6.NTPSuboptionMCAddr:
+				info.NTP = append(info.NTP, net.IP(*so))
+			case *dhcpv6.NTPSuboptionSrvFQDN:
+				info.NTPFQDN = append(info.NTPFQDN, so.Labels.Labels...)
+			}
+		}
+	}
+	for _, opt := range msg.Options.Options {
+		if !slices.Contains(informationOptions, opt.Code()) {
+			info.Other = append(info.Other, opt)
+		}
+	}
+	return info
+}
+
+// InformationRequest sends an Information-Request and returns the first
+// Reply received. duid can be nil to stay anonymous.
+func (c *Client) InformationRequest(ctx context.Context, duid dhcpv6.DUID, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	req, err := NewInformationRequest(duid, modifiers...)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendAndRead(ctx, c.serverAddr, req, IsMessageType(dhcpv6.MessageTypeReply))
+}
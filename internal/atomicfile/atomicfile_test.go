@@ -0,0 +1,36 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "state.json")
+	for _, data := range []string{"first\n", "second\n"} {
+		if err := WriteFile(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("got %q, want %q", b, data)
+		}
+	}
+	// no temporary file left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want 1", len(entries))
+	}
+
+	if err := WriteFile(filepath.Join(dir, "missing", "state.json"), nil); err == nil {
+		t.Error("no error in a missing directory")
+	}
+}
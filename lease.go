@@ -0,0 +1,651 @@
+package dhcp6c
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// InfiniteLifetime is the 0xffffffff lifetime (or T1/T2) value: it never expires.
+const InfiniteLifetime = time.Duration(0xffffffff) * time.Second
+
+// StatusError is returned when a server answers with a status code other
+// than Success.
+type StatusError struct {
+	Status *dhcpv6.OptStatusCode
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned %s (%s)", e.Status.StatusCode, e.Status.StatusMessage)
+}
+
+// Lease holds the IA_PDs delegated by a server.
+type Lease struct {
+	ClientID dhcpv6.DUID
+	ServerID dhcpv6.DUID
+
+	// ServerAddr is the address Renew messages are unicast to: the Server
+	// Unicast option if any, else the address the Reply came from.
+	ServerAddr *net.UDPAddr
+
+	// IAPDs only holds the IA_PDs with at least one valid prefix.
+	IAPDs []*dhcpv6.OptIAPD
+
+	// Obtained is when the Reply was received, all the timers start from it.
+	Obtained time.Time
+
+	// ReconfigureKey is the key used to authenticate Reconfigure messages,
+	// nil if the server didn't send one.
+	ReconfigureKey []byte
+	// ReconfigureReplay is the replay detection value of the Reply that
+	// delivered the Reconfigure Key, then of the last Reconfigure accepted: a
+	// Reconfigure must have a larger one.
+	ReconfigureReplay uint64
+}
+
+// NewLease builds a lease from a Reply message received from peer.
+func NewLease(reply *dhcpv6.Message, peer *net.UDPAddr) (*Lease, error) {
+	if reply == nil || reply.MessageType != dhcpv6.MessageTypeReply {
+		return nil, errors.New("a lease can only be built from a REPLY")
+	}
+	if status := reply.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		return nil, &StatusError{Status: status}
+	}
+	l := &Lease{
+		ClientID:   reply.Options.ClientID(),
+		ServerID:   reply.Options.ServerID(),
+		ServerAddr: peer,
+		Obtained:   time.Now(),
+	}
+	l.ReconfigureKey, l.ReconfigureReplay = reconfigureKey(reply)
+	if l.ServerID == nil {
+		return nil, errors.New("no Server ID in REPLY")
+	}
+	if opt := reply.GetOneOption(dhcpv6.OptionUnicast); opt != nil {
+		if ip := net.IP(opt.ToBytes()); len(ip) == net.IPv6len {
+			l.ServerAddr = &net.UDPAddr{IP: ip, Port: dhcpv6.DefaultServerPort}
+			if ip.IsLinkLocalUnicast() && peer != nil {
+				l.ServerAddr.Zone = peer.Zone
+			}
+		}
+	}
+	var iaStatus *dhcpv6.OptStatusCode
+	for _, iapd := range reply.Options.IAPD() {
+		if status := iapd.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			iaStatus = status
+			continue
+		}
+		valid := &dhcpv6.OptIAPD{IaId: iapd.IaId, T1: iapd.T1, T2: iapd.T2}
+		for _, p := range iapd.Options.Prefixes() {
+			if p.ValidLifetime > 0 {
+				valid.Options.Add(p)
+			}
+		}
+		if len(valid.Options.Options) > 0 {
+			l.IAPDs = append(l.IAPDs, valid)
+		}
+	}
+	if len(l.IAPDs) == 0 {
+		if iaStatus != nil {
+			return nil, &StatusError{Status: iaStatus}
+		}
+		return nil, errors.New("no prefix delegated")
+	}
+	return l, nil
+}
+
+// Prefixes returns all the prefixes of the lease.
+func (l *Lease) Prefixes() []*dhcpv6.OptIAPrefix {
+	var prefixes []*dhcpv6.OptIAPrefix
+	for _, iapd := range l.IAPDs {
+		prefixes = append(prefixes, iapd.Options.Prefixes()...)
+	}
+	return prefixes
+}
+
+// shortestPreferred returns the shortest preferred lifetime of the lease (or
+// the shortest valid lifetime if no prefix has a preferred lifetime).
+func (l *Lease) shortestPreferred() time.Duration {
+	var pref, valid time.Duration
+	for _, p := range l.Prefixes() {
+		if p.PreferredLifetime > 0 && (pref == 0 || p.PreferredLifetime < pref) {
+			pref = p.PreferredLifetime
+		}
+		if valid == 0 || p.ValidLifetime < valid {
+			valid = p.ValidLifetime
+		}
+	}
+	if pref == 0 {
+		return valid
+	}
+	return pref
+}
+
+// T1 returns the shortest T1 of the IA_PDs. When the server left it to the
+// client (T1 = 0), it's 0.5 times the shortest preferred lifetime as
+// recommended by RFC 8415 section 21.21.
+func (l *Lease) T1() time.Duration {
+	var t1 time.Duration
+	for _, iapd := range l.IAPDs {
+		if iapd.T1 > 0 && (t1 == 0 || iapd.T1 < t1) {
+			t1 = iapd.T1
+		}
+	}
+	if t1 == 0 {
+		t1 = l.shortestPreferred() / 2
+	}
+	return t1
+}
+
+// T2 returns the shortest T2 of the IA_PDs, or 0.8 times the shortest
+// preferred lifetime if the server left it to the client.
+func (l *Lease) T2() time.Duration {
+	var t2 time.Duration
+	for _, iapd := range l.IAPDs {
+		if iapd.T2 > 0 && (t2 == 0 || iapd.T2 < t2) {
+			t2 = iapd.T2
+		}
+	}
+	if t2 == 0 {
+		t2 = l.shortestPreferred() * 8 / 10
+	}
+	if t1 := l.T1(); t2 < t1 {
+		t2 = t1
+	}
+	return t2
+}
+
+// ValidLifetime returns the longest valid lifetime of the prefixes: the lease
+// is lost once it runs out.
+func (l *Lease) ValidLifetime() time.Duration {
+	var valid time.Duration
+	for _, p := range l.Prefixes() {
+		if p.ValidLifetime > valid {
+			valid = p.ValidLifetime
+		}
+	}
+	return valid
+}
+
+// RenewAt returns when the Renew must start (T1).
+func (l *Lease) RenewAt() time.Time {
+	return l.Obtained.Add(l.T1())
+}
+
+// RebindAt returns when the Rebind must start (T2).
+func (l *Lease) RebindAt() time.Time {
+	return l.Obtained.Add(l.T2())
+}
+
+// Expires returns when the valid lifetime of the lease runs out.
+func (l *Lease) Expires() time.Time {
+	return l.Obtained.Add(l.ValidLifetime())
+}
+
+// Renew sends a Renew for the prefixes of lease to the server that granted it
+// and returns the renewed lease.
+func (c *Client) Renew(ctx context.Context, lease *Lease, modifiers ...dhcpv6.Modifier) (*Lease, error) {
+	reply, peer, err := c.sendToServer(ctx, lease, func() (*dhcpv6.Message, error) {
+		return NewRenew(lease, modifiers...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extendLease(lease, reply, peer)
+}
+
+// extendLease builds the lease extended by reply. The Reconfigure Key is only
+// sent once, it's kept from the previous lease with its replay detection value
+// if the server is the same.
+func extendLease(lease *Lease, reply *dhcpv6.Message, peer *net.UDPAddr) (*Lease, error) {
+	l, err := NewLease(reply, peer)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(l.ServerID.ToBytes(), lease.ServerID.ToBytes()) {
+		if l.ReconfigureKey == nil {
+			l.ReconfigureKey = lease.ReconfigureKey
+		}
+		l.ReconfigureReplay = max(l.ReconfigureReplay, lease.ReconfigureReplay)
+	}
+	return l, nil
+}
+
+// Release gives the prefixes of lease back to the server that granted it.
+func (c *Client) Release(ctx context.Context, lease *Lease, modifiers ...dhcpv6.Modifier) error {
+	reply, _, err := c.sendToServer(ctx, lease, func() (*dhcpv6.Message, error) {
+		return NewRelease(lease, modifiers...)
+	})
+	if err != nil {
+		return err
+	}
+	if status := reply.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		return &StatusError{Status: status}
+	}
+	return nil
+}
+
+// Decline tells the server that granted lease that its prefixes can't be
+// used.
+func (c *Client) Decline(ctx context.Context, lease *Lease, modifiers ...dhcpv6.Modifier) error {
+	reply, _, err := c.sendToServer(ctx, lease, func() (*dhcpv6.Message, error) {
+		return NewDecline(lease, modifiers...)
+	})
+	if err != nil {
+		return err
+	}
+	if status := reply.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		return &StatusError{Status: status}
+	}
+	return nil
+}
+
+// sendToServer sends the message built by newMsg to the server of lease and
+// waits for its Reply.
+//
+// If the server answers with a UseMulticast status, a new message is sent
+// again to the broadcast address.
+func (c *Client) sendToServer(ctx context.Context, lease *Lease, newMsg func() (*dhcpv6.Message, error)) (*dhcpv6.Message, *net.UDPAddr, error) {
+	dest := c.serverAddr
+	if lease != nil && lease.ServerAddr != nil {
+		dest = lease.ServerAddr
+	}
+	for {
+		msg, err := newMsg()
+		if err != nil {
+			return nil, nil, err
+		}
+		reply, peer, err := c.SendAndReadFrom(ctx, dest, msg, IsMessageType(dhcpv6.MessageTypeReply))
+		if err != nil {
+			return nil, nil, err
+		}
+		status := reply.Options.Status()
+		if status != nil && status.StatusCode == iana.StatusUseMulticast && dest != c.serverAddr {
+			dest = c.serverAddr
+			continue
+		}
+		return reply, peer, nil
+	}
+}
+
+// Rebind broadcasts a Rebind for the prefixes of lease and returns the lease
+// extended by whichever server answered.
+func (c *Client) Rebind(ctx context.Context, lease *Lease, modifiers ...dhcpv6.Modifier) (*Lease, error) {
+	rebind, err := NewRebind(lease, modifiers...)
+	if err != nil {
+		return nil, err
+	}
+	reply, peer, err := c.SendAndReadFrom(ctx, c.serverAddr, rebind, IsMessageType(dhcpv6.MessageTypeReply))
+	if err != nil {
+		return nil, err
+	}
+	return extendLease(lease, reply, peer)
+}
+
+// LeaseEventType is the kind of a LeaseEvent.
+type LeaseEventType int
+
+const (
+	// LeaseBound: a new lease was obtained with Solicit/Request.
+	LeaseBound LeaseEventType = iota
+	// LeaseRenewed: the lease was extended by a Renew.
+	LeaseRenewed
+	// LeaseRebound: the lease was extended by a Rebind.
+	LeaseRebound
+	// LeaseExpired: the valid lifetime ran out, going back to Solicit.
+	LeaseExpired
+	// LeaseFailed: an exchange failed, Err is set. The lease (if any) is
+	// still valid.
+	LeaseFailed
+	// LeaseInformation: a Reconfigure asked for an Information-Request,
+	// Information is set.
+	LeaseInformation
+	// LeaseReconfigured: a valid Reconfigure was received, the lease has its
+	// replay detection value. The message it asks for is sent next.
+	LeaseReconfigured
+)
+
+func (t LeaseEventType) String() string {
+	switch t {
+	case LeaseBound:
+		return "bound"
+	case LeaseRenewed:
+		return "renewed"
+	case LeaseRebound:
+		return "rebound"
+	case LeaseExpired:
+		return "expired"
+	case LeaseFailed:
+		return "failed"
+	case LeaseInformation:
+		return "information"
+	case LeaseReconfigured:
+		return "reconfigured"
+	}
+	return fmt.Sprintf("unknown (%d)", int(t))
+}
+
+// LeaseEvent is sent by the LeaseManager on each change of the lease.
+type LeaseEvent struct {
+	Type LeaseEventType
+	// Lease is the current lease (the lost one for LeaseExpired, nil if
+	// there is none for LeaseFailed).
+	Lease       *Lease
+	Err         error
+	Information *Information
+}
+
+// LeaseManager obtains a lease and keeps it alive: Renew at T1, Rebind at T2
+// and back to Solicit when the valid lifetime runs out.
+type LeaseManager struct {
+	client    *Client
+	duid      dhcpv6.DUID
+	modifiers []dhcpv6.Modifier
+	events    chan LeaseEvent
+
+	// RetryDelay is the time to wait before soliciting again after a
+	// failure. Default is 1 minute.
+	RetryDelay time.Duration
+
+	// AcceptReconfigure sends the Reconfigure Accept option and handles the
+	// Reconfigure messages of the server that granted the lease.
+	AcceptReconfigure bool
+	// RequestedOptions are added to the Option Request Option of the
+	// messages (see WithRequestedOptions).
+	RequestedOptions []dhcpv6.OptionCode
+
+	mu    sync.Mutex
+	lease *Lease
+}
+
+// NewLeaseManager returns a lease manager using c to talk to the servers.
+// duid is our client ID and modifiers are applied to the Solicit messages
+// (typically the WithIAPD hints).
+func NewLeaseManager(c *Client, duid dhcpv6.DUID, modifiers ...dhcpv6.Modifier) *LeaseManager {
+	return &LeaseManager{
+		client:     c,
+		duid:       duid,
+		modifiers:  modifiers,
+		events:     make(chan LeaseEvent, 16),
+		RetryDelay: time.Minute,
+	}
+}
+
+// Events returns the channel the lease events are sent to. It must be read,
+// Run blocks when it's full. It's closed when Run returns.
+func (m *LeaseManager) Events() <-chan LeaseEvent {
+	return m.events
+}
+
+// Lease returns the current lease, nil if none.
+func (m *LeaseManager) Lease() *Lease {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lease
+}
+
+// Run runs the lease state machine until ctx is done. If lease is not nil and
+// still valid (restored after a restart), it's refreshed right away: the
+// client may be on another link (RFC 8415 section 18.2.12). If neither its
+// server (Renew) nor another one (Rebind) extends it, a new lease is
+// solicited with its prefixes as hints. Without lease, a new one is
+// solicited.
+func (m *LeaseManager) Run(ctx context.Context, lease *Lease) error {
+	defer close(m.events)
+
+	if lease != nil && !time.Now().Before(lease.Expires()) {
+		lease = nil
+	}
+	// hints is the restored lease that couldn't be refreshed
+	var hints *Lease
+	if lease != nil {
+		l, t, err := m.refresh(ctx, lease)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !m.emit(ctx, LeaseEvent{Type: LeaseFailed, Lease: lease, Err: err}) {
+				return ctx.Err()
+			}
+			hints, lease = lease, nil
+		} else {
+			lease = l
+			m.setLease(lease)
+			if !m.emit(ctx, LeaseEvent{Type: t, Lease: lease}) {
+				return ctx.Err()
+			}
+		}
+	}
+	for {
+		if lease == nil {
+			l, err := m.acquire(ctx, hints)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if !m.emit(ctx, LeaseEvent{Type: LeaseFailed, Err: err}) || !sleepUntil(ctx, time.Now().Add(m.RetryDelay)) {
+					return ctx.Err()
+				}
+				continue
+			}
+			lease, hints = l, nil
+			m.setLease(lease)
+			if !m.emit(ctx, LeaseEvent{Type: LeaseBound, Lease: lease}) {
+				return ctx.Err()
+			}
+		}
+
+		mt, replay, ok := m.wait(ctx, lease)
+		if !ok {
+			return ctx.Err()
+		}
+		if replay != 0 {
+			// a copy, the previous lease may be in use by the reader of
+			// the events
+			l := *lease
+			l.ReconfigureReplay = replay
+			lease = &l
+			m.setLease(lease)
+			if !m.emit(ctx, LeaseEvent{Type: LeaseReconfigured, Lease: lease}) {
+				return ctx.Err()
+			}
+		}
+		if mt == dhcpv6.MessageTypeInformationRequest {
+			info, err := m.information(ctx, lease)
+			e := LeaseEvent{Type: LeaseInformation, Lease: lease, Information: info}
+			if err != nil {
+				e = LeaseEvent{Type: LeaseFailed, Lease: lease, Err: err}
+			}
+			if !m.emit(ctx, e) {
+				return ctx.Err()
+			}
+			continue
+		}
+		if mt == dhcpv6.MessageTypeRenew {
+			l, err := m.until(ctx, lease.RebindAt(), func(ctx context.Context) (*Lease, error) {
+				return m.client.Renew(ctx, lease, m.leaseModifiers()...)
+			})
+			if err == nil {
+				lease = l
+				m.setLease(lease)
+				if !m.emit(ctx, LeaseEvent{Type: LeaseRenewed, Lease: lease}) {
+					return ctx.Err()
+				}
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !m.emit(ctx, LeaseEvent{Type: LeaseFailed, Lease: lease, Err: err}) {
+				return ctx.Err()
+			}
+		}
+
+		l, err := m.until(ctx, lease.Expires(), func(ctx context.Context) (*Lease, error) {
+			return m.client.Rebind(ctx, lease, m.leaseModifiers()...)
+		})
+		if err == nil {
+			lease = l
+			m.setLease(lease)
+			if !m.emit(ctx, LeaseEvent{Type: LeaseRebound, Lease: lease}) {
+				return ctx.Err()
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		m.setLease(nil)
+		if !m.emit(ctx, LeaseEvent{Type: LeaseExpired, Lease: lease, Err: err}) {
+			return ctx.Err()
+		}
+		lease = nil
+	}
+}
+
+// refresh extends a restored lease: Renew with its server until T2, then
+// Rebind with any server until it expires. It returns the event type of the
+// extension.
+func (m *LeaseManager) refresh(ctx context.Context, lease *Lease) (*Lease, LeaseEventType, error) {
+	l, err := m.until(ctx, lease.RebindAt(), func(ctx context.Context) (*Lease, error) {
+		return m.client.Renew(ctx, lease, m.leaseModifiers()...)
+	})
+	if err == nil {
+		return l, LeaseRenewed, nil
+	}
+	if ctx.Err() != nil {
+		return nil, 0, err
+	}
+	l, err = m.until(ctx, lease.Expires(), func(ctx context.Context) (*Lease, error) {
+		return m.client.Rebind(ctx, lease, m.leaseModifiers()...)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return l, LeaseRebound, nil
+}
+
+// acquire solicits a new lease with the 4 messages exchange, asking for the
+// prefixes of hints if not nil.
+func (m *LeaseManager) acquire(ctx context.Context, hints *Lease) (*Lease, error) {
+	modifiers := append(m.leaseModifiers(), m.modifiers...)
+	if hints != nil {
+		modifiers = append(modifiers, WithLeaseHints(hints))
+	}
+	solicit, err := NewSolicit(m.duid, modifiers...)
+	if err != nil {
+		return nil, err
+	}
+	adv, err := m.client.SendAndRead(ctx, m.client.serverAddr, solicit, IsMessageType(dhcpv6.MessageTypeAdvertise))
+	if err != nil {
+		return nil, err
+	}
+	request, err := NewRequestFromAdvertise(adv, append(m.leaseModifiers(), dhcpv6.WithClientID(m.duid))...)
+	if err != nil {
+		return nil, err
+	}
+	reply, peer, err := m.client.SendAndReadFrom(ctx, m.client.serverAddr, request, IsMessageType(dhcpv6.MessageTypeReply))
+	if err != nil {
+		return nil, err
+	}
+	return NewLease(reply, peer)
+}
+
+// leaseModifiers returns the modifiers of the messages sent for the lease.
+func (m *LeaseManager) leaseModifiers() []dhcpv6.Modifier {
+	var modifiers []dhcpv6.Modifier
+	if m.AcceptReconfigure {
+		modifiers = append(modifiers, WithReconfigureAccept)
+	}
+	if len(m.RequestedOptions) > 0 {
+		modifiers = append(modifiers, WithRequestedOptions(m.RequestedOptions...))
+	}
+	return modifiers
+}
+
+// wait waits for T1 or a valid Reconfigure message and returns the type of
+// the message to send then with the replay detection value of the
+// Reconfigure (0 at T1), false if ctx is done first.
+func (m *LeaseManager) wait(ctx context.Context, lease *Lease) (dhcpv6.MessageType, uint64, bool) {
+	timer := time.NewTimer(time.Until(lease.RenewAt()))
+	defer timer.Stop()
+	var reconfigure <-chan *Reconfigure
+	if m.AcceptReconfigure {
+		reconfigure = m.client.Reconfigures()
+	}
+	for {
+		select {
+		case <-timer.C:
+			return dhcpv6.MessageTypeRenew, 0, true
+		case <-ctx.Done():
+			return 0, 0, false
+		case r := <-reconfigure:
+			mt, replay, err := ValidateReconfigure(r, lease, lease.ReconfigureReplay)
+			if err != nil {
+				m.client.logger.Printf("dropping Reconfigure: %v", err)
+				continue
+			}
+			return mt, replay, true
+		}
+	}
+}
+
+// information sends the Information-Request asked by a Reconfigure.
+func (m *LeaseManager) information(ctx context.Context, lease *Lease) (*Information, error) {
+	reply, err := m.client.InformationRequest(ctx, m.duid, dhcpv6.WithServerID(lease.ServerID))
+	if err != nil {
+		return nil, err
+	}
+	return ParseInformation(reply), nil
+}
+
+// until calls fn until it succeeds or deadline is reached.
+func (m *LeaseManager) until(ctx context.Context, deadline time.Time, fn func(ctx context.Context) (*Lease, error)) (*Lease, error) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	for {
+		l, err := fn(ctx)
+		if err == nil {
+			return l, nil
+		}
+		// wait a bit, fn may have failed right away
+		if !sleepUntil(ctx, time.Now().Add(m.client.timeout)) {
+			return nil, err
+		}
+	}
+}
+
+func (m *LeaseManager) setLease(l *Lease) {
+	m.mu.Lock()
+	m.lease = l
+	m.mu.Unlock()
+}
+
+// emit sends e on the events channel, returns false if ctx is done first.
+func (m *LeaseManager) emit(ctx context.Context, e LeaseEvent) bool {
+	select {
+	case m.events <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleepUntil waits until t, returns false if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
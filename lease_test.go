@@ -0,0 +1,167 @@
+package dhcp6c_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/fakeserver"
+)
+
+var testMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x0a}
+
+// The lifetimes are sent in seconds: the leases renew after 1s, rebind after
+// 2s and expire after 3s.
+func newScenario(t *testing.T, faults ...fakeserver.Fault) fakeserver.Scenario {
+	return fakeserver.Scenario{
+		T1:        time.Second,
+		T2:        2 * time.Second,
+		Preferred: 3 * time.Second,
+		Valid:     3 * time.Second,
+		Faults:    faults,
+		Logf:      t.Logf,
+	}
+}
+
+// runLeaseManager runs a LeaseManager against srv from lease until the
+// events returned by want are received (or the test times out), and returns
+// them.
+func runLeaseManager(t *testing.T, srv *fakeserver.Server, lease *dhcp6c.Lease, want ...dhcp6c.LeaseEventType) []dhcp6c.LeaseEvent {
+	t.Helper()
+	client, err := dhcp6c.NewWithConn(srv.Pipe(), testMAC, dhcp6c.WithTimeout(100*time.Millisecond), dhcp6c.WithRetry(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	duid := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC}
+	m := dhcp6c.NewLeaseManager(client, duid, dhcp6c.WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{
+		Prefix: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(56, 128)},
+	}))
+	m.RetryDelay = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- m.Run(ctx, lease) }()
+
+	var events []dhcp6c.LeaseEvent
+	for e := range m.Events() {
+		t.Logf("%s %v", e.Type, e.Err)
+		events = append(events, e)
+		if len(events) == len(want) {
+			cancel()
+			break
+		}
+	}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v", err)
+	}
+	for i, e := range events {
+		if e.Type != want[i] {
+			t.Fatalf("event %d is %s, want %s", i, e.Type, want[i])
+		}
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	return events
+}
+
+// countMessages returns how many messages of type mt srv received.
+func countMessages(srv *fakeserver.Server, mt dhcpv6.MessageType) int {
+	n := 0
+	for _, msg := range srv.Received() {
+		if msg.MessageType == mt {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLeaseManager(t *testing.T) {
+	t.Parallel()
+	srv := fakeserver.New(newScenario(t))
+	events := runLeaseManager(t, srv, nil, dhcp6c.LeaseBound, dhcp6c.LeaseRenewed, dhcp6c.LeaseRenewed)
+	lease := events[0].Lease
+	if p := lease.Prefixes(); len(p) != 1 || p[0].Prefix.String() != "2001:db8::/56" {
+		t.Errorf("got prefixes %v, want 2001:db8::/56", p)
+	}
+	if renewed := events[2].Lease; !renewed.Obtained.After(lease.Obtained) || renewed.Prefixes()[0].Prefix.String() != "2001:db8::/56" {
+		t.Errorf("renewed lease %+v", renewed)
+	}
+	if n := countMessages(srv, dhcpv6.MessageTypeRebind); n != 0 {
+		t.Errorf("sent %d Rebind", n)
+	}
+}
+
+func TestLeaseManagerRebind(t *testing.T) {
+	t.Parallel()
+	srv := fakeserver.New(newScenario(t, fakeserver.Fault{Type: dhcpv6.MessageTypeRenew, Drop: true}))
+	events := runLeaseManager(t, srv, nil, dhcp6c.LeaseBound, dhcp6c.LeaseFailed, dhcp6c.LeaseRebound)
+	if !errors.Is(events[1].Err, context.DeadlineExceeded) {
+		t.Errorf("Renew failed with %v, want a timeout at T2", events[1].Err)
+	}
+	if p := events[2].Lease.Prefixes(); len(p) != 1 || p[0].Prefix.String() != "2001:db8::/56" {
+		t.Errorf("got prefixes %v after the Rebind, want 2001:db8::/56", p)
+	}
+}
+
+func TestLeaseManagerExpired(t *testing.T) {
+	t.Parallel()
+	srv := fakeserver.New(newScenario(t,
+		fakeserver.Fault{Type: dhcpv6.MessageTypeRenew, Drop: true},
+		fakeserver.Fault{Type: dhcpv6.MessageTypeRebind, Drop: true}))
+	events := runLeaseManager(t, srv, nil, dhcp6c.LeaseBound, dhcp6c.LeaseFailed, dhcp6c.LeaseExpired, dhcp6c.LeaseBound)
+	if expired := events[2].Lease; time.Now().Before(expired.Expires()) {
+		t.Errorf("lease expired before %s", expired.Expires())
+	}
+	if countMessages(srv, dhcpv6.MessageTypeRebind) == 0 {
+		t.Error("no Rebind sent")
+	}
+}
+
+func TestLeaseManagerNoBinding(t *testing.T) {
+	t.Parallel()
+	// a restored lease the server doesn't know: neither Renew nor Rebind
+	// extend it, a new one is solicited
+	srv := fakeserver.New(newScenario(t))
+	restored := &dhcp6c.Lease{
+		ClientID: &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC},
+		ServerID: fakeserver.DefaultServerID,
+		IAPDs: []*dhcpv6.OptIAPD{{
+			IaId: [4]byte{0, 0, 0, 1},
+			T1:   time.Second / 2,
+			T2:   time.Second,
+			Options: dhcpv6.PDOptions{Options: dhcpv6.Options{&dhcpv6.OptIAPrefix{
+				PreferredLifetime: 2 * time.Second,
+				ValidLifetime:     2 * time.Second,
+				Prefix:            &net.IPNet{IP: net.ParseIP("2001:db8:ff00::"), Mask: net.CIDRMask(56, 128)},
+			}}},
+		}},
+		Obtained: time.Now(),
+	}
+	events := runLeaseManager(t, srv, restored, dhcp6c.LeaseFailed, dhcp6c.LeaseBound)
+	var serr *dhcp6c.StatusError
+	if !errors.As(events[0].Err, &serr) || serr.Status.StatusCode != iana.StatusNoBinding {
+		t.Errorf("refresh failed with %v, want NoBinding", events[0].Err)
+	}
+	if countMessages(srv, dhcpv6.MessageTypeRenew) == 0 || countMessages(srv, dhcpv6.MessageTypeRebind) == 0 {
+		t.Error("no Renew or Rebind sent")
+	}
+}
+
+func TestLeaseManagerWrongXID(t *testing.T) {
+	t.Parallel()
+	// the Reply with another transaction ID is ignored, the Request is
+	// retransmitted
+	srv := fakeserver.New(newScenario(t, fakeserver.Fault{Type: dhcpv6.MessageTypeRequest, Count: 1, WrongXID: true}))
+	runLeaseManager(t, srv, nil, dhcp6c.LeaseBound)
+	if n := countMessages(srv, dhcpv6.MessageTypeRequest); n != 2 {
+		t.Errorf("sent %d Request, want 2", n)
+	}
+}
@@ -0,0 +1,238 @@
+package dhcp6c
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// NewSolicit creates a new SOLICIT message with the given duid.
+//
+// Unlike dhcpv6.NewSolicit, no IA_NA is added: use WithIAPD (and/or
+// dhcpv6.WithIANA) modifiers to add the IAs to solicit.
+func NewSolicit(duid dhcpv6.DUID, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	if duid == nil {
+		return nil, errors.New("no duid")
+	}
+
+	m, err := dhcpv6.NewMessage()
+	if err != nil {
+		return nil, err
+	}
+	m.MessageType = dhcpv6.MessageTypeSolicit
+	m.AddOption(dhcpv6.OptClientID(duid))
+	m.AddOption(dhcpv6.OptRequestedOption(
+		dhcpv6.OptionDNSRecursiveNameServer,
+		dhcpv6.OptionDomainSearchList,
+	))
+	m.AddOption(dhcpv6.OptElapsedTime(0))
+	for _, mod := range modifiers {
+		mod(m)
+	}
+	return m, nil
+}
+
+// WithLeaseHints asks for the prefixes of lease (without lifetimes) in the
+// IA_PDs of the same IAID, replacing their hints, and adds the missing IA_PDs.
+// It must be applied after the WithIAPD modifiers.
+func WithLeaseHints(lease *Lease) dhcpv6.Modifier {
+	return func(d dhcpv6.DHCPv6) {
+		msg, ok := d.(*dhcpv6.Message)
+		if !ok || lease == nil {
+			return
+		}
+		for _, held := range lease.IAPDs {
+			hint := &dhcpv6.OptIAPD{IaId: held.IaId}
+			for _, p := range held.Options.Prefixes() {
+				hint.Options.Add(&dhcpv6.OptIAPrefix{Prefix: p.Prefix})
+			}
+			i := slices.IndexFunc(msg.Options.Options, func(o dhcpv6.Option) bool {
+				iapd, ok := o.(*dhcpv6.OptIAPD)
+				return ok && iapd.IaId == held.IaId
+			})
+			if i >= 0 {
+				msg.Options.Options[i] = hint
+			} else {
+				msg.AddOption(hint)
+			}
+		}
+	}
+}
+
+// WithRequestedOptions adds codes to the Option Request Option of the message,
+// after the default ones. The messages without one (Release, Decline) are
+// left unchanged.
+func WithRequestedOptions(codes ...dhcpv6.OptionCode) dhcpv6.Modifier {
+	return func(d dhcpv6.DHCPv6) {
+		msg, ok := d.(*dhcpv6.Message)
+		if !ok || msg.GetOneOption(dhcpv6.OptionORO) == nil {
+			return
+		}
+		oro := msg.Options.RequestedOptions()
+		for _, c := range codes {
+			oro.Add(c)
+		}
+		msg.Options.Update(dhcpv6.OptRequestedOption(oro...))
+	}
+}
+
+// NewRequestFromAdvertise creates a new REQUEST message based on an ADVERTISE
+// message.
+//
+// Unlike dhcpv6.NewRequestFromAdvertise, an IA_NA is not required (PD only
+// servers don't send one) and all the IA_NA and IA_PD of the advertise are
+// copied, not only the first one, except the IA_PDs with an error status.
+func NewRequestFromAdvertise(adv *dhcpv6.Message, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	if adv == nil {
+		return nil, errors.New("ADVERTISE cannot be nil")
+	}
+	if adv.MessageType != dhcpv6.MessageTypeAdvertise {
+		return nil, fmt.Errorf("the passed ADVERTISE must have ADVERTISE type set")
+	}
+	req, err := dhcpv6.NewMessage()
+	if err != nil {
+		return nil, err
+	}
+	req.MessageType = dhcpv6.MessageTypeRequest
+	cid := adv.GetOneOption(dhcpv6.OptionClientID)
+	if cid == nil {
+		return nil, fmt.Errorf("Client ID cannot be nil in ADVERTISE when building REQUEST")
+	}
+	req.AddOption(cid)
+	sid := adv.GetOneOption(dhcpv6.OptionServerID)
+	if sid == nil {
+		return nil, fmt.Errorf("Server ID cannot be nil in ADVERTISE when building REQUEST")
+	}
+	req.AddOption(sid)
+	req.AddOption(dhcpv6.OptElapsedTime(0))
+	for _, iana := range adv.Options.IANA() {
+		req.AddOption(iana)
+	}
+	var iapds int
+	for _, iapd := range adv.Options.IAPD() {
+		// the IA_PDs without prefix are left out, and the client doesn't
+		// send Status Codes (RFC 8415 section 21.13)
+		if status := iapd.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			continue
+		}
+		req.AddOption(&dhcpv6.OptIAPD{IaId: iapd.IaId, T1: iapd.T1, T2: iapd.T2, Options: withoutStatus(iapd.Options)})
+		iapds++
+	}
+	if iapds == 0 && adv.Options.OneIANA() == nil {
+		return nil, fmt.Errorf("no IA_NA or IA_PD in ADVERTISE when building REQUEST")
+	}
+	req.AddOption(dhcpv6.OptRequestedOption(
+		dhcpv6.OptionDNSRecursiveNameServer,
+		dhcpv6.OptionDomainSearchList,
+	))
+
+	for _, mod := range modifiers {
+		mod(req)
+	}
+	return req, nil
+}
+
+// withoutStatus returns the options of an IA_PD without its Status Code.
+func withoutStatus(opts dhcpv6.PDOptions) dhcpv6.PDOptions {
+	var out dhcpv6.PDOptions
+	for _, opt := range opts.Options {
+		if opt.Code() != dhcpv6.OptionStatusCode {
+			out.Add(opt)
+		}
+	}
+	return out
+}
+
+// NewRenew creates a new RENEW message for the prefixes held in lease.
+func NewRenew(lease *Lease, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	if lease == nil || lease.ServerID == nil {
+		return nil, errors.New("RENEW requires a lease with a Server ID")
+	}
+	return newFromLease(dhcpv6.MessageTypeRenew, lease, true, modifiers...)
+}
+
+// NewRebind creates a new REBIND message for the prefixes held in lease.
+// Unlike RENEW, there is no Server ID: any server can answer.
+func NewRebind(lease *Lease, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	return newFromLease(dhcpv6.MessageTypeRebind, lease, false, modifiers...)
+}
+
+// newFromLease builds a message of type mt carrying the Client ID, the IA_PDs
+// and optionally the Server ID of lease.
+func newFromLease(mt dhcpv6.MessageType, lease *Lease, withServerID bool, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	if lease == nil || lease.ClientID == nil {
+		return nil, fmt.Errorf("%s requires a lease with a Client ID", mt)
+	}
+	m, err := dhcpv6.NewMessage()
+	if err != nil {
+		return nil, err
+	}
+	m.MessageType = mt
+	m.AddOption(dhcpv6.OptClientID(lease.ClientID))
+	if withServerID {
+		m.AddOption(dhcpv6.OptServerID(lease.ServerID))
+	}
+	m.AddOption(dhcpv6.OptElapsedTime(0))
+	for _, iapd := range lease.IAPDs {
+		// RFC 8415 section 18.2.4: T1 and T2 should be set to 0
+		m.AddOption(&dhcpv6.OptIAPD{IaId: iapd.IaId, Options: iapd.Options})
+	}
+	// no ORO in Release and Decline (RFC 8415 section 18.2.7 and 18.2.8)
+	if mt == dhcpv6.MessageTypeRenew || mt == dhcpv6.MessageTypeRebind {
+		m.AddOption(dhcpv6.OptRequestedOption(
+			dhcpv6.OptionDNSRecursiveNameServer,
+			dhcpv6.OptionDomainSearchList,
+		))
+	}
+	for _, mod := range modifiers {
+		mod(m)
+	}
+	return m, nil
+}
+
+// NewRelease creates a new RELEASE message giving back the prefixes held in
+// lease.
+func NewRelease(lease *Lease, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	if lease == nil || lease.ServerID == nil {
+		return nil, errors.New("RELEASE requires a lease with a Server ID")
+	}
+	return newFromLease(dhcpv6.MessageTypeRelease, lease, true, modifiers...)
+}
+
+// NewDecline creates a new DECLINE message for the prefixes held in lease.
+func NewDecline(lease *Lease, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	if lease == nil || lease.ServerID == nil {
+		return nil, errors.New("DECLINE requires a lease with a Server ID")
+	}
+	return newFromLease(dhcpv6.MessageTypeDecline, lease, true, modifiers...)
+}
+
+// NewInformationRequest creates a new INFORMATION-REQUEST message asking for
+// the stateless configuration (DNS, NTP, ...).
+//
+// duid can be nil, the Client ID option is then omitted.
+func NewInformationRequest(duid dhcpv6.DUID, modifiers ...dhcpv6.Modifier) (*dhcpv6.Message, error) {
+	m, err := dhcpv6.NewMessage()
+	if err != nil {
+		return nil, err
+	}
+	m.MessageType = dhcpv6.MessageTypeInformationRequest
+	if duid != nil {
+		m.AddOption(dhcpv6.OptClientID(duid))
+	}
+	m.AddOption(dhcpv6.OptRequestedOption(
+		dhcpv6.OptionDNSRecursiveNameServer,
+		dhcpv6.OptionDomainSearchList,
+		dhcpv6.OptionSNTPServerList,
+		dhcpv6.OptionNTPServer,
+		dhcpv6.OptionInformationRefreshTime,
+	))
+	m.AddOption(dhcpv6.OptElapsedTime(0))
+	for _, mod := range modifiers {
+		mod(m)
+	}
+	return m, nil
+}
@@ -0,0 +1,53 @@
+package dhcp6c_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/fakeserver"
+)
+
+func TestNewRequestFromAdvertise(t *testing.T) {
+	// the IA_PD without prefix is left out, the other one is requested
+	// without its Status Code
+	duid := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC}
+	adv, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	adv.MessageType = dhcpv6.MessageTypeAdvertise
+	adv.AddOption(dhcpv6.OptClientID(duid))
+	adv.AddOption(dhcpv6.OptServerID(fakeserver.DefaultServerID))
+	adv.AddOption(&dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 1}, Options: dhcpv6.PDOptions{Options: dhcpv6.Options{
+		&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoPrefixAvail},
+	}}})
+	adv.AddOption(&dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 2}, Options: dhcpv6.PDOptions{Options: dhcpv6.Options{
+		&dhcpv6.OptIAPrefix{PreferredLifetime: time.Hour, ValidLifetime: 2 * time.Hour, Prefix: &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(56, 128)}},
+		&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess},
+	}}})
+
+	req, err := dhcp6c.NewRequestFromAdvertise(adv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iapds := req.Options.IAPD()
+	if len(iapds) != 1 || iapds[0].IaId != [4]byte{0, 0, 0, 2} {
+		t.Fatalf("got IA_PDs %v, want IAID 2 only", iapds)
+	}
+	if iapds[0].Options.Status() != nil || len(iapds[0].Options.Prefixes()) != 1 {
+		t.Errorf("got IA_PD %s, want its prefix without Status Code", iapds[0])
+	}
+
+	// nothing left to request
+	adv.Options.Del(dhcpv6.OptionIAPD)
+	adv.AddOption(&dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 1}, Options: dhcpv6.PDOptions{Options: dhcpv6.Options{
+		&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoPrefixAvail},
+	}}})
+	if _, err := dhcp6c.NewRequestFromAdvertise(adv); err == nil {
+		t.Error("built a Request without IA")
+	}
+}
@@ -0,0 +1,346 @@
+// Package metrics exports the results of the monitor probes as Prometheus
+// metrics over HTTP, in the Prometheus text format or in OpenMetrics when the
+// scraper asks for it. The exposition is written by hand to keep the
+// dependencies down.
+//
+//	e := metrics.New()
+//	e.AddClient("eth0", client)
+//	http.Handle("/metrics", e)
+//	for ev := range m.Events() {
+//		e.Observe("eth0", ev)
+//	}
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/monitor"
+)
+
+// DefaultBuckets are the upper bounds of the RTT histogram, in seconds.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Reasons of the dhcpv6pd_probe_failures_total counter.
+const (
+	// ReasonTimeout: no answer to the probe.
+	ReasonTimeout = "timeout"
+	// ReasonStatusCode: the answer has an error Status Code, at the top
+	// level or in an IA_PD (NoPrefixAvail...).
+	ReasonStatusCode = "status_code"
+	// ReasonParseError: a received packet is not a DHCPv6 message.
+	ReasonParseError = "parse_error"
+	// ReasonAuth: an answer failed the authentication.
+	ReasonAuth = "auth"
+	// ReasonOther: any other probe error (socket...).
+	ReasonOther = "other"
+)
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// iapdMetrics is the last content of an IA_PD, the lifetimes and length are
+// the ones of its first prefix.
+type iapdMetrics struct {
+	prefixes  int
+	length    int
+	preferred time.Duration
+	valid     time.Duration
+}
+
+type ifaceMetrics struct {
+	client          *dhcp6c.Client
+	probes          uint64
+	failures        map[string]uint64
+	events          map[string]uint64
+	rtt             histogram
+	transmissions   int
+	retransmissions uint64
+	lastSuccess     time.Time
+	iapds           map[uint32]iapdMetrics
+}
+
+// Exporter holds the metrics of the monitored interfaces and serves them as
+// an http.Handler.
+type Exporter struct {
+	// Buckets are the sorted upper bounds of the RTT histogram in seconds,
+	// DefaultBuckets by default. They must not be changed once Observe was
+	// called.
+	Buckets []float64
+
+	mu     sync.Mutex
+	ifaces map[string]*ifaceMetrics
+}
+
+// New returns an exporter without metrics.
+func New() *Exporter {
+	return &Exporter{
+		Buckets: DefaultBuckets,
+		ifaces:  make(map[string]*ifaceMetrics),
+	}
+}
+
+func (e *Exporter) iface(name string) *ifaceMetrics {
+	m := e.ifaces[name]
+	if m == nil {
+		m = &ifaceMetrics{
+			failures: make(map[string]uint64),
+			events:   make(map[string]uint64),
+			rtt:      histogram{counts: make([]uint64, len(e.Buckets))},
+			iapds:    make(map[uint32]iapdMetrics),
+		}
+		e.ifaces[name] = m
+	}
+	return m
+}
+
+// AddClient adds the packets c dropped (Client.Stats) to the failures of
+// iface, as parse_error and auth.
+func (e *Exporter) AddClient(iface string, c *dhcp6c.Client) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.iface(iface).client = c
+}
+
+// Reason classifies a probe error.
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, dhcp6c.ErrNoResponse), errors.Is(err, monitor.ErrNoAdvertise), errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimeout
+	}
+	return ReasonOther
+}
+
+// failed tells if the answer has an error Status Code.
+func failed(r *monitor.Result) bool {
+	if r.Status != iana.StatusSuccess {
+		return true
+	}
+	for _, iapd := range r.IAPDs {
+		if iapd.Status != iana.StatusSuccess {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe updates the metrics of iface with a monitor event.
+func (e *Exporter) Observe(iface string, ev monitor.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := e.iface(iface)
+	m.events[ev.Type.String()]++
+
+	switch ev.Type {
+	case monitor.EventProbeFailed:
+		m.probes++
+		m.failures[Reason(ev.Err)]++
+	case monitor.EventProbed:
+		r := ev.Result
+		m.probes++
+		rtt := r.RTT.Seconds()
+		for i, b := range e.Buckets {
+			if rtt <= b {
+				m.rtt.counts[i]++
+			}
+		}
+		m.rtt.sum += rtt
+		m.rtt.count++
+		m.transmissions = r.Transmissions
+		if r.Transmissions > 1 {
+			m.retransmissions += uint64(r.Transmissions - 1)
+		}
+		if failed(r) {
+			m.failures[ReasonStatusCode]++
+		} else {
+			m.lastSuccess = r.Time
+		}
+		clear(m.iapds)
+		for _, iapd := range r.IAPDs {
+			im := iapdMetrics{}
+			if iapd.Status == iana.StatusSuccess && len(iapd.Prefixes) > 0 {
+				p := iapd.Prefixes[0]
+				im = iapdMetrics{
+					prefixes:  len(iapd.Prefixes),
+					length:    p.Prefix.Bits(),
+					preferred: p.Preferred,
+					valid:     p.Valid,
+				}
+			}
+			m.iapds[iapd.IAID] = im
+		}
+	}
+}
+
+// ServeHTTP writes the metrics, in OpenMetrics if the Accept header asks for
+// it.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	om := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if om {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypeText)
+	}
+	e.Write(w, om)
+}
+
+// sample is a line of a metric family.
+type sample struct {
+	// suffix is appended to the family name (_total, _bucket...).
+	suffix string
+	labels []string // name, value pairs
+	value  float64
+}
+
+type family struct {
+	// name is without the _total suffix of the counters.
+	name    string
+	typ     string
+	help    string
+	samples []sample
+}
+
+// Write writes the metrics to w, in OpenMetrics if om is set, otherwise in
+// the Prometheus text format.
+func (e *Exporter) Write(w io.Writer, om bool) error {
+	var b strings.Builder
+	for _, f := range e.families() {
+		f.write(&b, om)
+	}
+	if om {
+		b.WriteString("# EOF\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (e *Exporter) families() []*family {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	probes := &family{name: "dhcpv6pd_probes", typ: "counter", help: "Number of probes sent."}
+	failures := &family{name: "dhcpv6pd_probe_failures", typ: "counter", help: "Number of failures by reason."}
+	events := &family{name: "dhcpv6pd_events", typ: "counter", help: "Number of monitor events by type."}
+	rtt := &family{name: "dhcpv6pd_probe_rtt_seconds", typ: "histogram", help: "Time from the first transmission of the probe to the answer."}
+	transmissions := &family{name: "dhcpv6pd_probe_transmissions", typ: "gauge", help: "Number of transmissions of the last answered probe."}
+	retransmissions := &family{name: "dhcpv6pd_retransmissions", typ: "counter", help: "Number of retransmissions of the answered probes."}
+	lastSuccess := &family{name: "dhcpv6pd_last_success_timestamp_seconds", typ: "gauge", help: "Time of the last answer without error status."}
+	prefixes := &family{name: "dhcpv6pd_iapd_prefixes", typ: "gauge", help: "Number of prefixes delegated to the IA_PD."}
+	length := &family{name: "dhcpv6pd_prefix_length", typ: "gauge", help: "Length of the prefix delegated to the IA_PD."}
+	preferred := &family{name: "dhcpv6pd_prefix_preferred_lifetime_seconds", typ: "gauge", help: "Preferred lifetime of the prefix delegated to the IA_PD."}
+	valid := &family{name: "dhcpv6pd_prefix_valid_lifetime_seconds", typ: "gauge", help: "Valid lifetime of the prefix delegated to the IA_PD."}
+
+	for _, name := range slices.Sorted(maps.Keys(e.ifaces)) {
+		m := e.ifaces[name]
+		l := []string{"interface", name}
+		failed := maps.Clone(m.failures)
+		for _, reason := range []string{ReasonTimeout, ReasonStatusCode, ReasonOther} {
+			failed[reason] += 0
+		}
+		if m.client != nil {
+			stats := m.client.Stats()
+			failed[ReasonParseError] += stats.Invalid
+			failed[ReasonAuth] += stats.Unauthenticated
+		}
+
+		probes.add("_total", float64(m.probes), l...)
+		for _, reason := range slices.Sorted(maps.Keys(failed)) {
+			failures.add("_total", float64(failed[reason]), "interface", name, "reason", reason)
+		}
+		for _, event := range slices.Sorted(maps.Keys(m.events)) {
+			events.add("_total", float64(m.events[event]), "interface", name, "event", event)
+		}
+		for i, le := range e.Buckets {
+			rtt.add("_bucket", float64(m.rtt.counts[i]), "interface", name, "le", formatFloat(le))
+		}
+		rtt.add("_bucket", float64(m.rtt.count), "interface", name, "le", "+Inf")
+		rtt.add("_sum", m.rtt.sum, l...)
+		rtt.add("_count", float64(m.rtt.count), l...)
+		transmissions.add("", float64(m.transmissions), l...)
+		retransmissions.add("_total", float64(m.retransmissions), l...)
+		if !m.lastSuccess.IsZero() {
+			lastSuccess.add("", float64(m.lastSuccess.UnixMilli())/1000, l...)
+		}
+
+		for _, iaid := range slices.Sorted(maps.Keys(m.iapds)) {
+			im := m.iapds[iaid]
+			l := []string{"interface", name, "iaid", strconv.FormatUint(uint64(iaid), 10)}
+			prefixes.add("", float64(im.prefixes), l...)
+			if im.prefixes == 0 {
+				continue
+			}
+			length.add("", float64(im.length), l...)
+			preferred.add("", im.preferred.Seconds(), l...)
+			valid.add("", im.valid.Seconds(), l...)
+		}
+	}
+	return []*family{probes, failures, events, rtt, transmissions, retransmissions, lastSuccess, prefixes, length, preferred, valid}
+}
+
+func (f *family) add(suffix string, value float64, labels ...string) {
+	f.samples = append(f.samples, sample{suffix: suffix, labels: labels, value: value})
+}
+
+func (f *family) write(b *strings.Builder, om bool) {
+	name := f.name
+	if f.typ == "counter" && !om {
+		// the Prometheus text format names the counter family with its
+		// _total suffix, OpenMetrics without.
+		name += "_total"
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n", name, f.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, f.typ)
+	for _, s := range f.samples {
+		b.WriteString(f.name + s.suffix)
+		if len(s.labels) > 0 {
+			b.WriteByte('{')
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(b, "%s=\"%s\"", s.labels[i], escape(s.labels[i+1]))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(formatFloat(s.value))
+		b.WriteByte('\n')
+	}
+}
+
+// escape escapes a label value.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
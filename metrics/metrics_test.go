@@ -0,0 +1,140 @@
+package metrics_test
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/metrics"
+	"github.com/nspeed-app/testdhcpv6pd/monitor"
+	"github.com/nspeed-app/testdhcpv6pd/store"
+)
+
+// newExporter returns an exporter of eth0 after a probe answered in 3ms with
+// a retransmission, a probe answered in 30ms with NoPrefixAvail and a probe
+// without answer.
+func newExporter() *metrics.Exporter {
+	e := metrics.New()
+	e.Observe("eth0", monitor.Event{Type: monitor.EventProbed, Result: &monitor.Result{
+		Time:          time.Unix(1700000000, 0),
+		RTT:           3 * time.Millisecond,
+		Transmissions: 2,
+		IAPDs: []monitor.IAPD{{IAID: 1, Prefixes: []store.Prefix{
+			{Prefix: netip.MustParsePrefix("2001:db8::/56"), Preferred: time.Hour, Valid: 2 * time.Hour},
+		}}},
+	}})
+	e.Observe("eth0", monitor.Event{Type: monitor.EventProbed, Result: &monitor.Result{
+		Time:          time.Unix(1700000060, 0),
+		RTT:           30 * time.Millisecond,
+		Transmissions: 1,
+		IAPDs:         []monitor.IAPD{{IAID: 1, Status: iana.StatusNoPrefixAvail}},
+	}})
+	e.Observe("eth0", monitor.Event{Type: monitor.EventProbeFailed, Err: dhcp6c.ErrNoResponse})
+	return e
+}
+
+// scrape returns the content type and the lines of the metrics served to a
+// scraper sending accept.
+func scrape(t *testing.T, e *metrics.Exporter, accept string) (string, []string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	return w.Header().Get("Content-Type"), strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+}
+
+// contains checks that lines holds each of want.
+func contains(t *testing.T, lines []string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		found := false
+		for _, l := range lines {
+			if l == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no line %q", w)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	ct, lines := scrape(t, newExporter(), "")
+	if !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", ct)
+	}
+	contains(t, lines,
+		"# TYPE dhcpv6pd_probes_total counter",
+		`dhcpv6pd_probes_total{interface="eth0"} 3`,
+		// the reasons not seen yet are exported with 0
+		"# TYPE dhcpv6pd_probe_failures_total counter",
+		`dhcpv6pd_probe_failures_total{interface="eth0",reason="other"} 0`,
+		`dhcpv6pd_probe_failures_total{interface="eth0",reason="status_code"} 1`,
+		`dhcpv6pd_probe_failures_total{interface="eth0",reason="timeout"} 1`,
+		`dhcpv6pd_events_total{interface="eth0",event="probed"} 2`,
+		`dhcpv6pd_events_total{interface="eth0",event="probe-failed"} 1`,
+		// the buckets are cumulative
+		"# TYPE dhcpv6pd_probe_rtt_seconds histogram",
+		`dhcpv6pd_probe_rtt_seconds_bucket{interface="eth0",le="0.0025"} 0`,
+		`dhcpv6pd_probe_rtt_seconds_bucket{interface="eth0",le="0.005"} 1`,
+		`dhcpv6pd_probe_rtt_seconds_bucket{interface="eth0",le="0.025"} 1`,
+		`dhcpv6pd_probe_rtt_seconds_bucket{interface="eth0",le="0.05"} 2`,
+		`dhcpv6pd_probe_rtt_seconds_bucket{interface="eth0",le="10"} 2`,
+		`dhcpv6pd_probe_rtt_seconds_bucket{interface="eth0",le="+Inf"} 2`,
+		`dhcpv6pd_probe_rtt_seconds_sum{interface="eth0"} 0.033`,
+		`dhcpv6pd_probe_rtt_seconds_count{interface="eth0"} 2`,
+		`dhcpv6pd_probe_transmissions{interface="eth0"} 1`,
+		`dhcpv6pd_retransmissions_total{interface="eth0"} 1`,
+		// the answer with NoPrefixAvail is not a success
+		`dhcpv6pd_last_success_timestamp_seconds{interface="eth0"} 1.7e+09`,
+		`dhcpv6pd_iapd_prefixes{interface="eth0",iaid="1"} 0`,
+	)
+	for _, l := range lines {
+		if strings.HasPrefix(l, "dhcpv6pd_prefix_") {
+			t.Errorf("got %q for an IA_PD without prefix", l)
+		}
+		if l == "# EOF" {
+			t.Error("got the OpenMetrics EOF")
+		}
+	}
+}
+
+func TestOpenMetrics(t *testing.T) {
+	e := newExporter()
+	e.Observe("eth0", monitor.Event{Type: monitor.EventProbed, Result: &monitor.Result{
+		Time:          time.Unix(1700000120, 0),
+		RTT:           time.Millisecond,
+		Transmissions: 1,
+		IAPDs: []monitor.IAPD{{IAID: 1, Prefixes: []store.Prefix{
+			{Prefix: netip.MustParsePrefix("2001:db8::/56"), Preferred: time.Hour, Valid: 2 * time.Hour},
+		}}},
+	}})
+	ct, lines := scrape(t, e, "application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+	if !strings.HasPrefix(ct, "application/openmetrics-text; version=1.0.0") {
+		t.Errorf("got content type %q", ct)
+	}
+	// the counter families are named without _total, their samples with
+	contains(t, lines,
+		"# TYPE dhcpv6pd_probes counter",
+		`dhcpv6pd_probes_total{interface="eth0"} 4`,
+		"# HELP dhcpv6pd_retransmissions Number of retransmissions of the answered probes.",
+		`dhcpv6pd_probe_rtt_seconds_bucket{interface="eth0",le="0.001"} 1`,
+		`dhcpv6pd_last_success_timestamp_seconds{interface="eth0"} 1.70000012e+09`,
+		`dhcpv6pd_iapd_prefixes{interface="eth0",iaid="1"} 1`,
+		`dhcpv6pd_prefix_length{interface="eth0",iaid="1"} 56`,
+		`dhcpv6pd_prefix_preferred_lifetime_seconds{interface="eth0",iaid="1"} 3600`,
+		`dhcpv6pd_prefix_valid_lifetime_seconds{interface="eth0",iaid="1"} 7200`,
+	)
+	if lines[len(lines)-1] != "# EOF" {
+		t.Errorf("last line is %q, want # EOF", lines[len(lines)-1])
+	}
+}
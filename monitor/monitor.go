@@ -0,0 +1,251 @@
+// Package monitor probes the DHCPv6-PD servers on an interval and reports
+// the changes of the delegated prefixes, their lifetimes or the server, to
+// notice an ISP renumbering.
+//
+// The probes are spaced out: a failure doubles the delay (up to MaxBackoff),
+// the delay is randomized by Jitter and never goes below MinInterval, even
+// across restarts as the time of the last probe is kept in the State.
+//
+//	m := monitor.New(monitor.SolicitProbe(client, duid, hints...), time.Hour, state)
+//	m.StateFile = "monitor.json"
+//	go m.Run(ctx)
+//	for e := range m.Events() {
+//		...
+//	}
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventProbed: a probe succeeded, sent before the changes it found.
+	EventProbed EventType = iota
+	// EventProbeFailed: a probe failed, Err is set.
+	EventProbeFailed
+	// EventPrefixObtained: the IA_PD got prefixes, it had none before.
+	EventPrefixObtained
+	// EventPrefixChanged: the IA_PD got other prefixes.
+	EventPrefixChanged
+	// EventPrefixLost: the IA_PD has no prefixes anymore.
+	EventPrefixLost
+	// EventLifetimesChanged: same prefixes with other lifetimes.
+	EventLifetimesChanged
+	// EventServerChanged: another server (DUID) answered.
+	EventServerChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventProbed:
+		return "probed"
+	case EventProbeFailed:
+		return "probe-failed"
+	case EventPrefixObtained:
+		return "prefix-obtained"
+	case EventPrefixChanged:
+		return "prefix-changed"
+	case EventPrefixLost:
+		return "prefix-lost"
+	case EventLifetimesChanged:
+		return "lifetimes-changed"
+	case EventServerChanged:
+		return "server-changed"
+	}
+	return fmt.Sprintf("unknown (%d)", int(t))
+}
+
+// Event is sent by the Monitor after each probe.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// IAID is the IA_PD of the prefix and lifetimes events, Old and New its
+	// previous and current content (nil if absent).
+	IAID uint32
+	Old  *IAPD
+	New  *IAPD
+	// OldServer and NewServer are the server DUIDs of EventServerChanged.
+	OldServer string
+	NewServer string
+	// Result is the probe result, nil for EventProbeFailed.
+	Result *Result
+	Err    error
+}
+
+// Compare returns the change events from the old result to the new one. old
+// may be nil (first probe), then each delegating IA_PD is reported as
+// obtained.
+func Compare(old, new *Result) []Event {
+	var events []Event
+	event := func(t EventType) Event {
+		return Event{Type: t, Time: new.Time, Result: new}
+	}
+	if old != nil && old.ServerDUID != new.ServerDUID {
+		e := event(EventServerChanged)
+		e.OldServer, e.NewServer = old.ServerDUID, new.ServerDUID
+		events = append(events, e)
+	}
+	var oldIAPDs []IAPD
+	if old != nil {
+		oldIAPDs = old.IAPDs
+	}
+	iaids := make(map[uint32]bool)
+	for _, iapds := range [][]IAPD{oldIAPDs, new.IAPDs} {
+		for _, iapd := range iapds {
+			if iaids[iapd.IAID] {
+				continue
+			}
+			iaids[iapd.IAID] = true
+
+			e := event(EventPrefixObtained)
+			e.IAID = iapd.IAID
+			if old != nil {
+				e.Old = old.IAPD(iapd.IAID)
+			}
+			e.New = new.IAPD(iapd.IAID)
+			switch had, has := e.Old.delegated(), e.New.delegated(); {
+			case !had && !has:
+				continue
+			case !had:
+			case !has:
+				e.Type = EventPrefixLost
+			case !samePrefixes(e.Old, e.New):
+				e.Type = EventPrefixChanged
+			case !slices.Equal(e.Old.Prefixes, e.New.Prefixes):
+				e.Type = EventLifetimesChanged
+			default:
+				continue
+			}
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Monitor runs a Probe on an interval and reports the changes.
+type Monitor struct {
+	probe  Probe
+	events chan Event
+
+	// Interval is the delay between two successful probes.
+	Interval time.Duration
+	// Jitter randomizes the delays by plus or minus this fraction, so
+	// monitors started together don't stay in sync. Default is 0.1.
+	Jitter float64
+	// MaxBackoff caps the delay doubled on each failure. Default is 1 hour,
+	// or Interval if longer.
+	MaxBackoff time.Duration
+	// MinInterval is the shortest delay between two probes, whatever the
+	// other settings. Default is 1 minute.
+	MinInterval time.Duration
+
+	// State is updated after each probe and saved to StateFile if set.
+	State     *State
+	StateFile string
+}
+
+// New returns a monitor calling probe every interval. state holds what was
+// remembered from a previous run, nil to start afresh.
+func New(probe Probe, interval time.Duration, state *State) *Monitor {
+	if state == nil {
+		state = &State{}
+	}
+	return &Monitor{
+		probe:       probe,
+		events:      make(chan Event, 16),
+		Interval:    interval,
+		Jitter:      0.1,
+		MaxBackoff:  time.Hour,
+		MinInterval: time.Minute,
+		State:       state,
+	}
+}
+
+// Events returns the channel the events are sent to. It must be read, Run
+// blocks when it's full. It's closed when Run returns.
+func (m *Monitor) Events() <-chan Event {
+	return m.events
+}
+
+// delay returns the time to wait after the last probe.
+func (m *Monitor) delay() time.Duration {
+	d := m.Interval
+	if m.State.Failures > 0 {
+		limit := max(m.MaxBackoff, m.Interval)
+		for i := 0; i < m.State.Failures && d < limit; i++ {
+			d *= 2
+		}
+		d = min(d, limit)
+	}
+	if m.Jitter > 0 {
+		d += time.Duration(float64(d) * m.Jitter * (2*rand.Float64() - 1))
+	}
+	return max(d, m.MinInterval)
+}
+
+// Run probes until ctx is done or the state can't be saved. The first probe
+// is immediate, unless the State tells the last one is too recent.
+func (m *Monitor) Run(ctx context.Context) error {
+	defer close(m.events)
+
+	for {
+		if !m.State.LastProbe.IsZero() && !sleepUntil(ctx, m.State.LastProbe.Add(m.delay())) {
+			return ctx.Err()
+		}
+		result, err := m.probe(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		now := time.Now()
+		m.State.LastProbe = now
+		var events []Event
+		if err != nil {
+			m.State.Failures++
+			events = append(events, Event{Type: EventProbeFailed, Time: now, Err: err})
+		} else {
+			m.State.Failures = 0
+			events = append(events, Event{Type: EventProbed, Time: result.Time, Result: result})
+			events = append(events, Compare(m.State.Last, result)...)
+			m.State.Last = result
+		}
+		if m.StateFile != "" {
+			if err := m.State.Save(m.StateFile); err != nil {
+				return err
+			}
+		}
+		for _, e := range events {
+			if !m.emit(ctx, e) {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// emit sends e on the events channel, returns false if ctx is done first.
+func (m *Monitor) emit(ctx context.Context, e Event) bool {
+	select {
+	case m.events <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleepUntil waits until t, returns false if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
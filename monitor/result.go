@@ -0,0 +1,134 @@
+package monitor
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/store"
+)
+
+// IAPD is the content of an IA_PD option of the server answer.
+type IAPD struct {
+	IAID uint32        `json:"iaid"`
+	T1   time.Duration `json:"t1"`
+	T2   time.Duration `json:"t2"`
+	// Status is the IA_PD Status Code, StatusSuccess if absent.
+	Status   iana.StatusCode `json:"status"`
+	Prefixes []store.Prefix  `json:"prefixes"`
+}
+
+// Result is what a probe got from the server.
+type Result struct {
+	Time time.Time `json:"time"`
+	// ServerDUID is the Server ID in hex digits.
+	ServerDUID    string        `json:"server_duid"`
+	ServerAddr    string        `json:"server_address,omitempty"`
+	RTT           time.Duration `json:"rtt"`
+	Transmissions int           `json:"transmissions"`
+	// Status is the top level Status Code, StatusSuccess if absent.
+	Status iana.StatusCode `json:"status"`
+	IAPDs  []IAPD          `json:"iapds"`
+}
+
+// NewResult describes the IA_PDs of msg (an Advertise or a Reply) received
+// from peer.
+func NewResult(msg *dhcpv6.Message, peer *net.UDPAddr, rtt time.Duration, transmissions int) *Result {
+	r := &Result{
+		Time:          time.Now(),
+		RTT:           rtt,
+		Transmissions: transmissions,
+		IAPDs:         []IAPD{},
+	}
+	if sid := msg.Options.ServerID(); sid != nil {
+		r.ServerDUID = hex.EncodeToString(sid.ToBytes())
+	}
+	if status := msg.Options.Status(); status != nil {
+		r.Status = status.StatusCode
+	}
+	if peer != nil {
+		r.ServerAddr = peer.IP.String()
+	}
+	for _, opt := range msg.Options.IAPD() {
+		iapd := IAPD{
+			IAID:     binary.BigEndian.Uint32(opt.IaId[:]),
+			T1:       opt.T1,
+			T2:       opt.T2,
+			Prefixes: []store.Prefix{},
+		}
+		if status := opt.Options.Status(); status != nil {
+			iapd.Status = status.StatusCode
+		}
+		for _, p := range opt.Options.Prefixes() {
+			if prefix, ok := store.NewPrefix(p); ok {
+				iapd.Prefixes = append(iapd.Prefixes, prefix)
+			}
+		}
+		slices.SortFunc(iapd.Prefixes, func(a, b store.Prefix) int {
+			return a.Prefix.Addr().Compare(b.Prefix.Addr())
+		})
+		r.IAPDs = append(r.IAPDs, iapd)
+	}
+	return r
+}
+
+// IAPD returns the IA_PD iaid of the result, nil if absent.
+func (r *Result) IAPD(iaid uint32) *IAPD {
+	for i := range r.IAPDs {
+		if r.IAPDs[i].IAID == iaid {
+			return &r.IAPDs[i]
+		}
+	}
+	return nil
+}
+
+// delegated tells if the IA_PD holds prefixes.
+func (i *IAPD) delegated() bool {
+	return i != nil && i.Status == iana.StatusSuccess && len(i.Prefixes) > 0
+}
+
+// samePrefixes tells if a and b delegate the same prefixes, lifetimes aside.
+func samePrefixes(a, b *IAPD) bool {
+	return slices.EqualFunc(a.Prefixes, b.Prefixes, func(x, y store.Prefix) bool {
+		return x.Prefix == y.Prefix
+	})
+}
+
+// ErrNoAdvertise is returned by the SolicitProbe when no server answered.
+var ErrNoAdvertise = errors.New("no advertise received")
+
+// Probe asks the servers for prefixes, it's called by the Monitor on each
+// interval.
+type Probe func(ctx context.Context) (*Result, error)
+
+// SolicitProbe returns a probe sending a Solicit with duid as client ID and
+// the modifiers (typically the WithIAPD hints). The result is the best
+// Advertise received, even if it offers nothing so the loss of the prefixes
+// is noticed. Nothing is requested: the probe doesn't take a binding.
+func SolicitProbe(c *dhcp6c.Client, duid dhcpv6.DUID, modifiers ...dhcpv6.Modifier) Probe {
+	return func(ctx context.Context) (*Result, error) {
+		solicit, err := dhcp6c.NewSolicit(duid, modifiers...)
+		if err != nil {
+			return nil, err
+		}
+		ads, err := c.CollectAdvertises(ctx, solicit)
+		if err != nil {
+			return nil, err
+		}
+		if len(ads) == 0 {
+			return nil, ErrNoAdvertise
+		}
+		best := dhcp6c.SelectByPreference(ads)
+		if best == nil {
+			best = slices.MinFunc(ads, dhcp6c.ComparePreference)
+		}
+		return NewResult(best.Message, best.Peer, best.RTT, best.Transmissions), nil
+	}
+}
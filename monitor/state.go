@@ -0,0 +1,51 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nspeed-app/testdhcpv6pd/internal/atomicfile"
+)
+
+// State is what the Monitor remembers between runs: the last probes to
+// compare the next ones with and to space them out. The client identity is
+// not part of it, the probes are built with the one of the store package.
+type State struct {
+	LastProbe time.Time `json:"last_probe"`
+	// Failures is the number of probes that failed in a row.
+	Failures int `json:"failures"`
+	// Last is the result of the last successful probe.
+	Last *Result `json:"last,omitempty"`
+}
+
+// LoadState reads the state saved in file, a missing file is an empty state.
+func LoadState(file string) (*State, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("bad state file %s: %v", file, err)
+	}
+	return &s, nil
+}
+
+// Save writes the state to file, creating its directory if needed.
+func (s *State) Save(file string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(file, append(b, '\n'))
+}
@@ -0,0 +1,194 @@
+package dhcp6c
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// PcapWriter writes the packets of a Client to a pcapng capture, as raw IPv6
+// packets with synthetic IPv6 and UDP headers around the DHCPv6 payload. See
+// WithPcap.
+type PcapWriter struct {
+	mu  sync.Mutex
+	w   *pcapgo.NgWriter
+	err error
+}
+
+// NewPcapWriter writes the header of a pcapng capture to w, iface is the name
+// recorded for the interface (may be empty).
+func NewPcapWriter(w io.Writer, iface string) (*PcapWriter, error) {
+	ng, err := pcapgo.NewNgWriterInterface(w, pcapgo.NgInterface{
+		Name:                iface,
+		LinkType:            layers.LinkTypeRaw,
+		TimestampResolution: 9, // nanoseconds
+	}, pcapgo.NgWriterOptions{
+		SectionInfo: pcapgo.NgSectionInfo{Application: "testdhcpv6pd"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ng.Flush(); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: ng}, nil
+}
+
+// WritePacket writes the UDP payload sent from src to dst at t. The capture
+// is flushed after each packet so it is complete even if the program is
+// killed. Once a write failed, the same error is returned for all the
+// following packets.
+func (p *PcapWriter) WritePacket(t time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	ip := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolUDP,
+		HopLimit:   1,
+		SrcIP:      src.IP.To16(),
+		DstIP:      dst.IP.To16(),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port), DstPort: layers.UDPPort(dst.Port)}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(payload)); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	ci := gopacket.CaptureInfo{Timestamp: t, CaptureLength: len(data), Length: len(data)}
+	if p.err = p.w.WritePacket(ci, data); p.err == nil {
+		p.err = p.w.Flush()
+	}
+	return p.err
+}
+
+// WithPcap records every packet sent and received by the client to p,
+// including the invalid ones that are dropped.
+func WithPcap(p *PcapWriter) ClientOpt {
+	return func(c *Client) {
+		c.pcap = p
+	}
+}
+
+// pcapAddr is the address of the client in the capture when the transport
+// doesn't tell its local address.
+var pcapAddr = &net.UDPAddr{IP: net.IPv6unspecified, Port: dhcpv6.DefaultClientPort}
+
+// record writes a packet to the capture if any, sent tells if it is sent to
+// peer or received from it. Only the first error is logged.
+func (c *Client) record(sent bool, peer net.Addr, b []byte) {
+	if c.pcap == nil {
+		return
+	}
+	local := pcapAddr
+	if l, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		if a, ok := l.LocalAddr().(*net.UDPAddr); ok {
+			local = a
+		}
+	}
+	remote, ok := peer.(*net.UDPAddr)
+	if !ok {
+		remote = &net.UDPAddr{IP: net.IPv6unspecified, Port: dhcpv6.DefaultServerPort}
+	}
+	src, dst := remote, local
+	if sent {
+		src, dst = local, remote
+	}
+	if err := c.pcap.WritePacket(time.Now(), src, dst, b); err != nil && atomic.CompareAndSwapUint32(&c.pcapFailed, 0, 1) {
+		c.logger.Printf("error writing to the capture: %v", err)
+	}
+}
+
+// IsPcap tells if b starts like a pcap or pcapng capture.
+func IsPcap(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(b) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1, 0x0a0d0d0a:
+		return true
+	}
+	return false
+}
+
+// CapturedPacket is a UDP packet on the DHCPv6 ports read from a capture.
+type CapturedPacket struct {
+	Time time.Time
+	Src  *net.UDPAddr
+	Dst  *net.UDPAddr
+	// Data is the UDP payload, not checked to be a DHCPv6 message.
+	Data []byte
+}
+
+// ReadPcap returns the IPv6 UDP packets from or to port 546 or 547 of a pcap
+// or pcapng capture (Ethernet, Linux cooked, raw IP... as decoded by
+// gopacket), in the order of the capture. On a read error, e.g. a truncated
+// capture, the packets read until then are returned with it.
+func ReadPcap(r io.Reader) ([]*CapturedPacket, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	var source interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	}
+	var linkType layers.LinkType
+	if binary.LittleEndian.Uint32(magic) == 0x0a0d0d0a {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		source, linkType = ng, ng.LinkType()
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		source, linkType = pr, pr.LinkType()
+	}
+
+	var packets []*CapturedPacket
+	for {
+		data, ci, err := source.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return packets, nil
+		}
+		if err != nil {
+			return packets, err
+		}
+		pkt := gopacket.NewPacket(data, linkType, gopacket.NoCopy)
+		ip6, _ := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		udp, _ := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if ip6 == nil || udp == nil || !isDHCPv6Port(udp.SrcPort) && !isDHCPv6Port(udp.DstPort) {
+			continue
+		}
+		packets = append(packets, &CapturedPacket{
+			Time: ci.Timestamp,
+			Src:  &net.UDPAddr{IP: ip6.SrcIP, Port: int(udp.SrcPort)},
+			Dst:  &net.UDPAddr{IP: ip6.DstIP, Port: int(udp.DstPort)},
+			Data: udp.Payload,
+		})
+	}
+}
+
+func isDHCPv6Port(p layers.UDPPort) bool {
+	return p == dhcpv6.DefaultClientPort || p == dhcpv6.DefaultServerPort
+}
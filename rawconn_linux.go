@@ -0,0 +1,351 @@
+package dhcp6c
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+)
+
+// rawConn is a net.PacketConn sending and receiving the UDP payloads through
+// an AF_PACKET socket: the IPv6 and UDP headers are built and parsed here, the
+// kernel only adds the link-layer header.
+type rawConn struct {
+	ifi  *net.Interface
+	ip   net.IP
+	port int
+
+	f  *os.File
+	rc syscall.RawConn
+
+	mu sync.Mutex
+	// neighbors holds the link-layer addresses learned from the received
+	// packets, last is the one of the last packet.
+	neighbors map[string]net.HardwareAddr
+	last      net.HardwareAddr
+}
+
+// NewRawConn returns a connection sending from the link-local address of
+// iface and port, built on an AF_PACKET socket. Unlike NewIPv6UDPConn, it
+// doesn't bind the UDP port: it can run alongside the DHCPv6 client of the
+// system (dhcpcd, odhcp6c, systemd-networkd...). A BPF filter only lets the
+// DHCPv6 messages sent from port 547 to the link-local address and port
+// through. It requires the CAP_NET_RAW capability.
+//
+// Without a socket bound to port, the kernel answers the messages received
+// with ICMPv6 port unreachable errors, servers ignore them.
+//
+// Unicast destinations are sent to the link-layer address they were last
+// received from, or to the one of the last packet received if unknown (the
+// server or relay is usually the router).
+func NewRawConn(iface string, port int) (net.PacketConn, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := dhcpv6.GetLinkLocalAddr(iface)
+	if err != nil {
+		return nil, err
+	}
+	return newRawConn(ifi, ip, port)
+}
+
+func newRawConn(ifi *net.Interface, ip net.IP, port int) (*rawConn, error) {
+	filter, err := dhcpv6Filter(ip, port)
+	if err != nil {
+		return nil, err
+	}
+
+	// protocol 0 receives nothing until bind, so no packet gets in before
+	// the filter is attached
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, filter); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	// the auxiliary data tells if the UDP checksum is computed yet
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_IPV6), Ifindex: ifi.Index}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	c := &rawConn{
+		ifi:       ifi,
+		ip:        ip,
+		port:      port,
+		f:         os.NewFile(uintptr(fd), "packet:"+ifi.Name),
+		neighbors: make(map[string]net.HardwareAddr),
+	}
+	if c.rc, err = c.f.SyscallConn(); err != nil {
+		c.f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dhcpv6Filter returns the BPF program accepting the UDP packets (without
+// extension headers) from port 547 to ip and port. Packet sockets of type
+// SOCK_DGRAM run it from the IPv6 header.
+func dhcpv6Filter(ip net.IP, port int) (*unix.SockFprog, error) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return nil, fmt.Errorf("invalid IPv6 address %s", ip)
+	}
+	type check struct {
+		off, size int
+		val       uint32
+	}
+	checks := []check{
+		{6, 1, unix.IPPROTO_UDP},
+		{ipv6HeaderLen, 2, dhcpv6.DefaultServerPort},
+		{ipv6HeaderLen + 2, 2, uint32(port)},
+	}
+	for i := 0; i < net.IPv6len; i += 4 {
+		checks = append(checks, check{24 + i, 4, binary.BigEndian.Uint32(ip16[i:])})
+	}
+
+	var prog []bpf.Instruction
+	for i, ck := range checks {
+		prog = append(prog,
+			bpf.LoadAbsolute{Off: uint32(ck.off), Size: ck.size},
+			// on mismatch, skip the following checks and the accept
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: ck.val, SkipTrue: uint8(2*(len(checks)-i-1) + 1)},
+		)
+	}
+	prog = append(prog, bpf.RetConstant{Val: 0xffff}, bpf.RetConstant{Val: 0})
+
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return nil, err
+	}
+	filter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}, nil
+}
+
+// htons converts a short from host to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// udp6Checksum returns the UDP checksum of udp sent from src to dst, 0 when
+// checking a received packet means it's valid.
+func udp6Checksum(src, dst net.IP, udp []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.To16())
+	add(dst.To16())
+	sum += uint32(len(udp)) + unix.IPPROTO_UDP
+	add(udp)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// parse returns the source and payload of the UDP packet p, false if p isn't
+// a valid one. The checksum isn't verified if checksum is false.
+func (c *rawConn) parse(p []byte, checksum bool) (*net.UDPAddr, []byte, bool) {
+	if len(p) < ipv6HeaderLen+udpHeaderLen || p[0]>>4 != 6 || p[6] != unix.IPPROTO_UDP {
+		return nil, nil, false
+	}
+	udp := p[ipv6HeaderLen:]
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if length < udpHeaderLen || length > len(udp) {
+		return nil, nil, false
+	}
+	udp = udp[:length]
+	src := net.IP(bytes.Clone(p[8:24]))
+	if checksum && udp6Checksum(src, p[24:40], udp) != 0 {
+		return nil, nil, false
+	}
+	from := &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(udp)), Zone: c.ifi.Name}
+	return from, udp[udpHeaderLen:], true
+}
+
+// checksumReady tells from the PACKET_AUXDATA control message if the UDP
+// checksum was computed: it isn't for the packets sent locally with checksum
+// offloading (veth, bridges...).
+func checksumReady(oob []byte) bool {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return true
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_PACKET && m.Header.Type == unix.PACKET_AUXDATA && len(m.Data) >= 4 {
+			return binary.NativeEndian.Uint32(m.Data)&unix.TP_STATUS_CSUMNOTREADY == 0
+		}
+	}
+	return true
+}
+
+// ReadFrom reads the payload of the next DHCPv6 packet.
+func (c *rawConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, ipv6HeaderLen+udpHeaderLen+len(b))
+	oob := make([]byte, 64)
+	for {
+		var (
+			n, oobn int
+			from    unix.Sockaddr
+			err     error
+		)
+		rerr := c.rc.Read(func(fd uintptr) bool {
+			n, oobn, _, from, err = unix.Recvmsg(int(fd), buf, oob, 0)
+			return err != unix.EAGAIN
+		})
+		if rerr == nil {
+			rerr = err
+		}
+		if rerr != nil {
+			return 0, nil, c.opError("read", nil, rerr)
+		}
+
+		ll, _ := from.(*unix.SockaddrLinklayer)
+		if ll != nil && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		peer, payload, ok := c.parse(buf[:n], checksumReady(oob[:oobn]))
+		if !ok {
+			continue
+		}
+		if ll != nil && ll.Halen > 0 {
+			hw := net.HardwareAddr(bytes.Clone(ll.Addr[:ll.Halen]))
+			c.mu.Lock()
+			c.neighbors[peer.IP.String()] = hw
+			c.last = hw
+			c.mu.Unlock()
+		}
+		return copy(b, payload), peer, nil
+	}
+}
+
+// hardwareAddr returns the link-layer destination of ip.
+func (c *rawConn) hardwareAddr(ip net.IP) (net.HardwareAddr, error) {
+	if ip.IsMulticast() {
+		// RFC 2464 section 7
+		return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hw, ok := c.neighbors[ip.String()]; ok {
+		return hw, nil
+	}
+	if c.last != nil {
+		return c.last, nil
+	}
+	return nil, fmt.Errorf("no link-layer address known for %s", ip)
+}
+
+// WriteTo sends b in a UDP packet to addr, which must be a *net.UDPAddr.
+func (c *rawConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok || to.IP.To16() == nil || to.IP.To4() != nil {
+		return 0, c.opError("write", addr, errors.New("not an IPv6 UDP address"))
+	}
+	dst := to.IP.To16()
+	hw, err := c.hardwareAddr(dst)
+	if err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+
+	p := make([]byte, ipv6HeaderLen+udpHeaderLen+len(b))
+	p[0] = 6 << 4
+	binary.BigEndian.PutUint16(p[4:], uint16(udpHeaderLen+len(b)))
+	p[6] = unix.IPPROTO_UDP
+	p[7] = 64
+	if dst.IsLinkLocalMulticast() {
+		p[7] = 1
+	}
+	copy(p[8:24], c.ip.To16())
+	copy(p[24:40], dst)
+	udp := p[ipv6HeaderLen:]
+	binary.BigEndian.PutUint16(udp, uint16(c.port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(to.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], b)
+	cs := udp6Checksum(c.ip, dst, udp)
+	if cs == 0 {
+		cs = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], cs)
+
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_IPV6),
+		Ifindex:  c.ifi.Index,
+		Halen:    uint8(len(hw)),
+	}
+	copy(sa.Addr[:], hw)
+	werr := c.rc.Write(func(fd uintptr) bool {
+		err = unix.Sendto(int(fd), p, 0, sa)
+		return err != unix.EAGAIN
+	})
+	if werr == nil {
+		werr = err
+	}
+	if werr != nil {
+		return 0, c.opError("write", addr, werr)
+	}
+	return len(b), nil
+}
+
+// opError wraps err like the net package does, so a closed connection is
+// reported as net.ErrClosed.
+func (c *rawConn) opError(op string, addr net.Addr, err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		err = net.ErrClosed
+	}
+	return &net.OpError{Op: op, Net: "packet", Source: c.LocalAddr(), Addr: addr, Err: err}
+}
+
+// Close closes the socket.
+func (c *rawConn) Close() error {
+	return c.f.Close()
+}
+
+// LocalAddr returns the address the packets are sent from.
+func (c *rawConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: c.ip, Port: c.port, Zone: c.ifi.Name}
+}
+
+func (c *rawConn) SetDeadline(t time.Time) error {
+	return c.f.SetDeadline(t)
+}
+
+func (c *rawConn) SetReadDeadline(t time.Time) error {
+	return c.f.SetReadDeadline(t)
+}
+
+func (c *rawConn) SetWriteDeadline(t time.Time) error {
+	return c.f.SetWriteDeadline(t)
+}
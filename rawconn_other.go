@@ -0,0 +1,13 @@
+//go:build !linux
+
+package dhcp6c
+
+import (
+	"errors"
+	"net"
+)
+
+// NewRawConn is only available on Linux.
+func NewRawConn(iface string, port int) (net.PacketConn, error) {
+	return nil, errors.New("raw sockets are only supported on Linux")
+}
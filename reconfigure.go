@@ -0,0 +1,116 @@
+package dhcp6c
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// WithReconfigureAccept adds the Reconfigure Accept option to a message: the
+// client is willing to accept Reconfigure messages.
+func WithReconfigureAccept(d dhcpv6.DHCPv6) {
+	d.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionReconfAccept})
+}
+
+// Reconfigure is a Reconfigure message received from a server.
+type Reconfigure struct {
+	Message *dhcpv6.Message
+	// Raw holds the received bytes, the HMAC-MD5 digest is computed over them.
+	Raw  []byte
+	Peer *net.UDPAddr
+}
+
+// Reconfigures returns the channel the Reconfigure messages received are sent
+// to. They are dropped when nobody reads it.
+func (c *Client) Reconfigures() <-chan *Reconfigure {
+	return c.reconfigure
+}
+
+// dispatchReconfigure hands a Reconfigure over to the Reconfigures channel
+// without blocking the receive loop.
+func (c *Client) dispatchReconfigure(msg *dhcpv6.Message, raw []byte, peer net.Addr) {
+	r := &Reconfigure{Message: msg, Raw: raw}
+	r.Peer, _ = peer.(*net.UDPAddr)
+	select {
+	case c.reconfigure <- r:
+		c.logger.PrintMessage("received message", msg)
+	default:
+		if c.printDropped {
+			c.logger.Printf("No client waiting for Reconfigure: %s", msg)
+		}
+	}
+}
+
+// reconfigureKey returns the Reconfigure Key sent by the server in a Reply
+// (nil if none) and the replay detection value of the Reply.
+func reconfigureKey(reply *dhcpv6.Message) ([]byte, uint64) {
+	for _, auth := range authOptions(reply) {
+		if auth != nil && auth.Protocol == AuthProtocolReconfigureKey && len(auth.AuthInfo) == 1+md5.Size &&
+			auth.AuthInfo[0] == reconfigureKeyValue {
+			return auth.AuthInfo[1:], auth.ReplayDetection
+		}
+	}
+	return nil, 0
+}
+
+// ValidateReconfigure checks a Reconfigure message against lease, as
+// described in RFC 8415 section 18.2.11 and 20.4: Server and Client IDs,
+// requested message type and HMAC-MD5 digest computed with the Reconfigure
+// Key of the lease. lastReplay is the replay detection value of the last
+// Reconfigure accepted, or of the Reply that delivered the key (see
+// Lease.ReconfigureReplay).
+//
+// It returns the message type the client must send (Renew, Rebind or
+// Information-Request) and the replay detection value of the Reconfigure.
+func ValidateReconfigure(r *Reconfigure, lease *Lease, lastReplay uint64) (dhcpv6.MessageType, uint64, error) {
+	msg := r.Message
+	if msg.MessageType != dhcpv6.MessageTypeReconfigure {
+		return 0, 0, fmt.Errorf("not a Reconfigure: %s", msg.MessageType)
+	}
+	if lease == nil || lease.ReconfigureKey == nil {
+		return 0, 0, errors.New("no Reconfigure Key for this lease")
+	}
+	if sid := msg.Options.ServerID(); sid == nil || lease.ServerID == nil || !bytes.Equal(sid.ToBytes(), lease.ServerID.ToBytes()) {
+		return 0, 0, errors.New("Server ID mismatch")
+	}
+	if cid := msg.Options.ClientID(); cid == nil || lease.ClientID == nil || !bytes.Equal(cid.ToBytes(), lease.ClientID.ToBytes()) {
+		return 0, 0, errors.New("Client ID mismatch")
+	}
+
+	var mt dhcpv6.MessageType
+	if opt := msg.GetOneOption(dhcpv6.OptionReconfMessage); opt != nil && len(opt.ToBytes()) == 1 {
+		mt = dhcpv6.MessageType(opt.ToBytes()[0])
+	}
+	switch mt {
+	case dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeInformationRequest:
+	default:
+		return 0, 0, fmt.Errorf("invalid Reconfigure Message option: %s", mt)
+	}
+
+	auths := authOptions(msg)
+	n := slices.IndexFunc(auths, func(auth *OptAuth) bool {
+		return auth != nil && auth.Protocol == AuthProtocolReconfigureKey
+	})
+	if n < 0 {
+		return 0, 0, errors.New("no Reconfigure Key authentication")
+	}
+	auth := auths[n]
+	if auth.Algorithm != AuthAlgorithmHMACMD5 || auth.RDM != RDMMonotonicCounter {
+		return 0, 0, errors.New("no Reconfigure Key authentication")
+	}
+	if len(auth.AuthInfo) != 1+md5.Size || auth.AuthInfo[0] != reconfigureKeyDigest {
+		return 0, 0, errors.New("invalid Reconfigure Key authentication information")
+	}
+	if auth.ReplayDetection <= lastReplay {
+		return 0, 0, fmt.Errorf("replayed Reconfigure (%d <= %d)", auth.ReplayDetection, lastReplay)
+	}
+	if !validHMACMD5(r.Raw, n, lease.ReconfigureKey) {
+		return 0, 0, errors.New("invalid HMAC-MD5 digest")
+	}
+	return mt, auth.ReplayDetection, nil
+}
@@ -0,0 +1,124 @@
+package dhcp6c
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+var (
+	testReconfigureKey = []byte("0123456789abcdef")
+	reconfClientID     = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: testMAC}
+	reconfServerID     = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+)
+
+// signedReconfigure returns a Reconfigure asking for mt with the replay
+// detection value replay, signed with key as a server would: the HMAC-MD5
+// digest of the message with the digest zeroed.
+func signedReconfigure(t *testing.T, mt dhcpv6.MessageType, replay uint64, key []byte) *Reconfigure {
+	t.Helper()
+	msg, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.MessageType = dhcpv6.MessageTypeReconfigure
+	// a Reconfigure has no transaction
+	msg.TransactionID = dhcpv6.TransactionID{}
+	msg.AddOption(dhcpv6.OptServerID(reconfServerID))
+	msg.AddOption(dhcpv6.OptClientID(reconfClientID))
+	msg.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionReconfMessage, OptionData: []byte{byte(mt)}})
+	auth := &OptAuth{
+		Protocol:        AuthProtocolReconfigureKey,
+		Algorithm:       AuthAlgorithmHMACMD5,
+		RDM:             RDMMonotonicCounter,
+		ReplayDetection: replay,
+		AuthInfo:        append([]byte{reconfigureKeyDigest}, make([]byte, md5.Size)...),
+	}
+	msg.AddOption(auth)
+	mac := hmac.New(md5.New, key)
+	mac.Write(msg.ToBytes())
+	copy(auth.AuthInfo[1:], mac.Sum(nil))
+	return &Reconfigure{Message: msg, Raw: msg.ToBytes()}
+}
+
+func reconfigureLease() *Lease {
+	return &Lease{ClientID: reconfClientID, ServerID: reconfServerID, ReconfigureKey: testReconfigureKey, ReconfigureReplay: 10}
+}
+
+func TestValidateReconfigure(t *testing.T) {
+	r := signedReconfigure(t, dhcpv6.MessageTypeRenew, 11, testReconfigureKey)
+	mt, replay, err := ValidateReconfigure(r, reconfigureLease(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != dhcpv6.MessageTypeRenew || replay != 11 {
+		t.Errorf("got %s and replay %d, want RENEW and 11", mt, replay)
+	}
+
+	r = signedReconfigure(t, dhcpv6.MessageTypeInformationRequest, 12, testReconfigureKey)
+	if mt, _, err := ValidateReconfigure(r, reconfigureLease(), 11); err != nil || mt != dhcpv6.MessageTypeInformationRequest {
+		t.Errorf("got %s, %v, want INFORMATION-REQUEST", mt, err)
+	}
+}
+
+func TestValidateReconfigureInvalid(t *testing.T) {
+	otherID := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}
+	for _, tt := range []struct {
+		name  string
+		r     *Reconfigure
+		lease *Lease
+		want  string
+	}{
+		{"replayed", signedReconfigure(t, dhcpv6.MessageTypeRenew, 10, testReconfigureKey), reconfigureLease(), "replayed"},
+		{"older", signedReconfigure(t, dhcpv6.MessageTypeRenew, 9, testReconfigureKey), reconfigureLease(), "replayed"},
+		{"wrong key", signedReconfigure(t, dhcpv6.MessageTypeRenew, 11, []byte("fedcba9876543210")), reconfigureLease(), "digest"},
+		{"tampered", func() *Reconfigure {
+			r := signedReconfigure(t, dhcpv6.MessageTypeRenew, 11, testReconfigureKey)
+			// Renew turned into Rebind after signing
+			i := bytes.Index(r.Raw, []byte{0, byte(dhcpv6.OptionReconfMessage), 0, 1, byte(dhcpv6.MessageTypeRenew)})
+			r.Raw[i+4] = byte(dhcpv6.MessageTypeRebind)
+			r.Message, _ = dhcpv6.MessageFromBytes(r.Raw)
+			return r
+		}(), reconfigureLease(), "digest"},
+		{"Solicit", signedReconfigure(t, dhcpv6.MessageTypeSolicit, 11, testReconfigureKey), reconfigureLease(), "Reconfigure Message"},
+		{"Request", signedReconfigure(t, dhcpv6.MessageTypeRequest, 11, testReconfigureKey), reconfigureLease(), "Reconfigure Message"},
+		{"no key", signedReconfigure(t, dhcpv6.MessageTypeRenew, 11, testReconfigureKey), &Lease{ClientID: reconfClientID, ServerID: reconfServerID}, "no Reconfigure Key"},
+		{"other server", signedReconfigure(t, dhcpv6.MessageTypeRenew, 11, testReconfigureKey), &Lease{ClientID: reconfClientID, ServerID: otherID, ReconfigureKey: testReconfigureKey}, "Server ID"},
+		{"other client", signedReconfigure(t, dhcpv6.MessageTypeRenew, 11, testReconfigureKey), &Lease{ClientID: otherID, ServerID: reconfServerID, ReconfigureKey: testReconfigureKey}, "Client ID"},
+	} {
+		if _, _, err := ValidateReconfigure(tt.r, tt.lease, 10); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHMACMD5(t *testing.T) {
+	// the digest is computed with the digest bytes zeroed, whatever they
+	// hold
+	r := signedReconfigure(t, dhcpv6.MessageTypeRenew, 11, testReconfigureKey)
+	start, end := authInfoBounds(r.Raw, 0)
+	if start < 0 || end-start != 1+md5.Size || r.Raw[start] != reconfigureKeyDigest {
+		t.Fatalf("got authentication information bounds %d-%d", start, end)
+	}
+	digest, err := hmacMD5(r.Raw, 0, testReconfigureKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, r.Raw[end-md5.Size:end]) {
+		t.Errorf("got digest %x, want %x", digest, r.Raw[end-md5.Size:end])
+	}
+	if !validHMACMD5(r.Raw, 0, testReconfigureKey) || validHMACMD5(r.Raw, 0, []byte("fedcba9876543210")) {
+		t.Error("digest checked with the wrong key")
+	}
+
+	// a truncated option has no digest
+	if _, err := hmacMD5(r.Raw[:len(r.Raw)-1], 0, testReconfigureKey); err == nil {
+		t.Error("digest of a truncated message")
+	}
+}
@@ -0,0 +1,261 @@
+package dhcp6c
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// ReplayPacket is a recorded server message.
+type ReplayPacket struct {
+	Msg *dhcpv6.Message
+	// From is the address of the server.
+	From net.Addr
+	// Delay is the time from the client message it answers, see
+	// NewReplayConn.
+	Delay time.Duration
+}
+
+// ReplayConn is a Transport answering the messages of the client with
+// recorded server messages, without network: the Advertise (or Reply with
+// Rapid Commit) to a Solicit, the Reply to the others. Each new transaction
+// of the client gets the next recorded answers of the same recorded
+// transaction, rewritten with the transaction ID and the Client ID of the
+// client message, retransmissions get none. A message gets no answer when
+// the recording has none left.
+type ReplayConn struct {
+	in    chan *MemPacket
+	delay bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mu       sync.Mutex
+	packets  []*ReplayPacket
+	used     []bool
+	answered map[dhcpv6.TransactionID]bool
+}
+
+// NewReplayConn returns a ReplayConn answering with packets, after their
+// recorded delay if delay is set, else immediately.
+func NewReplayConn(packets []*ReplayPacket, delay bool) *ReplayConn {
+	return &ReplayConn{
+		in:       make(chan *MemPacket, memQueueLen),
+		delay:    delay,
+		done:     make(chan struct{}),
+		packets:  packets,
+		used:     make([]bool, len(packets)),
+		answered: make(map[dhcpv6.TransactionID]bool),
+	}
+}
+
+// ReadReplayFile reads the server messages to replay from a pcap or pcapng
+// capture (see ReadReplayPcap) or a text file (see ReadReplayHex). The
+// messages of a capture read until an error are returned with it.
+func ReadReplayFile(file string) ([]*ReplayPacket, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var packets []*ReplayPacket
+	if IsPcap(b) {
+		packets, err = ReadReplayPcap(bytes.NewReader(b))
+	} else {
+		packets, err = ReadReplayHex(bytes.NewReader(b))
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %v", file, err)
+	}
+	if len(packets) == 0 {
+		if err == nil {
+			err = fmt.Errorf("%s: no Advertise nor Reply message", file)
+		}
+		return nil, err
+	}
+	return packets, err
+}
+
+// isAnswer tells if t is a message replayed by a ReplayConn.
+func isAnswer(t dhcpv6.MessageType) bool {
+	return t == dhcpv6.MessageTypeAdvertise || t == dhcpv6.MessageTypeReply
+}
+
+// relayedMessage returns the message of b, the relayed one if b is a relay
+// message.
+func relayedMessage(b []byte) (*dhcpv6.Message, error) {
+	d, err := dhcpv6.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if relay, ok := d.(*dhcpv6.RelayMessage); ok {
+		return relay.GetInnerMessage()
+	}
+	return d.(*dhcpv6.Message), nil
+}
+
+// ReadReplayPcap returns the Advertise and Reply messages of a capture (see
+// ReadPcap), the relayed ones included. Their delay is from the last client
+// message of their transaction, or from the first answer if the capture
+// doesn't have it. On a read error, e.g. a truncated capture, the messages
+// read until then are returned with it.
+func ReadReplayPcap(r io.Reader) ([]*ReplayPacket, error) {
+	captured, readErr := ReadPcap(r)
+	var packets []*ReplayPacket
+	start := make(map[dhcpv6.TransactionID]time.Time)
+	for _, c := range captured {
+		msg, err := relayedMessage(c.Data)
+		if err != nil {
+			continue
+		}
+		if !isAnswer(msg.MessageType) {
+			start[msg.TransactionID] = c.Time
+			continue
+		}
+		t, ok := start[msg.TransactionID]
+		if !ok {
+			t = c.Time
+			start[msg.TransactionID] = t
+		}
+		packets = append(packets, &ReplayPacket{Msg: msg, From: c.Src, Delay: c.Time.Sub(t)})
+	}
+	return packets, readErr
+}
+
+// ReadReplayHex reads one message per line in hex digits (spaces, : or -
+// separators and a 0x prefix allowed), optionally preceded by its delay (a
+// Go duration like 150ms). Empty lines and # comments are skipped, and so are
+// the messages other than Advertise and Reply. The messages come from
+// MemServerAddr.
+func ReadReplayHex(r io.Reader) ([]*ReplayPacket, error) {
+	var packets []*ReplayPacket
+	clean := strings.NewReplacer(":", "", "-", "", " ", "", "\t", "")
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var delay time.Duration
+		if f := strings.Fields(line); len(f) > 1 {
+			if d, err := time.ParseDuration(f[0]); err == nil {
+				delay = d
+				line = strings.Join(f[1:], "")
+			}
+		}
+		b, err := hex.DecodeString(clean.Replace(strings.TrimPrefix(line, "0x")))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		msg, err := relayedMessage(b)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if isAnswer(msg.MessageType) {
+			packets = append(packets, &ReplayPacket{Msg: msg, From: MemServerAddr, Delay: delay})
+		}
+	}
+	return packets, s.Err()
+}
+
+func (c *ReplayConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "replay", Source: MemClientAddr, Addr: addr, Err: err}
+}
+
+// answers returns the recorded answers to msg and marks them used.
+func (c *ReplayConn) answers(msg *dhcpv6.Message) []*ReplayPacket {
+	accept := func(t dhcpv6.MessageType) bool {
+		return t == dhcpv6.MessageTypeReply || msg.MessageType == dhcpv6.MessageTypeSolicit && t == dhcpv6.MessageTypeAdvertise
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answered[msg.TransactionID] {
+		return nil
+	}
+	c.answered[msg.TransactionID] = true
+	var found []*ReplayPacket
+	for i, p := range c.packets {
+		if c.used[i] || !accept(p.Msg.MessageType) {
+			continue
+		}
+		if found != nil && p.Msg.TransactionID != found[0].Msg.TransactionID {
+			continue
+		}
+		c.used[i] = true
+		found = append(found, p)
+	}
+	return found
+}
+
+// push queues a packet for ReadFrom, it is dropped if the queue is full.
+func (c *ReplayConn) push(p *MemPacket) {
+	select {
+	case <-c.done:
+	case c.in <- p:
+	default:
+	}
+}
+
+// WriteTo implements net.PacketConn: the recorded answers to the message in
+// b are queued for ReadFrom.
+func (c *ReplayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.opError("write", addr, net.ErrClosed)
+	default:
+	}
+	msg, err := dhcpv6.MessageFromBytes(b)
+	if err != nil {
+		return len(b), nil
+	}
+	for _, p := range c.answers(msg) {
+		answer, err := dhcpv6.MessageFromBytes(p.Msg.ToBytes())
+		if err != nil {
+			continue
+		}
+		answer.TransactionID = msg.TransactionID
+		if cid := msg.Options.ClientID(); cid != nil {
+			answer.Options.Del(dhcpv6.OptionClientID)
+			answer.Options.Add(dhcpv6.OptClientID(cid))
+		}
+		mp := &MemPacket{Data: answer.ToBytes(), From: p.From, To: MemClientAddr}
+		if c.delay && p.Delay > 0 {
+			time.AfterFunc(p.Delay, func() { c.push(mp) })
+		} else {
+			c.push(mp)
+		}
+	}
+	return len(b), nil
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *ReplayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.done:
+		return 0, nil, c.opError("read", nil, net.ErrClosed)
+	case p := <-c.in:
+		return copy(b, p.Data), p.From, nil
+	}
+}
+
+// Close unblocks ReadFrom, the answers not read yet are discarded.
+func (c *ReplayConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+// LocalAddr returns MemClientAddr.
+func (c *ReplayConn) LocalAddr() net.Addr {
+	return MemClientAddr
+}
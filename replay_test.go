@@ -0,0 +1,45 @@
+package dhcp6c_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+func TestReadReplayPcapError(t *testing.T) {
+	// the messages read before the error are kept
+	var buf bytes.Buffer
+	w, err := dhcp6c.NewPcapWriter(&buf, "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("fe80::a"), Port: dhcpv6.DefaultClientPort}
+	server := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultServerPort}
+	start := time.Now()
+	for i, mt := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeAdvertise} {
+		msg := &dhcpv6.Message{MessageType: mt, TransactionID: dhcpv6.TransactionID{0, 0, 1}}
+		src, dst := client, server
+		if mt == dhcpv6.MessageTypeAdvertise {
+			src, dst = server, client
+		}
+		if err := w.WritePacket(start.Add(time.Duration(i)*100*time.Millisecond), src, dst, msg.ToBytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failure := errors.New("read failure")
+	packets, err := dhcp6c.ReadReplayPcap(io.MultiReader(&buf, iotest.ErrReader(failure)))
+	if !errors.Is(err, failure) {
+		t.Errorf("got error %v, want the read failure", err)
+	}
+	if len(packets) != 1 || packets[0].Msg.MessageType != dhcpv6.MessageTypeAdvertise || packets[0].Delay != 100*time.Millisecond {
+		t.Errorf("got %d packets, want the Advertise 100ms after the Solicit", len(packets))
+	}
+}
@@ -0,0 +1,126 @@
+package dhcp6c
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Retransmission holds the retransmission parameters of a message type as
+// defined by RFC 8415 section 15.
+type Retransmission struct {
+	// IRT is the initial retransmission time.
+	IRT time.Duration
+	// MRT is the maximum retransmission time, 0 means no maximum.
+	MRT time.Duration
+	// MRC is the maximum number of transmissions, 0 means unlimited.
+	MRC int
+	// MRD is the maximum retransmission duration, 0 means unlimited.
+	MRD time.Duration
+	// MaxDelay is the upper bound of the random delay before the first
+	// transmission (SOL_MAX_DELAY, INF_MAX_DELAY), 0 means no delay.
+	MaxDelay time.Duration
+}
+
+// DefaultRetransmissions are the RFC 8415 section 7.6 transmission and
+// retransmission parameters, used with WithRetransmissions.
+//
+// The Renew MRD (until T2) and Rebind MRD (until the lease expires) depend
+// on the lease: use a context deadline, as done by the LeaseManager. Solicit
+// and Information-Request have no MRC nor MRD either: they are retransmitted
+// until the context is done.
+var DefaultRetransmissions = map[dhcpv6.MessageType]Retransmission{
+	dhcpv6.MessageTypeSolicit:            {IRT: 1 * time.Second, MRT: 3600 * time.Second, MaxDelay: 1 * time.Second},
+	dhcpv6.MessageTypeRequest:            {IRT: 1 * time.Second, MRT: 30 * time.Second, MRC: 10},
+	dhcpv6.MessageTypeRenew:              {IRT: 10 * time.Second, MRT: 600 * time.Second},
+	dhcpv6.MessageTypeRebind:             {IRT: 10 * time.Second, MRT: 600 * time.Second},
+	dhcpv6.MessageTypeRelease:            {IRT: 1 * time.Second, MRC: 4},
+	dhcpv6.MessageTypeDecline:            {IRT: 1 * time.Second, MRC: 4},
+	dhcpv6.MessageTypeInformationRequest: {IRT: 1 * time.Second, MRT: 3600 * time.Second, MaxDelay: 1 * time.Second},
+}
+
+// WithRetransmissions uses the RFC 8415 retransmission parameters of
+// DefaultRetransmissions instead of the client timeout and retry (see
+// WithTimeout and WithRetry) for the message types they define.
+func WithRetransmissions() ClientOpt {
+	return func(c *Client) {
+		for mt, r := range DefaultRetransmissions {
+			c.retransmissions[mt] = r
+		}
+	}
+}
+
+// WithRetransmission configures the RFC 8415 retransmission parameters of a
+// message type, used instead of the client timeout and retry.
+func WithRetransmission(mt dhcpv6.MessageType, r Retransmission) ClientOpt {
+	return func(c *Client) {
+		c.retransmissions[mt] = r
+	}
+}
+
+// initialDelay waits the random delay before the first transmission of mt, if
+// it has retransmission parameters.
+func (c *Client) initialDelay(ctx context.Context, mt dhcpv6.MessageType) error {
+	if r, ok := c.retransmissions[mt]; ok {
+		return r.initialDelay(ctx)
+	}
+	return nil
+}
+
+// randFactor returns a random factor between -0.1 and 0.1, in (0, 0.1] if
+// positive is set.
+func randFactor(positive bool) float64 {
+	if positive {
+		return (1 - rand.Float64()) * 0.1
+	}
+	return rand.Float64()*0.2 - 0.1
+}
+
+// nextRT returns the retransmission timeout following prev (0 for the first
+// transmission).
+//
+// RFC 8415 section 15: the first RT of a Solicit must be greater than IRT,
+// hence positive.
+func (r Retransmission) nextRT(prev time.Duration, positive bool) time.Duration {
+	var rt time.Duration
+	if prev == 0 {
+		rt = r.IRT + time.Duration(randFactor(positive)*float64(r.IRT))
+		if positive && rt <= r.IRT {
+			// the random part rounded down to 0
+			rt = r.IRT + 1
+		}
+	} else {
+		rt = 2*prev + time.Duration(randFactor(false)*float64(prev))
+	}
+	if r.MRT > 0 && rt > r.MRT {
+		rt = r.MRT + time.Duration(randFactor(false)*float64(r.MRT))
+	}
+	return rt
+}
+
+// initialDelay waits a random time up to MaxDelay before the first
+// transmission.
+func (r Retransmission) initialDelay(ctx context.Context) error {
+	if r.MaxDelay <= 0 {
+		return nil
+	}
+	if !sleepUntil(ctx, time.Now().Add(rand.N(r.MaxDelay))) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// maxElapsedTime is the largest value of the Elapsed Time option (in
+// hundredths of a second).
+const maxElapsedTime = 0xffff * 10 * time.Millisecond
+
+// elapsedSince returns the Elapsed Time option value for an exchange started
+// at start.
+func elapsedSince(start time.Time) time.Duration {
+	if e := time.Since(start); e < maxElapsedTime {
+		return e
+	}
+	return maxElapsedTime
+}
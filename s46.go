@@ -0,0 +1,432 @@
+package dhcp6c
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+)
+
+// The IPv4 over IPv6 options: the DS-Lite AFTR name (RFC 6334) and the
+// softwire containers of MAP-E, MAP-T and Lightweight 4over6 (RFC 7598), in
+// the order of preference of the S46 Priority option (RFC 8026).
+//
+// The MAP-E container holds S46 Rule and S46 BR options, the MAP-T one S46
+// Rule and a S46 DMR option, the lw4o6 one S46 BR and S46 IPv4/IPv6 Address
+// Binding options. Rules and bindings may hold a S46 Port Parameters option.
+
+// OptAFTRName is the AFTR-Name option, RFC 6334: the name of the DS-Lite
+// tunnel endpoint.
+type OptAFTRName struct {
+	Name string
+}
+
+// Code returns the option code.
+func (op *OptAFTRName) Code() dhcpv6.OptionCode {
+	return dhcpv6.OptionAFTRName
+}
+
+// ToBytes serializes the option.
+func (op *OptAFTRName) ToBytes() []byte {
+	return (&rfc1035label.Labels{Labels: []string{op.Name}}).ToBytes()
+}
+
+// FromBytes parses the option data (without code and length).
+func (op *OptAFTRName) FromBytes(data []byte) error {
+	labels, err := rfc1035label.FromBytes(data)
+	if err != nil {
+		return err
+	}
+	if len(labels.Labels) != 1 {
+		return fmt.Errorf("AFTR-Name option must hold one name, got %d", len(labels.Labels))
+	}
+	op.Name = labels.Labels[0]
+	return nil
+}
+
+func (op *OptAFTRName) String() string {
+	return fmt.Sprintf("%s: %s", op.Code(), op.Name)
+}
+
+// S46PortParams is the S46 Port Parameters option: the set of ports of the
+// CE, the PSID (right aligned) of PSIDLen bits after the Offset first bits
+// of the port numbers.
+type S46PortParams struct {
+	Offset  uint8
+	PSIDLen uint8
+	PSID    uint16
+}
+
+// parseS46PortParams parses the S46 Port Parameters option data.
+func parseS46PortParams(data []byte) (*S46PortParams, error) {
+	if len(data) != 4 {
+		return nil, fmt.Errorf("S46 Port Parameters option must be 4 bytes long, got %d", len(data))
+	}
+	p := &S46PortParams{Offset: data[0], PSIDLen: data[1]}
+	if p.PSIDLen > 16 || int(p.Offset)+int(p.PSIDLen) > 16 {
+		return nil, fmt.Errorf("bad S46 port parameters offset %d and PSID length %d", p.Offset, p.PSIDLen)
+	}
+	// the PSID is left aligned in the 16 bits field
+	if p.PSIDLen > 0 {
+		p.PSID = binary.BigEndian.Uint16(data[2:]) >> (16 - p.PSIDLen)
+	}
+	return p, nil
+}
+
+func (p *S46PortParams) toBytes() []byte {
+	var psid uint16
+	if p.PSIDLen > 0 {
+		psid = p.PSID << (16 - p.PSIDLen)
+	}
+	return binary.BigEndian.AppendUint16([]byte{p.Offset, p.PSIDLen}, psid)
+}
+
+func (p *S46PortParams) String() string {
+	return fmt.Sprintf("offset=%d psid-len=%d psid=%#x", p.Offset, p.PSIDLen, p.PSID)
+}
+
+// S46Rule is a S46 Rule option, a mapping rule of MAP-E or MAP-T.
+type S46Rule struct {
+	// FMR tells if it is a Forwarding Mapping Rule, besides a Basic Mapping
+	// Rule.
+	FMR bool
+	// EALen is the length in bits of the embedded address.
+	EALen      uint8
+	IPv4Prefix *net.IPNet
+	IPv6Prefix *net.IPNet
+	PortParams *S46PortParams
+}
+
+func (r *S46Rule) String() string {
+	s := fmt.Sprintf("ipv4-prefix=%s ipv6-prefix=%s ea-len=%d", r.IPv4Prefix, r.IPv6Prefix, r.EALen)
+	if r.FMR {
+		s += " fmr"
+	}
+	if r.PortParams != nil {
+		s += " " + r.PortParams.String()
+	}
+	return s
+}
+
+// S46Binding is a S46 IPv4/IPv6 Address Binding option of lw4o6: the IPv4
+// address of the CE and the IPv6 prefix of its tunnel endpoint.
+type S46Binding struct {
+	IPv4       net.IP
+	IPv6Prefix *net.IPNet
+	PortParams *S46PortParams
+}
+
+func (b *S46Binding) String() string {
+	s := fmt.Sprintf("ipv4-address=%s ipv6-prefix=%s", b.IPv4, b.IPv6Prefix)
+	if b.PortParams != nil {
+		s += " " + b.PortParams.String()
+	}
+	return s
+}
+
+// OptS46Container is a softwire container option of RFC 7598, Container is
+// its code and tells the mechanism: dhcpv6.OptionS46ContMapE,
+// OptionS46ContMapT or OptionS46ContLW.
+type OptS46Container struct {
+	Container dhcpv6.OptionCode
+	Rules     []*S46Rule
+	// BRs are the addresses of the Border Relays (MAP-E and lw4o6).
+	BRs []net.IP
+	// DMR is the Default Mapping Rule prefix of MAP-T.
+	DMR      *net.IPNet
+	Bindings []*S46Binding
+}
+
+// S46Mechanism returns the name of the mechanism of an S46 container option
+// code.
+func S46Mechanism(code dhcpv6.OptionCode) string {
+	switch code {
+	case dhcpv6.OptionS46ContMapE:
+		return "MAP-E"
+	case dhcpv6.OptionS46ContMapT:
+		return "MAP-T"
+	case dhcpv6.OptionS46ContLW:
+		return "lw4o6"
+	}
+	return code.String()
+}
+
+// Code returns the option code.
+func (op *OptS46Container) Code() dhcpv6.OptionCode {
+	return op.Container
+}
+
+// ToBytes serializes the option.
+func (op *OptS46Container) ToBytes() []byte {
+	var b []byte
+	for _, r := range op.Rules {
+		flags := byte(0)
+		if r.FMR {
+			flags = 1
+		}
+		ones, _ := r.IPv4Prefix.Mask.Size()
+		data := append([]byte{flags, r.EALen, byte(ones)}, r.IPv4Prefix.IP.To4()...)
+		data = appendPrefix6(data, r.IPv6Prefix)
+		if r.PortParams != nil {
+			data = appendOption(data, dhcpv6.OptionS46PortParams, r.PortParams.toBytes())
+		}
+		b = appendOption(b, dhcpv6.OptionS46Rule, data)
+	}
+	for _, br := range op.BRs {
+		b = appendOption(b, dhcpv6.OptionS46BR, br.To16())
+	}
+	if op.DMR != nil {
+		b = appendOption(b, dhcpv6.OptionS46DMR, appendPrefix6(nil, op.DMR))
+	}
+	for _, bind := range op.Bindings {
+		data := appendPrefix6(append([]byte(nil), bind.IPv4.To4()...), bind.IPv6Prefix)
+		if bind.PortParams != nil {
+			data = appendOption(data, dhcpv6.OptionS46PortParams, bind.PortParams.toBytes())
+		}
+		b = appendOption(b, dhcpv6.OptionS46V4V6Bind, data)
+	}
+	return b
+}
+
+// FromBytes parses the option data (without code and length), Container
+// must be set. The options a container shouldn't hold are ignored.
+func (op *OptS46Container) FromBytes(data []byte) error {
+	return walkOptions(data, func(code dhcpv6.OptionCode, data []byte) error {
+		switch code {
+		case dhcpv6.OptionS46Rule:
+			r, err := parseS46Rule(data)
+			if err != nil {
+				return err
+			}
+			op.Rules = append(op.Rules, r)
+		case dhcpv6.OptionS46BR:
+			if len(data) != net.IPv6len {
+				return fmt.Errorf("S46 BR option must be 16 bytes long, got %d", len(data))
+			}
+			op.BRs = append(op.BRs, net.IP(append([]byte(nil), data...)))
+		case dhcpv6.OptionS46DMR:
+			if len(data) < 1 {
+				return errors.New("S46 DMR option too short")
+			}
+			dmr, rest, err := readPrefix6(data[1:], int(data[0]))
+			if err != nil {
+				return err
+			}
+			if len(rest) != 0 {
+				return errors.New("S46 DMR option too long")
+			}
+			op.DMR = dmr
+		case dhcpv6.OptionS46V4V6Bind:
+			b, err := parseS46Binding(data)
+			if err != nil {
+				return err
+			}
+			op.Bindings = append(op.Bindings, b)
+		}
+		return nil
+	})
+}
+
+func (op *OptS46Container) String() string {
+	var s []string
+	for _, r := range op.Rules {
+		s = append(s, "rule "+r.String())
+	}
+	for _, br := range op.BRs {
+		s = append(s, "br "+br.String())
+	}
+	if op.DMR != nil {
+		s = append(s, "dmr "+op.DMR.String())
+	}
+	for _, b := range op.Bindings {
+		s = append(s, "binding "+b.String())
+	}
+	return fmt.Sprintf("%s: {%s}", S46Mechanism(op.Container), strings.Join(s, ", "))
+}
+
+// parseS46Rule parses the S46 Rule option data.
+func parseS46Rule(data []byte) (*S46Rule, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("S46 Rule option too short: %d bytes", len(data))
+	}
+	r := &S46Rule{FMR: data[0]&1 != 0, EALen: data[1]}
+	if data[2] > 32 {
+		return nil, fmt.Errorf("bad S46 Rule IPv4 prefix length %d", data[2])
+	}
+	r.IPv4Prefix = &net.IPNet{IP: net.IP(append([]byte(nil), data[3:7]...)), Mask: net.CIDRMask(int(data[2]), 32)}
+	var err error
+	var rest []byte
+	if r.IPv6Prefix, rest, err = readPrefix6(data[8:], int(data[7])); err != nil {
+		return nil, err
+	}
+	r.PortParams, err = portParams(rest)
+	return r, err
+}
+
+// parseS46Binding parses the S46 IPv4/IPv6 Address Binding option data.
+func parseS46Binding(data []byte) (*S46Binding, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("S46 IPv4/IPv6 Address Binding option too short: %d bytes", len(data))
+	}
+	b := &S46Binding{IPv4: net.IP(append([]byte(nil), data[:4]...))}
+	var err error
+	var rest []byte
+	if b.IPv6Prefix, rest, err = readPrefix6(data[5:], int(data[4])); err != nil {
+		return nil, err
+	}
+	b.PortParams, err = portParams(rest)
+	return b, err
+}
+
+// portParams returns the S46 Port Parameters option of the options in data,
+// nil if none.
+func portParams(data []byte) (*S46PortParams, error) {
+	var p *S46PortParams
+	err := walkOptions(data, func(code dhcpv6.OptionCode, data []byte) error {
+		var err error
+		if code == dhcpv6.OptionS46PortParams {
+			p, err = parseS46PortParams(data)
+		}
+		return err
+	})
+	return p, err
+}
+
+// OptS46Priority is the S46 Priority option, RFC 8026: the S46 container
+// option codes in order of preference.
+type OptS46Priority struct {
+	Priority []dhcpv6.OptionCode
+}
+
+// Code returns the option code.
+func (op *OptS46Priority) Code() dhcpv6.OptionCode {
+	return dhcpv6.OptionS46Priority
+}
+
+// ToBytes serializes the option.
+func (op *OptS46Priority) ToBytes() []byte {
+	var b []byte
+	for _, c := range op.Priority {
+		b = binary.BigEndian.AppendUint16(b, uint16(c))
+	}
+	return b
+}
+
+// FromBytes parses the option data (without code and length).
+func (op *OptS46Priority) FromBytes(data []byte) error {
+	if len(data) == 0 || len(data)%2 != 0 {
+		return fmt.Errorf("bad S46 Priority option length %d", len(data))
+	}
+	op.Priority = nil
+	for ; len(data) > 0; data = data[2:] {
+		op.Priority = append(op.Priority, dhcpv6.OptionCode(binary.BigEndian.Uint16(data)))
+	}
+	return nil
+}
+
+func (op *OptS46Priority) String() string {
+	var s []string
+	for _, c := range op.Priority {
+		s = append(s, S46Mechanism(c))
+	}
+	return fmt.Sprintf("%s: %s", op.Code(), strings.Join(s, ", "))
+}
+
+// readPrefix6 reads an IPv6 prefix of bits length stored in the minimum
+// number of bytes, it returns the bytes after it.
+func readPrefix6(b []byte, bits int) (*net.IPNet, []byte, error) {
+	if bits > 128 {
+		return nil, nil, fmt.Errorf("bad IPv6 prefix length %d", bits)
+	}
+	n := (bits + 7) / 8
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("IPv6 prefix of %d bits truncated", bits)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, b[:n])
+	mask := net.CIDRMask(bits, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, b[n:], nil
+}
+
+// appendPrefix6 appends the length of p and its significant bytes to b.
+func appendPrefix6(b []byte, p *net.IPNet) []byte {
+	bits, _ := p.Mask.Size()
+	return append(append(b, byte(bits)), p.IP.To16()[:(bits+7)/8]...)
+}
+
+// appendOption appends an option to b.
+func appendOption(b []byte, code dhcpv6.OptionCode, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(code))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// walkOptions calls fn with each option encapsulated in data.
+func walkOptions(data []byte, fn func(code dhcpv6.OptionCode, data []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return fmt.Errorf("%d trailing bytes in options", len(data))
+		}
+		code := dhcpv6.OptionCode(binary.BigEndian.Uint16(data))
+		l := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+l {
+			return fmt.Errorf("%s option truncated", code)
+		}
+		if err := fn(code, data[4:4+l]); err != nil {
+			return err
+		}
+		data = data[4+l:]
+	}
+	return nil
+}
+
+// GetAFTRName returns the AFTR name of msg, empty if there's none or it can't
+// be parsed.
+func GetAFTRName(msg *dhcpv6.Message) string {
+	opt := msg.GetOneOption(dhcpv6.OptionAFTRName)
+	if opt == nil {
+		return ""
+	}
+	aftr := &OptAFTRName{}
+	if err := aftr.FromBytes(opt.ToBytes()); err != nil {
+		return ""
+	}
+	return aftr.Name
+}
+
+// GetS46Containers returns the S46 containers of msg that can be parsed, in
+// the order of the S46 Priority option if any, else in the message order.
+func GetS46Containers(msg *dhcpv6.Message) []*OptS46Container {
+	var containers []*OptS46Container
+	for _, opt := range msg.Options.Options {
+		switch opt.Code() {
+		case dhcpv6.OptionS46ContMapE, dhcpv6.OptionS46ContMapT, dhcpv6.OptionS46ContLW:
+			c := &OptS46Container{Container: opt.Code()}
+			if err := c.FromBytes(opt.ToBytes()); err == nil {
+				containers = append(containers, c)
+			}
+		}
+	}
+	if opt := msg.GetOneOption(dhcpv6.OptionS46Priority); opt != nil {
+		prio := &OptS46Priority{}
+		if err := prio.FromBytes(opt.ToBytes()); err == nil {
+			rank := func(c dhcpv6.OptionCode) int {
+				for i, p := range prio.Priority {
+					if p == c {
+						return i
+					}
+				}
+				return len(prio.Priority)
+			}
+			slices.SortStableFunc(containers, func(a, b *OptS46Container) int {
+				return rank(a.Container) - rank(b.Container)
+			})
+		}
+	}
+	return containers
+}
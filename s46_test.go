@@ -0,0 +1,207 @@
+package dhcp6c
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, p, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func TestS46ContainerRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		op   *OptS46Container
+		want string
+	}{
+		{"MAP-E", &OptS46Container{
+			Container: dhcpv6.OptionS46ContMapE,
+			Rules: []*S46Rule{
+				{FMR: true, EALen: 16, IPv4Prefix: mustCIDR("192.0.2.0/24"), IPv6Prefix: mustCIDR("2001:db8::/40"),
+					PortParams: &S46PortParams{Offset: 6, PSIDLen: 8, PSID: 0x34}},
+				{EALen: 0, IPv4Prefix: mustCIDR("198.51.100.7/32"), IPv6Prefix: mustCIDR("2001:db8:ff::/48")},
+			},
+			BRs: []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")},
+		}, "MAP-E: {rule ipv4-prefix=192.0.2.0/24 ipv6-prefix=2001:db8::/40 ea-len=16 fmr offset=6 psid-len=8 psid=0x34, " +
+			"rule ipv4-prefix=198.51.100.7/32 ipv6-prefix=2001:db8:ff::/48 ea-len=0, br 2001:db8::1, br 2001:db8::2}"},
+		// the prefix lengths that aren't a multiple of 8 keep the bits of
+		// the last byte
+		{"MAP-T", &OptS46Container{
+			Container: dhcpv6.OptionS46ContMapT,
+			Rules:     []*S46Rule{{EALen: 12, IPv4Prefix: mustCIDR("192.0.2.0/28"), IPv6Prefix: mustCIDR("2001:db8:ab80::/41")}},
+			DMR:       mustCIDR("64:ff9b::/96"),
+		}, "MAP-T: {rule ipv4-prefix=192.0.2.0/28 ipv6-prefix=2001:db8:ab80::/41 ea-len=12, dmr 64:ff9b::/96}"},
+		{"lw4o6", &OptS46Container{
+			Container: dhcpv6.OptionS46ContLW,
+			BRs:       []net.IP{net.ParseIP("2001:db8::1")},
+			Bindings: []*S46Binding{{IPv4: net.ParseIP("192.0.2.9"), IPv6Prefix: mustCIDR("2001:db8:1:2::/64"),
+				PortParams: &S46PortParams{Offset: 0, PSIDLen: 4, PSID: 0xa}}},
+		}, "lw4o6: {br 2001:db8::1, binding ipv4-address=192.0.2.9 ipv6-prefix=2001:db8:1:2::/64 offset=0 psid-len=4 psid=0xa}"},
+		{"empty", &OptS46Container{Container: dhcpv6.OptionS46ContLW}, "lw4o6: {}"},
+	} {
+		b := tt.op.ToBytes()
+		got := &OptS46Container{Container: tt.op.Container}
+		if err := got.FromBytes(b); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+		if !bytes.Equal(got.ToBytes(), b) {
+			t.Errorf("%s: got %x after the round trip, want %x", tt.name, got.ToBytes(), b)
+		}
+	}
+}
+
+func TestS46ContainerTruncated(t *testing.T) {
+	rule := &S46Rule{IPv4Prefix: mustCIDR("192.0.2.0/24"), IPv6Prefix: mustCIDR("2001:db8::/40")}
+	b := (&OptS46Container{Container: dhcpv6.OptionS46ContMapE, Rules: []*S46Rule{rule}}).ToBytes()
+	for n := 1; n < len(b); n++ {
+		if err := (&OptS46Container{Container: dhcpv6.OptionS46ContMapE}).FromBytes(b[:n]); err == nil {
+			t.Errorf("no error for the container truncated to %d bytes", n)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"short rule", appendOption(nil, dhcpv6.OptionS46Rule, []byte{0, 0, 24, 192, 0, 2, 0}), "too short"},
+		{"IPv4 prefix", appendOption(nil, dhcpv6.OptionS46Rule, []byte{0, 0, 33, 192, 0, 2, 0, 0}), "IPv4 prefix length"},
+		{"IPv6 prefix", appendOption(nil, dhcpv6.OptionS46Rule, []byte{0, 0, 24, 192, 0, 2, 0, 64, 0x20, 0x01, 0x0d, 0xb8}), "truncated"},
+		{"IPv6 prefix length", appendOption(nil, dhcpv6.OptionS46Rule, []byte{0, 0, 24, 192, 0, 2, 0, 129}), "prefix length"},
+		{"port params", appendOption(nil, dhcpv6.OptionS46Rule,
+			appendOption([]byte{0, 0, 24, 192, 0, 2, 0, 0}, dhcpv6.OptionS46PortParams, []byte{0, 8, 0x34})), "4 bytes"},
+		{"port params trailer", appendOption(nil, dhcpv6.OptionS46Rule, []byte{0, 0, 24, 192, 0, 2, 0, 0, 0, 93}), "trailing"},
+		{"BR", appendOption(nil, dhcpv6.OptionS46BR, net.ParseIP("2001:db8::1")[:15]), "16 bytes"},
+		{"empty DMR", appendOption(nil, dhcpv6.OptionS46DMR, nil), "too short"},
+		{"long DMR", appendOption(nil, dhcpv6.OptionS46DMR, []byte{8, 0x20, 0}), "too long"},
+		{"short binding", appendOption(nil, dhcpv6.OptionS46V4V6Bind, []byte{192, 0, 2, 9}), "too short"},
+		{"binding prefix", appendOption(nil, dhcpv6.OptionS46V4V6Bind, []byte{192, 0, 2, 9, 64, 0x20, 0x01}), "truncated"},
+	} {
+		err := (&OptS46Container{Container: dhcpv6.OptionS46ContMapE}).FromBytes(tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestS46PortParams(t *testing.T) {
+	// the PSID is right aligned in S46PortParams, left aligned on the wire
+	for _, tt := range []struct {
+		p    S46PortParams
+		data []byte
+	}{
+		{S46PortParams{Offset: 6, PSIDLen: 8, PSID: 0x34}, []byte{6, 8, 0x34, 0x00}},
+		{S46PortParams{Offset: 0, PSIDLen: 4, PSID: 0xa}, []byte{0, 4, 0xa0, 0x00}},
+		{S46PortParams{Offset: 4, PSIDLen: 12, PSID: 0xabc}, []byte{4, 12, 0xab, 0xc0}},
+		{S46PortParams{Offset: 0, PSIDLen: 16, PSID: 0xbeef}, []byte{0, 16, 0xbe, 0xef}},
+		{S46PortParams{Offset: 6, PSIDLen: 0}, []byte{6, 0, 0, 0}},
+	} {
+		if got := tt.p.toBytes(); !bytes.Equal(got, tt.data) {
+			t.Errorf("%s: got %x, want %x", &tt.p, got, tt.data)
+		}
+		p, err := parseS46PortParams(tt.data)
+		if err != nil {
+			t.Errorf("%x: %v", tt.data, err)
+		} else if *p != tt.p {
+			t.Errorf("%x: got %s, want %s", tt.data, p, &tt.p)
+		}
+	}
+
+	// the bits after the PSID are ignored
+	if p, err := parseS46PortParams([]byte{0, 4, 0xaf, 0xff}); err != nil || p.PSID != 0xa {
+		t.Errorf("got %v, %v, want the PSID 0xa", p, err)
+	}
+	for _, data := range [][]byte{{0, 17, 0, 0}, {8, 9, 0, 0}, {16, 1, 0, 0}} {
+		if _, err := parseS46PortParams(data); err == nil {
+			t.Errorf("%x: no error", data)
+		}
+	}
+}
+
+func TestS46PriorityRoundTrip(t *testing.T) {
+	op := &OptS46Priority{Priority: []dhcpv6.OptionCode{dhcpv6.OptionS46ContMapT, dhcpv6.OptionS46ContLW}}
+	got := &OptS46Priority{}
+	if err := got.FromBytes(op.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Priority, op.Priority) {
+		t.Errorf("got %s, want %s", got, op)
+	}
+	for _, data := range [][]byte{nil, {0, 95, 0}} {
+		if err := got.FromBytes(data); err == nil {
+			t.Errorf("%x: no error", data)
+		}
+	}
+}
+
+func TestAFTRNameRoundTrip(t *testing.T) {
+	got := &OptAFTRName{}
+	if err := got.FromBytes((&OptAFTRName{Name: "aftr.example.net"}).ToBytes()); err != nil || got.Name != "aftr.example.net" {
+		t.Errorf("got %q, %v", got.Name, err)
+	}
+	if err := got.FromBytes([]byte{5, 'a', 'f', 't', 'r'}); err == nil {
+		t.Error("no error for a truncated label")
+	}
+	two := append((&OptAFTRName{Name: "a.example.net"}).ToBytes(), (&OptAFTRName{Name: "b.example.net"}).ToBytes()...)
+	if err := got.FromBytes(two); err == nil || !strings.Contains(err.Error(), "one name") {
+		t.Errorf("got error %v for two names", err)
+	}
+}
+
+func TestGetS46Containers(t *testing.T) {
+	mapE := &OptS46Container{Container: dhcpv6.OptionS46ContMapE, BRs: []net.IP{net.ParseIP("2001:db8::1")}}
+	mapT := &OptS46Container{Container: dhcpv6.OptionS46ContMapT, DMR: mustCIDR("64:ff9b::/96")}
+	lw := &OptS46Container{Container: dhcpv6.OptionS46ContLW, BRs: []net.IP{net.ParseIP("2001:db8::2")}}
+	newReply := func(opts ...dhcpv6.Option) *dhcpv6.Message {
+		msg := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply}
+		for _, opt := range opts {
+			msg.AddOption(opt)
+		}
+		msg, err := dhcpv6.MessageFromBytes(msg.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	mechanisms := func(containers []*OptS46Container) []string {
+		var s []string
+		for _, c := range containers {
+			s = append(s, S46Mechanism(c.Container))
+		}
+		return s
+	}
+	broken := &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionS46ContMapT, OptionData: appendOption(nil, dhcpv6.OptionS46DMR, nil)}
+
+	for _, tt := range []struct {
+		name string
+		msg  *dhcpv6.Message
+		want []string
+	}{
+		{"message order", newReply(lw, mapE, mapT), []string{"lw4o6", "MAP-E", "MAP-T"}},
+		// the mechanisms not in the priority come last, in message order
+		{"priority", newReply(lw, mapE, mapT, &OptS46Priority{Priority: []dhcpv6.OptionCode{dhcpv6.OptionS46ContMapT, dhcpv6.OptionS46ContLW}}),
+			[]string{"MAP-T", "lw4o6", "MAP-E"}},
+		{"bad priority", newReply(lw, mapE, &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionS46Priority, OptionData: []byte{0}}),
+			[]string{"lw4o6", "MAP-E"}},
+		{"unparsable", newReply(broken, mapE), []string{"MAP-E"}},
+		{"none", newReply(), nil},
+	} {
+		if got := mechanisms(GetS46Containers(tt.msg)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nspeed-app/testdhcpv6pd/internal/atomicfile"
+)
+
+// Binding is a prefix delegated to the IA_PD of a client.
+type Binding struct {
+	// DUID is the client DUID in hex digits.
+	DUID    string       `json:"duid"`
+	IAID    uint32       `json:"iaid"`
+	Prefix  netip.Prefix `json:"prefix"`
+	Expires time.Time    `json:"expires"`
+	// Declined is set once the client declined the prefix, it's kept out
+	// of the pools until Expires.
+	Declined bool `json:"declined,omitempty"`
+}
+
+// bindingKey identifies the IA_PD of a client.
+func bindingKey(duid string, iaid uint32) string {
+	return fmt.Sprintf("%s/%d", duid, iaid)
+}
+
+func (b *Binding) key() string {
+	return bindingKey(b.DUID, b.IAID)
+}
+
+// maxCandidates bounds the number of prefixes of a pool tried to find a free
+// one.
+const maxCandidates = 1 << 20
+
+// Pool delegates the prefixes of length Length out of Prefix, for instance
+// /56 out of a /48.
+type Pool struct {
+	Prefix netip.Prefix
+	Length int
+}
+
+// ParsePool parses a pool as prefix=length, for instance 2001:db8::/48=56.
+func ParsePool(s string) (Pool, error) {
+	p, l, ok := strings.Cut(s, "=")
+	if !ok {
+		return Pool{}, fmt.Errorf("bad pool %q, expecting prefix=length", s)
+	}
+	prefix, err := netip.ParsePrefix(p)
+	if err != nil {
+		return Pool{}, err
+	}
+	length, err := strconv.Atoi(l)
+	if err != nil {
+		return Pool{}, fmt.Errorf("bad pool %q: %v", s, err)
+	}
+	pool := Pool{Prefix: prefix.Masked(), Length: length}
+	return pool, pool.validate()
+}
+
+func (p Pool) String() string {
+	return fmt.Sprintf("%s=%d", p.Prefix, p.Length)
+}
+
+func (p Pool) validate() error {
+	if !p.Prefix.Addr().Is6() || p.Prefix.Addr().Is4In6() {
+		return fmt.Errorf("pool %s is not IPv6", p)
+	}
+	if p.Length < p.Prefix.Bits() || p.Length > 128 {
+		return fmt.Errorf("pool %s: bad delegated length", p)
+	}
+	return nil
+}
+
+// candidates returns the number of prefixes of the pool to try.
+func (p Pool) candidates() uint64 {
+	bits := p.Length - p.Prefix.Bits()
+	if bits >= 20 {
+		return maxCandidates
+	}
+	return 1 << bits
+}
+
+// nth returns the nth prefix of the pool.
+func (p Pool) nth(n uint64) netip.Prefix {
+	a := p.Prefix.Addr().As16()
+	hi := binary.BigEndian.Uint64(a[:8])
+	lo := binary.BigEndian.Uint64(a[8:])
+	shift := uint(128 - p.Length)
+	switch {
+	case shift >= 64:
+		hi += n << (shift - 64)
+	case shift == 0:
+		lo += n
+	default:
+		add := n << shift
+		if lo+add < lo {
+			hi++
+		}
+		lo += add
+		hi += n >> (64 - shift)
+	}
+	binary.BigEndian.PutUint64(a[:8], hi)
+	binary.BigEndian.PutUint64(a[8:], lo)
+	return netip.PrefixFrom(netip.AddrFrom16(a), p.Length)
+}
+
+// contains tells if prefix is one the pool delegates.
+func (p Pool) contains(prefix netip.Prefix) bool {
+	return prefix.Bits() == p.Length && p.Prefix.Contains(prefix.Addr())
+}
+
+// loadBindings reads the bindings saved in file, a missing file holds none.
+func loadBindings(file string) ([]*Binding, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bindings []*Binding
+	if err := json.Unmarshal(b, &bindings); err != nil {
+		return nil, fmt.Errorf("bad bindings file %s: %v", file, err)
+	}
+	return bindings, nil
+}
+
+// saveBindings writes bindings to file.
+func saveBindings(file string, bindings []*Binding) error {
+	b, err := json.MarshalIndent(bindings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(file, append(b, '\n'))
+}
@@ -0,0 +1,551 @@
+// Package server is a minimal DHCPv6-PD delegating router for lab use: it
+// delegates prefixes out of configured pools, honours the client hints,
+// supports Rapid Commit, Renew, Rebind, Release, Decline and Relay-Forward
+// messages, and persists its bindings (keyed by DUID and IAID) in a JSON file.
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+// Default lifetimes of the delegated prefixes.
+const (
+	DefaultPreferred = 1 * time.Hour
+	DefaultValid     = 2 * time.Hour
+)
+
+// offerLifetime is how long a prefix advertised stays reserved for the
+// client.
+const offerLifetime = time.Minute
+
+// declineLifetime is how long a prefix declined by a client stays out of the
+// pools.
+const declineLifetime = 24 * time.Hour
+
+// Config is the server configuration.
+type Config struct {
+	// ServerID is the server DUID.
+	ServerID dhcpv6.DUID
+	// Pools are tried in order.
+	Pools []Pool
+	// Preferred and Valid are the lifetimes of the prefixes (DefaultPreferred
+	// and DefaultValid if 0). T1 and T2 default to 0.5 and 0.8 times the
+	// preferred lifetime.
+	Preferred time.Duration
+	Valid     time.Duration
+	T1        time.Duration
+	T2        time.Duration
+	// Preference is sent in the Advertise messages if not 0.
+	Preference uint8
+	// RapidCommit commits the bindings on a Solicit with the Rapid Commit
+	// option.
+	RapidCommit bool
+	// DNS and DomainSearch are sent to the clients requesting them.
+	DNS          []net.IP
+	DomainSearch []string
+	// BindingsFile persists the bindings if set.
+	BindingsFile string
+	// Logger logs the exchanges if set.
+	Logger dhcp6c.Logger
+}
+
+// Server is a DHCPv6-PD server.
+type Server struct {
+	cfg Config
+
+	mu       sync.Mutex
+	bindings map[string]*Binding
+	offers   map[string]*Binding
+	// declined are the prefixes declined by the clients, by prefix.
+	declined map[string]*Binding
+}
+
+// New returns a server, loading the bindings saved in cfg.BindingsFile.
+func New(cfg Config) (*Server, error) {
+	if cfg.ServerID == nil {
+		return nil, errors.New("no server DUID")
+	}
+	if len(cfg.Pools) == 0 {
+		return nil, errors.New("no pool to delegate prefixes from")
+	}
+	for _, p := range cfg.Pools {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Preferred == 0 {
+		cfg.Preferred = DefaultPreferred
+	}
+	if cfg.Valid == 0 {
+		cfg.Valid = DefaultValid
+	}
+	if cfg.Preferred > cfg.Valid {
+		return nil, fmt.Errorf("preferred lifetime %s greater than valid lifetime %s", cfg.Preferred, cfg.Valid)
+	}
+	if cfg.T1 == 0 {
+		cfg.T1 = cfg.Preferred / 2
+	}
+	if cfg.T2 == 0 {
+		cfg.T2 = cfg.Preferred * 4 / 5
+	}
+	s := &Server{
+		cfg:      cfg,
+		bindings: make(map[string]*Binding),
+		offers:   make(map[string]*Binding),
+		declined: make(map[string]*Binding),
+	}
+	if cfg.BindingsFile != "" {
+		bindings, err := loadBindings(cfg.BindingsFile)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for _, b := range bindings {
+			switch {
+			case !b.Expires.After(now):
+			case b.Declined:
+				s.declined[b.Prefix.String()] = b
+			default:
+				s.bindings[b.key()] = b
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) logf(format string, v ...any) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Printf(format, v...)
+	}
+}
+
+// Listen returns a connection receiving the messages sent to the
+// All_DHCP_Relay_Agents_and_Servers multicast address on iface and to port
+// 547.
+func Listen(iface string) (net.PacketConn, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenMulticastUDP("udp6", ifi, dhcp6c.AllDHCPRelayAgentsAndServers)
+}
+
+// Serve answers the messages received on conn until it is closed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	b := make([]byte, 65536)
+	for {
+		n, peer, err := conn.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		d, err := dhcpv6.FromBytes(b[:n])
+		if err != nil {
+			s.logf("invalid message from %s: %v", peer, err)
+			continue
+		}
+		resp, err := s.HandleDHCPv6(d)
+		if err != nil {
+			s.logf("%s from %s: %v", d.Type(), peer, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+			s.logf("sending %s to %s: %v", resp.Type(), peer, err)
+		}
+	}
+}
+
+// HandleDHCPv6 returns the answer to a message or to a Relay-Forward
+// message, nil if there's none.
+func (s *Server) HandleDHCPv6(d dhcpv6.DHCPv6) (dhcpv6.DHCPv6, error) {
+	if !d.IsRelay() {
+		msg, ok := d.(*dhcpv6.Message)
+		if !ok {
+			return nil, errors.New("not a message")
+		}
+		resp := s.Handle(msg)
+		if resp == nil {
+			return nil, nil
+		}
+		return resp, nil
+	}
+	msg, err := d.GetInnerMessage()
+	if err != nil {
+		return nil, err
+	}
+	resp := s.Handle(msg)
+	if resp == nil {
+		return nil, nil
+	}
+	return dhcpv6.NewRelayReplFromRelayForw(d.(*dhcpv6.RelayMessage), resp)
+}
+
+// Handle returns the answer to msg, nil if msg must be ignored.
+func (s *Server) Handle(msg *dhcpv6.Message) *dhcpv6.Message {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.PrintMessage("received message", msg)
+	}
+	cid := msg.Options.ClientID()
+	if cid == nil {
+		s.logf("ignoring %s without Client ID", msg.MessageType)
+		return nil
+	}
+	sid := msg.Options.ServerID()
+	ours := sid != nil && bytes.Equal(sid.ToBytes(), s.cfg.ServerID.ToBytes())
+
+	// RFC 8415 section 16: Server ID checks
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRebind:
+		if sid != nil {
+			return nil
+		}
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		if !ours {
+			return nil
+		}
+	case dhcpv6.MessageTypeInformationRequest:
+		if sid != nil && !ours {
+			return nil
+		}
+	default:
+		s.logf("ignoring %s", msg.MessageType)
+		return nil
+	}
+
+	mt := dhcpv6.MessageTypeReply
+	rapid := msg.MessageType == dhcpv6.MessageTypeSolicit && s.cfg.RapidCommit &&
+		msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil
+	if msg.MessageType == dhcpv6.MessageTypeSolicit && !rapid {
+		mt = dhcpv6.MessageTypeAdvertise
+	}
+	resp := &dhcpv6.Message{MessageType: mt, TransactionID: msg.TransactionID}
+	resp.AddOption(dhcpv6.OptClientID(cid))
+	resp.AddOption(dhcpv6.OptServerID(s.cfg.ServerID))
+	if rapid {
+		resp.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit})
+	}
+	if mt == dhcpv6.MessageTypeAdvertise && s.cfg.Preference != 0 {
+		resp.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionPreference, OptionData: []byte{s.cfg.Preference}})
+	}
+
+	duid := hex.EncodeToString(cid.ToBytes())
+	now := time.Now()
+	s.mu.Lock()
+	s.expire(now)
+	changed := false
+	for _, iapd := range msg.Options.IAPD() {
+		iaid := binary.BigEndian.Uint32(iapd.IaId[:])
+		var opt *dhcpv6.OptIAPD
+		switch msg.MessageType {
+		case dhcpv6.MessageTypeSolicit:
+			opt = s.offer(duid, iaid, iapd, now, rapid)
+			changed = changed || rapid
+		case dhcpv6.MessageTypeRequest:
+			opt = s.offer(duid, iaid, iapd, now, true)
+			changed = true
+		case dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+			opt = s.extend(duid, iaid, iapd, now, msg.MessageType == dhcpv6.MessageTypeRebind)
+			changed = true
+		case dhcpv6.MessageTypeRelease:
+			opt = s.release(duid, iaid, iapd)
+			changed = true
+		case dhcpv6.MessageTypeDecline:
+			opt = s.decline(duid, iaid, iapd, now)
+			changed = true
+		}
+		if opt != nil {
+			resp.AddOption(opt)
+		}
+	}
+	var saveErr error
+	if changed && s.cfg.BindingsFile != "" {
+		saveErr = saveBindings(s.cfg.BindingsFile, s.list())
+	}
+	s.mu.Unlock()
+	if saveErr != nil {
+		s.logf("saving bindings: %v", saveErr)
+	}
+
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeRelease:
+		resp.AddOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess, StatusMessage: "released"})
+	case dhcpv6.MessageTypeDecline:
+		resp.AddOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess, StatusMessage: "declined"})
+	default:
+		s.information(msg, resp)
+	}
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.PrintMessage("sending message", resp)
+	}
+	return resp
+}
+
+// information adds the requested DNS and domain search options.
+func (s *Server) information(msg, resp *dhcpv6.Message) {
+	oro := msg.Options.RequestedOptions()
+	if len(s.cfg.DNS) > 0 && oro.Contains(dhcpv6.OptionDNSRecursiveNameServer) {
+		resp.AddOption(dhcpv6.OptDNS(s.cfg.DNS...))
+	}
+	if len(s.cfg.DomainSearch) > 0 && oro.Contains(dhcpv6.OptionDomainSearchList) {
+		dhcpv6.WithDomainSearchList(s.cfg.DomainSearch...)(resp)
+	}
+}
+
+// hints returns the prefixes of an IA_PD of the client.
+func hints(iapd *dhcpv6.OptIAPD) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, p := range iapd.Options.Prefixes() {
+		if p.Prefix == nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(p.Prefix.IP.To16())
+		if !ok {
+			continue
+		}
+		bits, _ := p.Prefix.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, bits).Masked())
+	}
+	return prefixes
+}
+
+// newIAPD returns the IA_PD delegating prefix to the client.
+func (s *Server) newIAPD(iaid [4]byte, prefix netip.Prefix) *dhcpv6.OptIAPD {
+	opt := &dhcpv6.OptIAPD{IaId: iaid, T1: s.cfg.T1, T2: s.cfg.T2}
+	opt.Options.Add(&dhcpv6.OptIAPrefix{
+		PreferredLifetime: s.cfg.Preferred,
+		ValidLifetime:     s.cfg.Valid,
+		Prefix:            ipNet(prefix),
+	})
+	return opt
+}
+
+// statusIAPD returns an IA_PD with a Status Code.
+func statusIAPD(iaid [4]byte, code iana.StatusCode, message string) *dhcpv6.OptIAPD {
+	opt := &dhcpv6.OptIAPD{IaId: iaid}
+	opt.Options.Add(&dhcpv6.OptStatusCode{StatusCode: code, StatusMessage: message})
+	return opt
+}
+
+func ipNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), 128)}
+}
+
+// offer answers an IA_PD of a Solicit or Request: the binding of the client,
+// or a new prefix. The prefix is reserved for a while if not committed.
+func (s *Server) offer(duid string, iaid uint32, iapd *dhcpv6.OptIAPD, now time.Time, commit bool) *dhcpv6.OptIAPD {
+	key := bindingKey(duid, iaid)
+	b, ok := s.bindings[key]
+	if !ok {
+		b, ok = s.offers[key]
+	}
+	if !ok {
+		prefix, found := s.allocate(key, hints(iapd))
+		if !found {
+			s.logf("no prefix available for %s", key)
+			return statusIAPD(iapd.IaId, iana.StatusNoPrefixAvail, "no prefix available")
+		}
+		b = &Binding{DUID: duid, IAID: iaid, Prefix: prefix}
+	}
+	if commit {
+		delete(s.offers, key)
+		b.Expires = now.Add(s.cfg.Valid)
+		s.bindings[key] = b
+		s.logf("delegated %s to %s", b.Prefix, key)
+	} else if _, bound := s.bindings[key]; !bound {
+		b.Expires = now.Add(offerLifetime)
+		s.offers[key] = b
+	}
+	return s.newIAPD(iapd.IaId, b.Prefix)
+}
+
+// extend answers an IA_PD of a Renew or Rebind, RFC 8415 sections 18.3.4
+// and 18.3.5.
+func (s *Server) extend(duid string, iaid uint32, iapd *dhcpv6.OptIAPD, now time.Time, rebind bool) *dhcpv6.OptIAPD {
+	key := bindingKey(duid, iaid)
+	b, ok := s.bindings[key]
+	if !ok && rebind {
+		// after a restart without bindings file: keep the prefix if free
+		for _, hint := range hints(iapd) {
+			if s.inPool(hint) && s.free(key, hint) {
+				b = &Binding{DUID: duid, IAID: iaid, Prefix: hint}
+				s.bindings[key] = b
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		if rebind {
+			// the prefixes are not appropriate: 0 lifetimes
+			opt := &dhcpv6.OptIAPD{IaId: iapd.IaId}
+			for _, hint := range hints(iapd) {
+				opt.Options.Add(&dhcpv6.OptIAPrefix{Prefix: ipNet(hint)})
+			}
+			return opt
+		}
+		return statusIAPD(iapd.IaId, iana.StatusNoBinding, "no binding")
+	}
+	b.Expires = now.Add(s.cfg.Valid)
+	opt := s.newIAPD(iapd.IaId, b.Prefix)
+	for _, hint := range hints(iapd) {
+		if hint != b.Prefix && hint.Addr().IsGlobalUnicast() {
+			// not delegated to this IA_PD any more
+			opt.Options.Add(&dhcpv6.OptIAPrefix{Prefix: ipNet(hint)})
+		}
+	}
+	s.logf("extended %s of %s", b.Prefix, key)
+	return opt
+}
+
+// release removes the binding of an IA_PD.
+func (s *Server) release(duid string, iaid uint32, iapd *dhcpv6.OptIAPD) *dhcpv6.OptIAPD {
+	key := bindingKey(duid, iaid)
+	b, ok := s.bindings[key]
+	if !ok {
+		return statusIAPD(iapd.IaId, iana.StatusNoBinding, "no binding")
+	}
+	delete(s.bindings, key)
+	s.logf("released %s of %s", b.Prefix, key)
+	return nil
+}
+
+// decline removes the binding of an IA_PD and keeps its prefix out of the
+// pools for declineLifetime, RFC 8415 section 18.3.8: the client found it
+// unusable, another client would too.
+func (s *Server) decline(duid string, iaid uint32, iapd *dhcpv6.OptIAPD, now time.Time) *dhcpv6.OptIAPD {
+	key := bindingKey(duid, iaid)
+	b, ok := s.bindings[key]
+	if !ok {
+		return statusIAPD(iapd.IaId, iana.StatusNoBinding, "no binding")
+	}
+	delete(s.bindings, key)
+	b.Declined = true
+	b.Expires = now.Add(declineLifetime)
+	s.declined[b.Prefix.String()] = b
+	s.logf("declined %s of %s", b.Prefix, key)
+	return nil
+}
+
+// expire removes the expired bindings, offers and declined prefixes.
+func (s *Server) expire(now time.Time) {
+	for _, m := range []map[string]*Binding{s.bindings, s.offers, s.declined} {
+		for key, b := range m {
+			if !b.Expires.After(now) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// inPool tells if prefix is delegated by one of the pools.
+func (s *Server) inPool(prefix netip.Prefix) bool {
+	for _, p := range s.cfg.Pools {
+		if p.contains(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// free tells if prefix overlaps no binding nor offer but the ones of key, and
+// no declined prefix.
+func (s *Server) free(key string, prefix netip.Prefix) bool {
+	for _, m := range []map[string]*Binding{s.bindings, s.offers} {
+		for k, b := range m {
+			if k != key && b.Prefix.Overlaps(prefix) {
+				return false
+			}
+		}
+	}
+	for _, b := range s.declined {
+		if b.Prefix.Overlaps(prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocate returns a free prefix for key. A hint with a prefix is honoured
+// if it's free and in a pool, a hint with only a length (::/60) selects the
+// pools delegating that length. Otherwise the first free prefix of the pools
+// is returned.
+func (s *Server) allocate(key string, hints []netip.Prefix) (netip.Prefix, bool) {
+	pools := s.cfg.Pools
+	for _, hint := range hints {
+		if hint.Addr().IsUnspecified() {
+			var matching []Pool
+			for _, p := range s.cfg.Pools {
+				if p.Length == hint.Bits() {
+					matching = append(matching, p)
+				}
+			}
+			if len(matching) > 0 {
+				pools = matching
+			}
+			continue
+		}
+		for _, p := range s.cfg.Pools {
+			if !p.Prefix.Contains(hint.Addr()) {
+				continue
+			}
+			candidate := netip.PrefixFrom(hint.Addr(), p.Length).Masked()
+			if s.free(key, candidate) {
+				return candidate, true
+			}
+		}
+	}
+	for _, p := range pools {
+		for i := uint64(0); i < p.candidates(); i++ {
+			if candidate := p.nth(i); s.free(key, candidate) {
+				return candidate, true
+			}
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// list returns the bindings and the declined prefixes, sorted by DUID and
+// IAID.
+func (s *Server) list() []*Binding {
+	bindings := make([]*Binding, 0, len(s.bindings)+len(s.declined))
+	for _, m := range []map[string]*Binding{s.bindings, s.declined} {
+		for _, b := range m {
+			bindings = append(bindings, b)
+		}
+	}
+	slices.SortFunc(bindings, func(a, b *Binding) int {
+		return cmp.Or(cmp.Compare(a.DUID, b.DUID), cmp.Compare(a.IAID, b.IAID), a.Prefix.Addr().Compare(b.Prefix.Addr()))
+	})
+	return bindings
+}
+
+// Bindings returns a copy of the current bindings, declined prefixes
+// included.
+func (s *Server) Bindings() []Binding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var bindings []Binding
+	for _, b := range s.list() {
+		bindings = append(bindings, *b)
+	}
+	return bindings
+}
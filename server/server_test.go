@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+)
+
+var serverID = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+
+func clientID(n byte) dhcpv6.DUID {
+	return &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 1, n}}
+}
+
+// bind runs the Solicit/Request exchange of client with srv and returns the
+// lease.
+func bind(t *testing.T, srv *Server, client dhcpv6.DUID) *dhcp6c.Lease {
+	t.Helper()
+	solicit, err := dhcp6c.NewSolicit(client, dhcp6c.WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{
+		Prefix: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(56, 128)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := dhcp6c.NewRequestFromAdvertise(srv.Handle(solicit), dhcpv6.WithClientID(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := dhcp6c.NewLease(srv.Handle(request), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lease
+}
+
+func TestDecline(t *testing.T) {
+	pool, _ := ParsePool("2001:db8::/55=56")
+	file := filepath.Join(t.TempDir(), "bindings.json")
+	srv, err := New(Config{ServerID: serverID, Pools: []Pool{pool}, BindingsFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := bind(t, srv, clientID(1))
+	declined := lease.Prefixes()[0].Prefix.String()
+	if declined != "2001:db8::/56" {
+		t.Fatalf("got %s, want the first prefix of the pool", declined)
+	}
+
+	decline, err := dhcp6c.NewDecline(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := srv.Handle(decline)
+	if status := reply.Options.Status(); status == nil || status.StatusCode != iana.StatusSuccess {
+		t.Errorf("got status %v, want Success", status)
+	}
+
+	// neither the client nor another one gets the declined prefix, even
+	// after a restart
+	if p := bind(t, srv, clientID(1)).Prefixes()[0].Prefix.String(); p == declined {
+		t.Errorf("got the declined prefix %s again", p)
+	}
+	srv, err = New(Config{ServerID: serverID, Pools: []Pool{pool}, BindingsFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	solicit, err := dhcp6c.NewSolicit(clientID(2), dhcp6c.WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{
+		Prefix: &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(56, 128)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iapd := srv.Handle(solicit).Options.IAPD()[0]
+	if status := iapd.Options.Status(); status == nil || status.StatusCode != iana.StatusNoPrefixAvail {
+		t.Errorf("got IA_PD %s, want NoPrefixAvail: the pool holds a bound and a declined prefix", iapd)
+	}
+
+	var n int
+	for _, b := range srv.Bindings() {
+		if b.Declined {
+			n++
+			if b.Prefix != netip.MustParsePrefix(declined) {
+				t.Errorf("declined %s, want %s", b.Prefix, declined)
+			}
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d declined prefixes, want 1", n)
+	}
+}
+
+// newServer returns a server delegating /56 out of 2001:db8::/48, without
+// bindings file.
+func newServer(t *testing.T, rapidCommit bool) *Server {
+	t.Helper()
+	pool, _ := ParsePool("2001:db8::/48=56")
+	srv, err := New(Config{ServerID: serverID, Pools: []Pool{pool}, RapidCommit: rapidCommit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// newSolicit returns a Solicit of client for one IA_PD with hint.
+func newSolicit(t *testing.T, client dhcpv6.DUID, hint string, modifiers ...dhcpv6.Modifier) *dhcpv6.Message {
+	t.Helper()
+	p := netip.MustParsePrefix(hint)
+	solicit, err := dhcp6c.NewSolicit(client, append([]dhcpv6.Modifier{dhcp6c.WithIAPD([4]byte{0, 0, 0, 1}, &dhcpv6.OptIAPrefix{Prefix: ipNet(p)})}, modifiers...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return solicit
+}
+
+// prefixes returns the prefixes and valid lifetimes of the IA_PDs of msg.
+func prefixes(msg *dhcpv6.Message) map[string]time.Duration {
+	m := make(map[string]time.Duration)
+	for _, iapd := range msg.Options.IAPD() {
+		for _, p := range iapd.Options.Prefixes() {
+			m[p.Prefix.String()] = p.ValidLifetime
+		}
+	}
+	return m
+}
+
+func TestHints(t *testing.T) {
+	srv := newServer(t, false)
+	// a free prefix of the pool is honoured, a hint with only a length gets
+	// the first free prefix
+	if got := prefixes(srv.Handle(newSolicit(t, clientID(1), "2001:db8:0:4200::/56"))); len(got) != 1 || got["2001:db8:0:4200::/56"] == 0 {
+		t.Errorf("got %v, want the hinted prefix", got)
+	}
+	if got := prefixes(srv.Handle(newSolicit(t, clientID(2), "::/56"))); len(got) != 1 || got["2001:db8::/56"] == 0 {
+		t.Errorf("got %v, want the first prefix of the pool", got)
+	}
+	// outside the pool or offered to another client
+	if got := prefixes(srv.Handle(newSolicit(t, clientID(3), "2001:db9::/56"))); len(got) != 1 || got["2001:db8:0:100::/56"] == 0 {
+		t.Errorf("got %v for a hint outside the pool, want the next free prefix", got)
+	}
+	if got := prefixes(srv.Handle(newSolicit(t, clientID(4), "2001:db8:0:4200::/56"))); len(got) != 1 || got["2001:db8:0:4200::/56"] != 0 {
+		t.Errorf("got %v, want another prefix than the one offered to client 1", got)
+	}
+}
+
+func TestRapidCommit(t *testing.T) {
+	solicit := newSolicit(t, clientID(1), "::/56", dhcpv6.WithRapidCommit)
+
+	// ignored unless configured
+	srv := newServer(t, false)
+	if resp := srv.Handle(solicit); resp.MessageType != dhcpv6.MessageTypeAdvertise || len(srv.Bindings()) != 0 {
+		t.Errorf("got %s and bindings %v, want an Advertise without binding", resp.MessageType, srv.Bindings())
+	}
+
+	srv = newServer(t, true)
+	resp := srv.Handle(solicit)
+	if resp.MessageType != dhcpv6.MessageTypeReply || resp.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+		t.Fatalf("got %s, want a Reply with Rapid Commit", resp.Summary())
+	}
+	if b := srv.Bindings(); len(b) != 1 || b[0].Prefix != netip.MustParsePrefix("2001:db8::/56") {
+		t.Errorf("got bindings %v, want 2001:db8::/56 committed", b)
+	}
+	// a Solicit without Rapid Commit is advertised
+	if resp := srv.Handle(newSolicit(t, clientID(2), "::/56")); resp.MessageType != dhcpv6.MessageTypeAdvertise {
+		t.Errorf("got %s, want an Advertise", resp.MessageType)
+	}
+}
+
+func TestRenewRebind(t *testing.T) {
+	srv := newServer(t, false)
+	lease := bind(t, srv, clientID(1))
+	expires := srv.Bindings()[0].Expires
+	for _, newMessage := range []func(*dhcp6c.Lease, ...dhcpv6.Modifier) (*dhcpv6.Message, error){dhcp6c.NewRenew, dhcp6c.NewRebind} {
+		time.Sleep(10 * time.Millisecond)
+		msg, err := newMessage(lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := srv.Handle(msg)
+		if got := prefixes(reply); len(got) != 1 || got["2001:db8::/56"] != DefaultValid {
+			t.Errorf("%s: got %v, want 2001:db8::/56 extended", msg.MessageType, got)
+		}
+		b := srv.Bindings()
+		if len(b) != 1 || !b[0].Expires.After(expires) {
+			t.Errorf("%s: got bindings %v, want the expiry pushed back", msg.MessageType, b)
+		}
+		expires = b[0].Expires
+	}
+}
+
+func TestRenewRebindUnknown(t *testing.T) {
+	// a lease the server doesn't know, with a prefix bound to another client
+	srv := newServer(t, false)
+	other := bind(t, srv, clientID(1))
+	lease := &dhcp6c.Lease{ClientID: clientID(2), ServerID: serverID, IAPDs: other.IAPDs}
+
+	renew, err := dhcp6c.NewRenew(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iapd := srv.Handle(renew).Options.IAPD()[0]
+	if status := iapd.Options.Status(); status == nil || status.StatusCode != iana.StatusNoBinding {
+		t.Errorf("got IA_PD %s to the Renew, want NoBinding", iapd)
+	}
+
+	// the prefix is not appropriate, the Rebind gets it with 0 lifetimes
+	rebind, err := dhcp6c.NewRebind(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prefixes(srv.Handle(rebind)); len(got) != 1 || got["2001:db8::/56"] != 0 {
+		t.Errorf("got %v to the Rebind, want 2001:db8::/56 with 0 lifetimes", got)
+	}
+	if b := srv.Bindings(); len(b) != 1 || b[0].DUID == hex.EncodeToString(clientID(2).ToBytes()) {
+		t.Errorf("got bindings %v, want the one of client 1 only", b)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	srv := newServer(t, false)
+	lease := bind(t, srv, clientID(1))
+	release, err := dhcp6c.NewRelease(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := srv.Handle(release)
+	if status := reply.Options.Status(); status == nil || status.StatusCode != iana.StatusSuccess {
+		t.Errorf("got status %v, want Success", status)
+	}
+	if b := srv.Bindings(); len(b) != 0 {
+		t.Errorf("got bindings %v after the Release", b)
+	}
+	// nothing left to release
+	iapd := srv.Handle(release).Options.IAPD()[0]
+	if status := iapd.Options.Status(); status == nil || status.StatusCode != iana.StatusNoBinding {
+		t.Errorf("got IA_PD %s to the second Release, want NoBinding", iapd)
+	}
+}
+
+func TestRelayForward(t *testing.T) {
+	srv := newServer(t, false)
+	link, peer := net.ParseIP("2001:db8:ffff::1"), net.ParseIP("fe80::1")
+	relay, err := dhcpv6.EncapsulateRelay(newSolicit(t, clientID(1), "::/56"), dhcpv6.MessageTypeRelayForward, link, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.Options.Add(dhcpv6.OptInterfaceID([]byte("eth0")))
+	resp, err := srv.HandleDHCPv6(relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repl, ok := resp.(*dhcpv6.RelayMessage)
+	if !ok || repl.MessageType != dhcpv6.MessageTypeRelayReply {
+		t.Fatalf("got %s, want a Relay-Reply", resp.Summary())
+	}
+	if !repl.LinkAddr.Equal(link) || !repl.PeerAddr.Equal(peer) || string(repl.Options.InterfaceID()) != "eth0" {
+		t.Errorf("got %s, want the link and peer addresses and the Interface ID of the Relay-Forward", repl.Summary())
+	}
+	inner, err := repl.GetInnerMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prefixes(inner); inner.MessageType != dhcpv6.MessageTypeAdvertise || len(got) != 1 || got["2001:db8::/56"] == 0 {
+		t.Errorf("got %s, want an Advertise of 2001:db8::/56", inner.Summary())
+	}
+}
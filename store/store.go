@@ -0,0 +1,283 @@
+// Package store keeps the identity of a client and its lease across
+// restarts, in a JSON file: the DUID and IAIDs (the server sees the same
+// client and can give the same prefixes back), the last lease (prefixes,
+// server, lifetimes and Reconfigure Key) and the replay detection counter of
+// the Authentication option.
+//
+//	s, err := store.Open(file)
+//	duid, err := s.DUID() // nil the first time, then SetDUID
+//	lease, err := s.Lease() // nil if none or expired
+//	err = m.Run(ctx, lease) // with a LeaseManager, SetLease on each event
+package store
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcp6c "github.com/nspeed-app/testdhcpv6pd"
+	"github.com/nspeed-app/testdhcpv6pd/internal/atomicfile"
+)
+
+// Prefix is a delegated prefix and its lifetimes.
+type Prefix struct {
+	Prefix    netip.Prefix  `json:"prefix"`
+	Preferred time.Duration `json:"preferred"`
+	Valid     time.Duration `json:"valid"`
+}
+
+// NewPrefix returns the prefix of an IA Prefix option, false if it's not a
+// valid IPv6 prefix.
+func NewPrefix(p *dhcpv6.OptIAPrefix) (Prefix, bool) {
+	if p.Prefix == nil {
+		return Prefix{}, false
+	}
+	addr, ok := netip.AddrFromSlice(p.Prefix.IP)
+	if !ok {
+		return Prefix{}, false
+	}
+	bits, _ := p.Prefix.Mask.Size()
+	return Prefix{
+		Prefix:    netip.PrefixFrom(addr.Unmap(), bits).Masked(),
+		Preferred: p.PreferredLifetime,
+		Valid:     p.ValidLifetime,
+	}, true
+}
+
+// IAPD is an IA_PD of the lease.
+type IAPD struct {
+	IAID     uint32        `json:"iaid"`
+	T1       time.Duration `json:"t1"`
+	T2       time.Duration `json:"t2"`
+	Prefixes []Prefix      `json:"prefixes"`
+}
+
+// Lease is the saved form of a dhcp6c.Lease, the DUIDs and the Reconfigure
+// Key in hex digits.
+type Lease struct {
+	ServerDUID        string    `json:"server_duid"`
+	ServerAddr        string    `json:"server_address,omitempty"`
+	Obtained          time.Time `json:"obtained"`
+	ReconfigureKey    string    `json:"reconfigure_key,omitempty"`
+	ReconfigureReplay uint64    `json:"reconfigure_replay,omitempty"`
+	IAPDs             []IAPD    `json:"iapds"`
+}
+
+// State is the content of the file.
+type State struct {
+	// DUID is the client DUID in hex digits, empty until one is chosen.
+	DUID  string   `json:"duid"`
+	IAIDs []uint32 `json:"iaids,omitempty"`
+	Lease *Lease   `json:"lease,omitempty"`
+	// ReplayCounter is the last replay detection value sent.
+	ReplayCounter uint64 `json:"replay_counter,omitempty"`
+}
+
+// Store is the state of a client, saved to its file on each change.
+type Store struct {
+	file string
+
+	mu    sync.Mutex
+	state State
+	ntp   dhcp6c.NTPCounter
+}
+
+// Open reads the state saved in file, a missing file is an empty state (the
+// file is created on the first change).
+func Open(file string) (*Store, error) {
+	s := &Store{file: file}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.state); err != nil {
+		return nil, fmt.Errorf("bad state file %s: %v", file, err)
+	}
+	return s, nil
+}
+
+// State returns a copy of the state.
+func (s *Store) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// DUID returns the saved client DUID, nil if none.
+func (s *Store) DUID() (dhcpv6.DUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.DUID == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(s.state.DUID)
+	if err != nil {
+		return nil, fmt.Errorf("bad DUID in state file: %v", err)
+	}
+	return dhcpv6.DUIDFromBytes(b)
+}
+
+// SetDUID saves the client DUID. The lease of another DUID is forgotten, the
+// server would not know it.
+func (s *Store) SetDUID(duid dhcpv6.DUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := hex.EncodeToString(duid.ToBytes())
+	if h == s.state.DUID {
+		return nil
+	}
+	s.state.DUID = h
+	s.state.Lease = nil
+	return s.save()
+}
+
+// IAIDs returns n IAIDs: the saved ones first, then new ones following the
+// largest, starting at 1. The new ones are saved.
+func (s *Store) IAIDs(n int) ([]uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n <= len(s.state.IAIDs) {
+		return s.state.IAIDs[:n:n], nil
+	}
+	var last uint32
+	for _, id := range s.state.IAIDs {
+		last = max(last, id)
+	}
+	for len(s.state.IAIDs) < n {
+		last++
+		s.state.IAIDs = append(s.state.IAIDs, last)
+	}
+	return s.state.IAIDs[:n:n], s.save()
+}
+
+// Lease returns the saved lease, nil if none or if it expired. Its server
+// address has no zone, the caller sets it if it's link-local.
+func (s *Store) Lease() (*dhcp6c.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sl := s.state.Lease
+	if sl == nil || s.state.DUID == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(s.state.DUID)
+	if err != nil {
+		return nil, fmt.Errorf("bad DUID in state file: %v", err)
+	}
+	l := &dhcp6c.Lease{Obtained: sl.Obtained, ReconfigureReplay: sl.ReconfigureReplay}
+	if l.ClientID, err = dhcpv6.DUIDFromBytes(b); err != nil {
+		return nil, fmt.Errorf("bad DUID in state file: %v", err)
+	}
+	if b, err = hex.DecodeString(sl.ServerDUID); err == nil {
+		l.ServerID, err = dhcpv6.DUIDFromBytes(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad server DUID in state file: %v", err)
+	}
+	if sl.ReconfigureKey != "" {
+		if l.ReconfigureKey, err = hex.DecodeString(sl.ReconfigureKey); err != nil {
+			return nil, fmt.Errorf("bad Reconfigure Key in state file: %v", err)
+		}
+	}
+	if sl.ServerAddr != "" {
+		ap, err := netip.ParseAddrPort(sl.ServerAddr)
+		if err != nil {
+			return nil, fmt.Errorf("bad server address in state file: %v", err)
+		}
+		l.ServerAddr = net.UDPAddrFromAddrPort(ap)
+	}
+	for _, iapd := range sl.IAPDs {
+		opt := &dhcpv6.OptIAPD{T1: iapd.T1, T2: iapd.T2}
+		binary.BigEndian.PutUint32(opt.IaId[:], iapd.IAID)
+		for _, p := range iapd.Prefixes {
+			opt.Options.Add(&dhcpv6.OptIAPrefix{
+				PreferredLifetime: p.Preferred,
+				ValidLifetime:     p.Valid,
+				Prefix:            &net.IPNet{IP: p.Prefix.Addr().AsSlice(), Mask: net.CIDRMask(p.Prefix.Bits(), 128)},
+			})
+		}
+		l.IAPDs = append(l.IAPDs, opt)
+	}
+	if len(l.IAPDs) == 0 || !time.Now().Before(l.Expires()) {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// SetLease saves lease, nil forgets the saved one (released or expired).
+func (s *Store) SetLease(lease *dhcp6c.Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lease == nil {
+		if s.state.Lease == nil {
+			return nil
+		}
+		s.state.Lease = nil
+		return s.save()
+	}
+	if lease.ClientID != nil {
+		s.state.DUID = hex.EncodeToString(lease.ClientID.ToBytes())
+	}
+	sl := &Lease{
+		ServerDUID:        hex.EncodeToString(lease.ServerID.ToBytes()),
+		Obtained:          lease.Obtained,
+		ReconfigureKey:    hex.EncodeToString(lease.ReconfigureKey),
+		ReconfigureReplay: lease.ReconfigureReplay,
+	}
+	if lease.ServerAddr != nil {
+		// without the zone, the interface may be renamed
+		ap := lease.ServerAddr.AddrPort()
+		sl.ServerAddr = netip.AddrPortFrom(ap.Addr().WithZone(""), ap.Port()).String()
+	}
+	for _, opt := range lease.IAPDs {
+		iapd := IAPD{IAID: binary.BigEndian.Uint32(opt.IaId[:]), T1: opt.T1, T2: opt.T2}
+		for _, p := range opt.Options.Prefixes() {
+			if prefix, ok := NewPrefix(p); ok {
+				iapd.Prefixes = append(iapd.Prefixes, prefix)
+			}
+		}
+		sl.IAPDs = append(sl.IAPDs, iapd)
+	}
+	s.state.Lease = sl
+	return s.save()
+}
+
+// Next implements dhcp6c.ReplayCounter: the current NTP timestamp, or the
+// saved value plus one if it's not larger (the clock went back). The value is
+// saved before being returned.
+func (s *Store) Next() (uint64, error) {
+	ts, _ := s.ntp.Next()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts <= s.state.ReplayCounter {
+		ts = s.state.ReplayCounter + 1
+	}
+	s.state.ReplayCounter = ts
+	if err := s.save(); err != nil {
+		return 0, err
+	}
+	return ts, nil
+}
+
+// save writes the state to the file, creating its directory if needed.
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0o755); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.file, append(b, '\n'))
+}
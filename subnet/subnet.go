@@ -0,0 +1,289 @@
+// Package subnet hands out sub-prefixes of a delegated prefix to named
+// consumers (LAN, guest, IoT, containers...), each asking for a prefix
+// length.
+//
+// A sub-prefix is identified by its subnet ID, its index among the
+// sub-prefixes of its length in the delegation: with a /56, the /64 of ID 3
+// is the fourth one. The IDs are kept (and saved to a file), so a consumer
+// keeps the same subnet across restarts and when the ISP renumbers the
+// delegation: only the delegated part of the address changes.
+//
+//	a, err := subnet.New("subnets.json", subnet.Request{Name: "lan", Length: 64},
+//		subnet.Request{Name: "guest", Length: 64}, subnet.Request{Name: "containers", Length: 60})
+//	alloc, err := a.Allocate(iaPrefix.Prefix)
+//	for _, s := range alloc.Assigned {
+//		...
+//	}
+//
+// When a smaller delegation arrives (a /60 instead of a /56), the consumers
+// whose ID doesn't fit anymore get another free ID (Moved) if there's room,
+// otherwise the last requests lose their subnet (Lost) and Allocate returns
+// ErrExhausted.
+package subnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nspeed-app/testdhcpv6pd/internal/atomicfile"
+)
+
+// maxCandidates bounds the number of IDs tried to find a free one.
+const maxCandidates = 1 << 20
+
+// ErrExhausted is returned (wrapped) when the delegation is too small for
+// all the consumers.
+var ErrExhausted = errors.New("delegated prefix exhausted")
+
+// Request is a consumer asking for a sub-prefix of length Length.
+type Request struct {
+	Name   string
+	Length int
+}
+
+// ParseRequest parses a request as name=length, for instance lan=64.
+func ParseRequest(s string) (Request, error) {
+	name, l, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return Request{}, fmt.Errorf("bad subnet request %q, expecting name=length", s)
+	}
+	length, err := strconv.Atoi(l)
+	if err != nil || length < 1 || length > 128 {
+		return Request{}, fmt.Errorf("bad subnet request %q: bad length", s)
+	}
+	return Request{Name: name, Length: length}, nil
+}
+
+// ID is the subnet ID of a consumer and the length it was given for.
+type ID struct {
+	Length int    `json:"length"`
+	ID     uint64 `json:"id"`
+}
+
+// Assignment is a sub-prefix given to a consumer.
+type Assignment struct {
+	Name   string
+	ID     uint64
+	Prefix *net.IPNet
+}
+
+func (a Assignment) String() string {
+	return fmt.Sprintf("%s=%s (id %d)", a.Name, a.Prefix, a.ID)
+}
+
+// Allocation is the result of Allocate.
+type Allocation struct {
+	// Assigned are the sub-prefixes, in the order of the requests.
+	Assigned []Assignment
+	// Moved are the consumers that got a new subnet ID: their previous one
+	// doesn't fit in the delegation or is taken.
+	Moved []string
+	// Lost are the consumers without a sub-prefix.
+	Lost []string
+}
+
+// Get returns the assignment of consumer name, nil if it has none.
+func (a *Allocation) Get(name string) *Assignment {
+	for i := range a.Assigned {
+		if a.Assigned[i].Name == name {
+			return &a.Assigned[i]
+		}
+	}
+	return nil
+}
+
+// Allocator hands out the sub-prefixes, remembering the subnet IDs.
+type Allocator struct {
+	file     string
+	requests []Request
+	ids      map[string]ID
+}
+
+// New returns an allocator for the requests, keeping the subnet IDs in file
+// (none if empty). The IDs already saved in file are reused.
+func New(file string, requests ...Request) (*Allocator, error) {
+	a := &Allocator{file: file, requests: requests, ids: make(map[string]ID)}
+	for i, r := range requests {
+		if r.Length < 1 || r.Length > 128 {
+			return nil, fmt.Errorf("subnet %s: bad length %d", r.Name, r.Length)
+		}
+		if slices.ContainsFunc(requests[:i], func(o Request) bool { return o.Name == r.Name }) {
+			return nil, fmt.Errorf("subnet %s requested twice", r.Name)
+		}
+	}
+	if file == "" {
+		return a, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &a.ids); err != nil {
+		return nil, fmt.Errorf("bad subnet file %s: %v", file, err)
+	}
+	return a, nil
+}
+
+// IDs returns the subnet IDs of the consumers, including the ones that lost
+// their subnet: they get it back when the delegation is large enough again.
+func (a *Allocator) IDs() map[string]ID {
+	ids := make(map[string]ID, len(a.ids))
+	for k, v := range a.ids {
+		ids[k] = v
+	}
+	return ids
+}
+
+// subPrefix returns the sub-prefix id of length length of delegated.
+func subPrefix(delegated netip.Prefix, length int, id uint64) netip.Prefix {
+	a := delegated.Addr().As16()
+	v := new(big.Int).SetBytes(a[:])
+	v.Add(v, new(big.Int).Lsh(new(big.Int).SetUint64(id), uint(128-length)))
+	v.FillBytes(a[:])
+	return netip.PrefixFrom(netip.AddrFrom16(a), length)
+}
+
+// count returns the number of sub-prefixes of length length in delegated,
+// capped at maxCandidates: the number of IDs tried to find a free one.
+func count(delegated netip.Prefix, length int) uint64 {
+	bits := length - delegated.Bits()
+	if bits >= 20 {
+		return maxCandidates
+	}
+	return 1 << bits
+}
+
+// fits tells if the sub-prefix id of length length is in delegated, whatever
+// the number of IDs searched (a saved ID may be beyond it).
+func fits(delegated netip.Prefix, length int, id uint64) bool {
+	bits := length - delegated.Bits()
+	return bits >= 0 && (bits >= 64 || id>>bits == 0)
+}
+
+// place places reqs in delegated: first the ones whose subnet ID still fits,
+// then the others by decreasing size (in the order of the requests for the
+// same size) on the lowest free IDs. It returns the assignments by name and
+// the consumers left without a subnet.
+func (a *Allocator) place(delegated netip.Prefix, reqs []Request) (map[string]Assignment, []string) {
+	var used []netip.Prefix
+	placed := make(map[string]Assignment)
+	try := func(r Request, id uint64) bool {
+		if !fits(delegated, r.Length, id) {
+			return false
+		}
+		p := subPrefix(delegated, r.Length, id)
+		if slices.ContainsFunc(used, p.Overlaps) {
+			return false
+		}
+		used = append(used, p)
+		placed[r.Name] = Assignment{
+			Name:   r.Name,
+			ID:     id,
+			Prefix: &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(r.Length, 128)},
+		}
+		return true
+	}
+
+	var rest []Request
+	for _, r := range reqs {
+		id, ok := a.ids[r.Name]
+		if !ok || id.Length != r.Length || !try(r, id.ID) {
+			rest = append(rest, r)
+		}
+	}
+	slices.SortStableFunc(rest, func(x, y Request) int {
+		return x.Length - y.Length
+	})
+	var lost []string
+	for _, r := range rest {
+		found := false
+		if r.Length >= delegated.Bits() {
+			for id := uint64(0); id < count(delegated, r.Length) && !found; id++ {
+				found = try(r, id)
+			}
+		}
+		if !found {
+			lost = append(lost, r.Name)
+		}
+	}
+	return placed, lost
+}
+
+// Allocate splits delegated among the consumers. The requests are in
+// priority order: if the delegation is too small for all of them, the last
+// ones lose their subnet first (the ones that still fit after them are
+// kept). The IDs are saved when they change. The error wraps ErrExhausted if
+// a consumer lost its subnet.
+func (a *Allocator) Allocate(delegated *net.IPNet) (*Allocation, error) {
+	addr, ok := netip.AddrFromSlice(delegated.IP)
+	bits, size := delegated.Mask.Size()
+	if !ok || size != 128 {
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", delegated)
+	}
+	dp := netip.PrefixFrom(addr, bits).Masked()
+
+	// the most requests in priority order that fit together, then the
+	// other ones that still fit
+	n := len(a.requests)
+	placed, lost := a.place(dp, a.requests)
+	for len(lost) > 0 && n > 0 {
+		n--
+		placed, lost = a.place(dp, a.requests[:n])
+	}
+	kept := slices.Clone(a.requests[:n])
+	for _, r := range a.requests[n:] {
+		if p, l := a.place(dp, append(kept, r)); len(l) == 0 {
+			kept = append(kept, r)
+			placed = p
+		}
+	}
+
+	alloc := &Allocation{}
+	changed := false
+	for _, r := range a.requests {
+		s, ok := placed[r.Name]
+		if !ok {
+			alloc.Lost = append(alloc.Lost, r.Name)
+			continue
+		}
+		alloc.Assigned = append(alloc.Assigned, s)
+		old, ok := a.ids[r.Name]
+		if ok && old.ID == s.ID && old.Length == r.Length {
+			continue
+		}
+		if ok && old.Length == r.Length {
+			alloc.Moved = append(alloc.Moved, r.Name)
+		}
+		a.ids[r.Name] = ID{Length: r.Length, ID: s.ID}
+		changed = true
+	}
+
+	var errs []error
+	if changed && a.file != "" {
+		errs = append(errs, a.save())
+	}
+	if len(alloc.Lost) > 0 {
+		errs = append(errs, fmt.Errorf("%w: no room in %s for %s", ErrExhausted, dp, strings.Join(alloc.Lost, ", ")))
+	}
+	return alloc, errors.Join(errs...)
+}
+
+// save writes the IDs to the file.
+func (a *Allocator) save() error {
+	b, err := json.MarshalIndent(a.ids, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(a.file, append(b, '\n'))
+}
@@ -0,0 +1,57 @@
+package subnet
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	a, err := New("", Request{Name: "lan", Length: 64}, Request{Name: "guest", Length: 60}, Request{Name: "iot", Length: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, delegated, _ := net.ParseCIDR("2001:db8::/56")
+	alloc, err := a.Allocate(delegated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the /60 first, then the /64 in the order of the requests
+	want := map[string]string{"guest": "2001:db8::/60", "lan": "2001:db8:0:10::/64", "iot": "2001:db8:0:11::/64"}
+	for _, s := range alloc.Assigned {
+		if s.Prefix.String() != want[s.Name] {
+			t.Errorf("%s got %s, want %s", s.Name, s.Prefix, want[s.Name])
+		}
+	}
+}
+
+func TestAllocateSavedID(t *testing.T) {
+	// an ID saved beyond the IDs searched for a free one still fits
+	file := filepath.Join(t.TempDir(), "subnets.json")
+	if err := os.WriteFile(file, []byte(`{"lan": {"length": 64, "id": 5000000}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(file, Request{Name: "lan", Length: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, delegated, _ := net.ParseCIDR("2001:db8::/32")
+	alloc, err := a.Allocate(delegated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alloc.Moved) != 0 || alloc.Assigned[0].ID != 5000000 || alloc.Assigned[0].Prefix.String() != "2001:db8:4c:4b40::/64" {
+		t.Errorf("got %v, moved %v, want the saved ID 5000000", alloc.Assigned, alloc.Moved)
+	}
+
+	// it doesn't fit in a smaller delegation
+	_, delegated, _ = net.ParseCIDR("2001:db8::/48")
+	alloc, err = a.Allocate(delegated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alloc.Moved) != 1 || alloc.Assigned[0].ID != 0 {
+		t.Errorf("got %v, moved %v, want ID 0", alloc.Assigned, alloc.Moved)
+	}
+}
@@ -0,0 +1,219 @@
+package dhcp6c
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Transport carries the DHCPv6 messages of a Client. Any net.PacketConn is a
+// Transport: NewIPv6UDPConn, NewRawConn and the in-memory MemConn are, and so
+// is the ReplayConn of recorded server messages.
+//
+// ReadFrom is called in a loop by a single goroutine and must return the
+// payload of one message per call along with the address it came from (a
+// *net.UDPAddr). Once Close is called, it must return an error wrapping
+// net.ErrClosed.
+//
+// WriteTo sends one message to addr, a *net.UDPAddr which is either the
+// multicast address of the servers (see WithBroadcastAddr) or a server
+// unicast address.
+type Transport interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+	Close() error
+}
+
+// memQueueLen is the number of packets a MemConn buffers, the following ones
+// are dropped like UDP would.
+const memQueueLen = 64
+
+// MemPacket is a packet carried by the in-memory transport.
+type MemPacket struct {
+	Data []byte
+	// From is the local address of the sender and To the destination it
+	// wrote to.
+	From net.Addr
+	To   net.Addr
+}
+
+// MemConn is one end of an in-memory transport, a net.PacketConn without
+// network: what is written to one end is read from the other. See
+// NewMemPipe.
+type MemConn struct {
+	local net.Addr
+	peer  *MemConn
+	in    chan *MemPacket
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mu sync.Mutex
+	// readDeadline is the read deadline, deadlineSet is closed (and
+	// replaced) when it changes so that a blocked read picks it up.
+	readDeadline time.Time
+	deadlineSet  chan struct{}
+}
+
+// Default addresses of NewMemPipe.
+var (
+	MemClientAddr = &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort, Zone: "mem"}
+	MemServerAddr = &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: dhcpv6.DefaultServerPort, Zone: "mem"}
+)
+
+// NewMemPipe returns the two connected ends of an in-memory transport: the
+// client end is given to NewWithConn while a test (or a fake server) plays
+// the server on the other end, whatever the destination address the client
+// writes to. clientAddr and serverAddr are the addresses each end reads
+// packets from, MemClientAddr and MemServerAddr if nil.
+func NewMemPipe(clientAddr, serverAddr *net.UDPAddr) (client *MemConn, server *MemConn) {
+	if clientAddr == nil {
+		clientAddr = MemClientAddr
+	}
+	if serverAddr == nil {
+		serverAddr = MemServerAddr
+	}
+	client = newMemConn(clientAddr)
+	server = newMemConn(serverAddr)
+	client.peer = server
+	server.peer = client
+	return client, server
+}
+
+func newMemConn(local net.Addr) *MemConn {
+	return &MemConn{
+		local:       local,
+		in:          make(chan *MemPacket, memQueueLen),
+		done:        make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+}
+
+func (c *MemConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "mem", Source: c.local, Addr: addr, Err: err}
+}
+
+// ReadPacket returns the next packet written by the other end.
+func (c *MemConn) ReadPacket() (*MemPacket, error) {
+	for {
+		c.mu.Lock()
+		deadline, set := c.readDeadline, c.deadlineSet
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var p *MemPacket
+		var err error
+		select {
+		case <-c.done:
+			err = c.opError("read", nil, net.ErrClosed)
+		case p = <-c.in:
+		case <-timeout:
+			err = c.opError("read", nil, os.ErrDeadlineExceeded)
+		case <-set:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if p != nil || err != nil {
+			return p, err
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *MemConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p, err := c.ReadPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, p.Data), p.From, nil
+}
+
+// ReadMessage reads the next packet and parses it as a DHCPv6 message, it
+// returns the address to answer to.
+func (c *MemConn) ReadMessage() (*dhcpv6.Message, net.Addr, error) {
+	p, err := c.ReadPacket()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := dhcpv6.MessageFromBytes(p.Data)
+	if err != nil {
+		return nil, p.From, err
+	}
+	return msg, p.From, nil
+}
+
+// WriteTo implements net.PacketConn: b is queued for the other end, or
+// dropped if the other end is closed or its queue is full.
+func (c *MemConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.opError("write", addr, net.ErrClosed)
+	default:
+	}
+	p := &MemPacket{Data: append([]byte(nil), b...), From: c.local, To: addr}
+	select {
+	case <-c.peer.done:
+	case c.peer.in <- p:
+	default:
+	}
+	return len(b), nil
+}
+
+// WriteMessage writes msg to addr.
+func (c *MemConn) WriteMessage(msg dhcpv6.DHCPv6, addr net.Addr) error {
+	_, err := c.WriteTo(msg.ToBytes(), addr)
+	return err
+}
+
+// Close unblocks the pending reads, the following ones and the writes fail
+// with net.ErrClosed.
+func (c *MemConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+// Done returns a channel closed when Close is called.
+func (c *MemConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// LocalAddr returns the address the packets written by this end come from.
+func (c *MemConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// SetDeadline sets the read deadline, writes never block.
+func (c *MemConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (c *MemConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn, writes never block.
+func (c *MemConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}